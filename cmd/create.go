@@ -22,14 +22,16 @@ import (
 	"fmt"
 	"hpc-toolkit/pkg/config"
 	"hpc-toolkit/pkg/modulewriter"
-	"log"
+	"hpc-toolkit/pkg/sourcereader"
 	"os"
 
 	"github.com/spf13/cobra"
 )
 
 const msgCLIVars = "Comma-separated list of name=value variables to override YAML configuration. Can be used multiple times."
-const msgCLIBackendConfig = "Comma-separated list of name=value variables to set Terraform backend configuration. Can be used multiple times."
+const msgCLIBackendConfig = "Comma-separated list of name=value variables to set Terraform backend configuration. " +
+	"Use group:name=value to configure the backend of a single deployment group, " +
+	"and group:type=value to replace it. Can be used multiple times."
 
 func init() {
 	createCmd.Flags().StringVarP(&bpFilename, "config", "c", "",
@@ -46,8 +48,21 @@ func init() {
 	createCmd.Flags().BoolVarP(&overwriteDeployment, "overwrite-deployment", "w", false,
 		"If specified, an existing deployment directory is overwritten by the new deployment. \n"+
 			"Note: Terraform state IS preserved. \n"+
-			"Note: Terraform workspaces are NOT supported (behavior undefined). \n"+
-			"Note: Packer is NOT supported.")
+			"Note: Terraform groups whose backend changed are marked for state migration. \n"+
+			"Note: Packer manifests, *.pkrvars.hcl overrides and build logs ARE preserved. \n"+
+			"Note: Terraform workspaces are NOT supported (behavior undefined).")
+	createCmd.Flags().BoolVar(&allowGroupRemoval, "allow-group-removal", false,
+		"Allow overwriting a deployment with a blueprint that removes deployment groups. \n"+
+			"The removed groups and their Terraform state are archived in the .ghpc directory.")
+	createCmd.Flags().BoolVar(&forceOverwrite, "force", false,
+		"Overwrite an existing deployment even if its files were changed after it was created.")
+	createCmd.Flags().BoolVar(&dryRun, "dry-run", false,
+		"Print the changes that would be made to the deployment directory without writing it.")
+	createCmd.Flags().IntVar(&historyLimit, "history-limit", modulewriter.DefaultHistoryLimit,
+		"Number of generations of the deployment kept in its history.")
+	createCmd.Flags().StringVar(&outputFormat, "format", modulewriter.FormatHCL,
+		fmt.Sprintf("Syntax of the generated Terraform files, one of (%q, %q).",
+			modulewriter.FormatHCL, modulewriter.FormatTFJSON))
 	rootCmd.AddCommand(createCmd)
 }
 
@@ -58,6 +73,11 @@ var (
 
 	cliBEConfigVars     []string
 	overwriteDeployment bool
+	forceOverwrite      bool
+	allowGroupRemoval   bool
+	dryRun              bool
+	historyLimit        int
+	outputFormat        string
 	validationLevel     string
 	validationLevelDesc = "Set validation level to one of (\"ERROR\", \"WARNING\", \"IGNORE\")"
 	createCmd           = &cobra.Command{
@@ -81,27 +101,39 @@ func runCreateCmd(cmd *cobra.Command, args []string) {
 
 	deploymentConfig, err := config.NewDeploymentConfig(bpFilename)
 	if err != nil {
-		log.Fatal(err)
+		logFatal(err)
 	}
 	if err := deploymentConfig.SetCLIVariables(cliVariables); err != nil {
-		log.Fatalf("Failed to set the variables at CLI: %v", err)
+		logFatalf("Failed to set the variables at CLI: %v", err)
 	}
 	if err := deploymentConfig.SetBackendConfig(cliBEConfigVars); err != nil {
-		log.Fatalf("Failed to set the backend config at CLI: %v", err)
+		logFatalf("Failed to set the backend config at CLI: %v", err)
 	}
 	if err := deploymentConfig.SetValidationLevel(validationLevel); err != nil {
-		log.Fatal(err)
+		logFatal(err)
 	}
 	if err := deploymentConfig.ExpandConfig(); err != nil {
-		log.Fatal(err)
+		logFatal(err)
 	}
-	if err := modulewriter.WriteDeployment(&deploymentConfig.Config, outputDir, overwriteDeployment); err != nil {
+	writeOptions := modulewriter.WriteOptions{
+		Overwrite:         overwriteDeployment,
+		AllowGroupRemoval: allowGroupRemoval,
+		Force:             forceOverwrite,
+		DryRun:            dryRun,
+		HistoryLimit:      historyLimit,
+		Format:            outputFormat,
+		GhpcVersion:       rootCmd.Version,
+		GhpcCommit:        GitCommitInfo,
+	}
+	if err := modulewriter.WriteDeployment(&deploymentConfig.Config, outputDir, writeOptions); err != nil {
 		var target *modulewriter.OverwriteDeniedError
-		if errors.As(err, &target) {
+		var drift *modulewriter.DriftError
+		if errors.As(err, &target) || errors.As(err, &drift) {
 			fmt.Printf("\n%s\n", err.Error())
+			sourcereader.RemoveGitClones()
 			os.Exit(1)
 		} else {
-			log.Fatal(err)
+			logFatal(err)
 		}
 	}
 }
@@ -0,0 +1,85 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	. "gopkg.in/check.v1"
+)
+
+// runGhpc runs ghpc with the arguments in a new process, which log.Fatal may
+// exit, with the temporary files of the process kept in tmpDir
+func runGhpc(tmpDir string, args ...string) error {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "GHPC_TEST_ARGS="+strings.Join(args, " "), "TMPDIR="+tmpDir)
+	return cmd.Run()
+}
+
+/* Tests */
+// create.go
+func (s *MySuite) TestCreate_FailureRemovesGitClones(c *C) {
+	// Setup: a git repository holding a module
+	testDir := c.MkDir()
+	repoDir := filepath.Join(testDir, "repo")
+	c.Assert(os.MkdirAll(filepath.Join(repoDir, "module"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(repoDir, "module", "main.tf"),
+		[]byte("variable \"name\" {\n  type = string\n}\n"), 0644), IsNil)
+	repo, err := git.PlainInit(repoDir, false)
+	c.Assert(err, IsNil)
+	tree, err := repo.Worktree()
+	c.Assert(err, IsNil)
+	_, err = tree.Add("module/main.tf")
+	c.Assert(err, IsNil)
+	_, err = tree.Commit("add module", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	c.Assert(err, IsNil)
+
+	// a blueprint that fails validation once its module was cloned
+	bpFile := filepath.Join(testDir, "blueprint.yaml")
+	bp := fmt.Sprintf(`blueprint_name: clones
+vars:
+  deployment_name: clones
+terraform_backend_defaults:
+  type: gcs
+deployment_groups:
+- group: primary
+  modules:
+  - id: mod
+    source: git::file://%s//module
+    settings:
+      name: test
+`, repoDir)
+	c.Assert(ioutil.WriteFile(bpFile, []byte(bp), 0644), IsNil)
+
+	tmpDir := filepath.Join(testDir, "tmp")
+	c.Assert(os.Mkdir(tmpDir, 0755), IsNil)
+	err = runGhpc(tmpDir, "create", bpFile, "-o", testDir, "-l", "IGNORE")
+	c.Assert(err, NotNil)
+	clones, err := filepath.Glob(filepath.Join(tmpDir, "git-repo-*"))
+	c.Assert(err, IsNil)
+	c.Check(clones, HasLen, 0)
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"hpc-toolkit/pkg/shell"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	deployCmd.Flags().StringSliceVar(&deployGroups, "groups", nil,
+		"Comma-separated list of deployment groups to deploy, after the listed groups they depend on. All groups are deployed by default.")
+	deployCmd.Flags().BoolVar(&autoApprove, "auto-approve", false,
+		"Apply Terraform changes without asking for approval.")
+	deployCmd.Flags().BoolVar(&resumeDeploy, "resume", false,
+		"Skip the deployment groups deployed by the previous run, which failed.")
+	deployCmd.Flags().BoolVar(&parallelDeploy, "parallel", false,
+		"Deploy the groups that do not depend on each other at the same time. Requires --auto-approve.")
+	deployCmd.Flags().StringVar(&terraformBinary, "terraform-binary", shell.DefaultBinaries.Terraform,
+		"Path to the terraform executable.")
+	deployCmd.Flags().StringVar(&packerBinary, "packer-binary", shell.DefaultBinaries.Packer,
+		"Path to the packer executable.")
+	rootCmd.AddCommand(deployCmd)
+}
+
+var (
+	deployGroups    []string
+	autoApprove     bool
+	resumeDeploy    bool
+	parallelDeploy  bool
+	terraformBinary string
+	packerBinary    string
+	deployCmd       = &cobra.Command{
+		Use:   "deploy DEPLOYMENT_DIR",
+		Short: "Deploy the deployment groups of a deployment directory.",
+		Long: "Runs Terraform or Packer in each deployment group of a deployment directory, " +
+			"after the groups it depends on, and stops at the first group that fails. The output of each group is " +
+			"logged in the .ghpc/logs directory of the deployment.",
+		Run:  runDeployCmd,
+		Args: cobra.ExactArgs(1),
+	}
+)
+
+func runDeployCmd(cmd *cobra.Command, args []string) {
+	opts := shell.DeployOptions{
+		Binaries:    shell.Binaries{Terraform: terraformBinary, Packer: packerBinary},
+		Groups:      deployGroups,
+		AutoApprove: autoApprove,
+		Resume:      resumeDeploy,
+		Parallel:    parallelDeploy,
+	}
+	if err := shell.Deploy(args[0], opts); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"hpc-toolkit/pkg/shell"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	destroyCmd.Flags().BoolVar(&autoApprove, "auto-approve", false,
+		"Destroy Terraform resources without asking for approval.")
+	destroyCmd.Flags().StringVar(&terraformBinary, "terraform-binary", shell.DefaultBinaries.Terraform,
+		"Path to the terraform executable.")
+	rootCmd.AddCommand(destroyCmd)
+}
+
+var destroyCmd = &cobra.Command{
+	Use:   "destroy DEPLOYMENT_DIR",
+	Short: "Destroy the deployment groups of a deployment directory.",
+	Long: "Runs terraform destroy in each Terraform deployment group of a deployment directory, " +
+		"in the reverse order of deployment, and stops at the first group that fails. " +
+		"Images built by Packer groups are not destroyed.",
+	Run:  runDestroyCmd,
+	Args: cobra.ExactArgs(1),
+}
+
+func runDestroyCmd(cmd *cobra.Command, args []string) {
+	opts := shell.DestroyOptions{
+		Binaries:    shell.Binaries{Terraform: terraformBinary},
+		AutoApprove: autoApprove,
+	}
+	if err := shell.Destroy(args[0], opts); err != nil {
+		log.Fatal(err)
+	}
+}
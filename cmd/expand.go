@@ -18,7 +18,6 @@ package cmd
 import (
 	"fmt"
 	"hpc-toolkit/pkg/config"
-	"log"
 
 	"github.com/spf13/cobra"
 )
@@ -35,17 +34,21 @@ func init() {
 	expandCmd.Flags().StringSliceVar(&cliBEConfigVars, "backend-config", nil, msgCLIBackendConfig)
 	expandCmd.Flags().StringVarP(&validationLevel, "validation-level", "l", "WARNING",
 		validationLevelDesc)
+	expandCmd.Flags().BoolVar(&showSensitive, "show-sensitive", false,
+		"Keep the values of sensitive settings and variables in the expanded blueprint.")
 	rootCmd.AddCommand(expandCmd)
 }
 
 var (
 	outputFilename string
+	showSensitive  bool
 	expandCmd      = &cobra.Command{
 		Use:   "expand BLUEPRINT_NAME",
 		Short: "Expand the Environment Blueprint.",
-		Long:  "Updates the Environment Blueprint in the same way as create, but without writing the deployment.",
-		Run:   runExpandCmd,
-		Args:  cobra.ExactArgs(1),
+		Long: "Updates the Environment Blueprint in the same way as create, but without writing the deployment. " +
+			"The values of sensitive settings and variables are redacted, unless --show-sensitive is set.",
+		Run:  runExpandCmd,
+		Args: cobra.ExactArgs(1),
 	}
 )
 
@@ -61,21 +64,21 @@ func runExpandCmd(cmd *cobra.Command, args []string) {
 
 	deploymentConfig, err := config.NewDeploymentConfig(bpFilename)
 	if err != nil {
-		log.Fatal(err)
+		logFatal(err)
 	}
 	if err := deploymentConfig.SetCLIVariables(cliVariables); err != nil {
-		log.Fatalf("Failed to set the variables at CLI: %v", err)
+		logFatalf("Failed to set the variables at CLI: %v", err)
 	}
 	if err := deploymentConfig.SetBackendConfig(cliBEConfigVars); err != nil {
-		log.Fatalf("Failed to set the backend config at CLI: %v", err)
+		logFatalf("Failed to set the backend config at CLI: %v", err)
 	}
 	if err := deploymentConfig.SetValidationLevel(validationLevel); err != nil {
-		log.Fatal(err)
+		logFatal(err)
 	}
 	if err := deploymentConfig.ExpandConfig(); err != nil {
-		log.Fatal(err)
+		logFatal(err)
 	}
-	deploymentConfig.ExportBlueprint(outputFilename)
+	deploymentConfig.ExportBlueprint(outputFilename, showSensitive)
 	fmt.Printf(
 		"Expanded Environment Definition created successfully, saved as %s.\n", outputFilename)
 }
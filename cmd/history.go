@@ -0,0 +1,70 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/modulewriter"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	historyCmd.AddCommand(historyListCmd)
+	rootCmd.AddCommand(historyCmd)
+}
+
+var (
+	historyCmd = &cobra.Command{
+		Use:   "history",
+		Short: "Inspect the history of a deployment.",
+		Long: "Each time a deployment directory is written, a snapshot of its deployment groups, " +
+			"blueprint and manifest is recorded in its history.",
+	}
+	historyListCmd = &cobra.Command{
+		Use:   "list DEPLOYMENT_DIR",
+		Short: "List the generations recorded in the history of a deployment.",
+		Run:   runHistoryListCmd,
+		Args:  cobra.ExactArgs(1),
+	}
+)
+
+func runHistoryListCmd(cmd *cobra.Command, args []string) {
+	entries, err := modulewriter.ListHistory(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No history found for deployment %s.\n", args[0])
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCREATED\tGHPC VERSION\tBLUEPRINT\t")
+	for i, e := range entries {
+		current := ""
+		if i == len(entries)-1 {
+			current = "(current)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.ID, e.Manifest.CreatedAt.Format(time.RFC3339),
+			e.Manifest.GhpcVersion, e.Manifest.BlueprintName, current)
+	}
+	w.Flush()
+}
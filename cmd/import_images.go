@@ -0,0 +1,57 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/modulewriter"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/maps"
+)
+
+func init() {
+	rootCmd.AddCommand(importImagesCmd)
+}
+
+var importImagesCmd = &cobra.Command{
+	Use:   "import-images DEPLOYMENT_GROUP_DIR",
+	Short: "Supply images built by Packer to a Terraform deployment group.",
+	Long: "Reads the names of the images built by Packer modules of earlier deployment groups " +
+		"from their Packer manifests and writes them to the variables of a deployment group. " +
+		"Fails if an image has not been built yet.",
+	Run:  runImportImagesCmd,
+	Args: cobra.ExactArgs(1),
+}
+
+func runImportImagesCmd(cmd *cobra.Command, args []string) {
+	groupDir := filepath.Clean(args[0])
+	images, err := modulewriter.ImportPackerImages(filepath.Dir(groupDir), filepath.Base(groupDir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(images) == 0 {
+		fmt.Printf("Deployment group %s does not use any images built by Packer.\n", groupDir)
+		return
+	}
+	variables := maps.Keys(images)
+	sort.Strings(variables)
+	for _, variable := range variables {
+		fmt.Printf("%s = %s\n", variable, images[variable])
+	}
+}
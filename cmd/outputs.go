@@ -0,0 +1,95 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hpc-toolkit/pkg/shell"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	outputsCmd.Flags().BoolVar(&outputsJSON, "json", false,
+		"Print the outputs in JSON, including sensitive values. The output of Terraform is printed to stderr.")
+	outputsCmd.Flags().StringVar(&terraformBinary, "terraform-binary", shell.DefaultBinaries.Terraform,
+		"Path to the terraform executable.")
+	rootCmd.AddCommand(outputsCmd)
+}
+
+var (
+	outputsJSON bool
+	outputsCmd  = &cobra.Command{
+		Use:   "outputs DEPLOYMENT_DIR",
+		Short: "Print the outputs of the deployment.",
+		Long: "Collects the values of the outputs listed in the outputs section of the blueprint " +
+			"from the deployment groups they are written to. Outputs of groups with a remote " +
+			"Terraform backend are read with terraform output.",
+		Run:  runOutputsCmd,
+		Args: cobra.ExactArgs(1),
+	}
+)
+
+func runOutputsCmd(cmd *cobra.Command, args []string) {
+	opts := shell.OutputsOptions{Binaries: shell.Binaries{Terraform: terraformBinary}}
+	if outputsJSON {
+		// keep stdout for the outputs
+		opts.Stdout = os.Stderr
+	}
+	outputs, err := shell.DeploymentOutputs(args[0], opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if outputsJSON {
+		values := make(map[string]shell.DeploymentOutput)
+		for _, out := range outputs {
+			values[out.Name] = out
+		}
+		b, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+
+	if len(outputs) == 0 {
+		fmt.Println("The blueprint of the deployment has no outputs.")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tGROUP\tVALUE\t")
+	for _, out := range outputs {
+		value := "(not applied)"
+		switch {
+		case out.Sensitive:
+			value = "(sensitive)"
+		case out.Applied:
+			var b bytes.Buffer
+			if err := json.Compact(&b, out.Value); err != nil {
+				log.Fatal(err)
+			}
+			value = b.String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", out.Name, out.Group, value)
+	}
+	w.Flush()
+}
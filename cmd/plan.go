@@ -0,0 +1,67 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"hpc-toolkit/pkg/shell"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	planCmd.Flags().BoolVar(&planJSON, "json", false,
+		"Print the report in JSON. The output of Terraform is printed to stderr.")
+	planCmd.Flags().StringVar(&terraformBinary, "terraform-binary", shell.DefaultBinaries.Terraform,
+		"Path to the terraform executable.")
+	rootCmd.AddCommand(planCmd)
+}
+
+var (
+	planJSON bool
+	planCmd  = &cobra.Command{
+		Use:   "plan DEPLOYMENT_DIR",
+		Short: "Plan the changes to every deployment group.",
+		Long: "Runs terraform plan in each Terraform deployment group of a deployment directory, " +
+			"in order, and reports the resources that would be added, changed and destroyed " +
+			"per group and module.",
+		Run:  runPlanCmd,
+		Args: cobra.ExactArgs(1),
+	}
+)
+
+func runPlanCmd(cmd *cobra.Command, args []string) {
+	opts := shell.PlanOptions{Binaries: shell.Binaries{Terraform: terraformBinary}}
+	if planJSON {
+		// keep stdout for the report
+		opts.Stdout = os.Stderr
+	}
+	report, err := shell.Plan(args[0], opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !planJSON {
+		fmt.Print(report.String())
+		return
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(b))
+}
@@ -0,0 +1,52 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/modulewriter"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	restoreGroupCmd.Flags().StringVar(&archiveID, "archive", "",
+		"ID of the archive to restore the group from. Defaults to the most recent archive of the group.")
+	rootCmd.AddCommand(restoreGroupCmd)
+}
+
+var (
+	archiveID       string
+	restoreGroupCmd = &cobra.Command{
+		Use:   "restore-group DEPLOYMENT_DIR GROUP",
+		Short: "Restore a deployment group that was archived when it was removed.",
+		Long: "Moves a deployment group, along with its Terraform state, from the archive in " +
+			"the .ghpc directory back into the deployment directory and adds it to the deployment manifest.",
+		Run:  runRestoreGroupCmd,
+		Args: cobra.ExactArgs(2),
+	}
+)
+
+func runRestoreGroupCmd(cmd *cobra.Command, args []string) {
+	deploymentDir, group := args[0], args[1]
+	id, err := modulewriter.RestoreGroup(deploymentDir, group, archiveID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Deployment group %s was restored from archive %s.\n", group, id)
+	fmt.Println("Add the group back to the blueprint before overwriting the deployment again.")
+}
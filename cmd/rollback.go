@@ -0,0 +1,56 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/modulewriter"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rollbackCmd.Flags().BoolVar(&forceOverwrite, "force", false,
+		"Roll back even if files of the deployment were changed after it was created.")
+	rollbackCmd.Flags().BoolVar(&allowGroupRemoval, "allow-group-removal", false,
+		"Allow rolling back to a generation that does not contain some of the current deployment groups.")
+	rollbackCmd.Flags().IntVar(&historyLimit, "history-limit", modulewriter.DefaultHistoryLimit,
+		"Number of generations of the deployment kept in its history.")
+	rootCmd.AddCommand(rollbackCmd)
+}
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback DEPLOYMENT_DIR ID",
+	Short: "Regenerate a deployment from its history.",
+	Long: "Replaces the deployment groups of a deployment directory with a generation recorded " +
+		"in its history, keeping the current Terraform state. Use \"ghpc history list\" to find the ID.",
+	Run:  runRollbackCmd,
+	Args: cobra.ExactArgs(2),
+}
+
+func runRollbackCmd(cmd *cobra.Command, args []string) {
+	deploymentDir, id := args[0], args[1]
+	opts := modulewriter.WriteOptions{
+		Force:             forceOverwrite,
+		AllowGroupRemoval: allowGroupRemoval,
+		HistoryLimit:      historyLimit,
+	}
+	if err := modulewriter.RollbackDeployment(deploymentDir, id, opts); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Deployment %s was rolled back to %s.\n", deploymentDir, id)
+}
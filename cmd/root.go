@@ -19,6 +19,7 @@ package cmd
 
 import (
 	"fmt"
+	"hpc-toolkit/pkg/sourcereader"
 	"log"
 	"os"
 	"path/filepath"
@@ -78,9 +79,25 @@ Built from '{{index .Annotations "branch"}}' branch.
 Commit info: {{index .Annotations "commitInfo"}}
 `)
 	}
+	// git modules are cloned once and shared by every step of a command;
+	// commands exiting with an error remove them with logFatal
+	defer sourcereader.RemoveGitClones()
 	return rootCmd.Execute()
 }
 
+// logFatal removes the git clones of this run before calling log.Fatal, which
+// exits without running deferred calls
+func logFatal(v ...interface{}) {
+	sourcereader.RemoveGitClones()
+	log.Fatal(v...)
+}
+
+// logFatalf is logFatal with a format
+func logFatalf(format string, v ...interface{}) {
+	sourcereader.RemoveGitClones()
+	log.Fatalf(format, v...)
+}
+
 func init() {}
 
 // checkGitHashMismatch will compare the hash of the git repository vs the git
@@ -20,6 +20,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/go-git/go-billy/v5"
@@ -46,6 +47,14 @@ func Test(t *testing.T) {
 }
 
 func TestMain(m *testing.M) {
+	// run ghpc instead of the tests in processes started by runGhpc
+	if args := os.Getenv("GHPC_TEST_ARGS"); args != "" {
+		rootCmd.SetArgs(strings.Split(args, " "))
+		if err := Execute(); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	setup()
 	code := m.Run()
 	os.Exit(code)
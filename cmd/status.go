@@ -0,0 +1,87 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/shell"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/maps"
+)
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status DEPLOYMENT_DIR",
+	Short: "Summarize the state of each deployment group.",
+	Long: "Inspects the local Terraform state and Packer manifests of each deployment group " +
+		"and reports whether it was applied, its resources and outputs, and whether the " +
+		"deployment was written after it was last applied. Groups with a remote Terraform " +
+		"backend are reported as unknown, as their state is not inspected.",
+	Run:  runStatusCmd,
+	Args: cobra.ExactArgs(1),
+}
+
+func runStatusCmd(cmd *cobra.Command, args []string) {
+	manifest, statuses, err := shell.DeploymentStatus(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Deployment %s written at %s\n\n",
+		manifest.DeploymentName, manifest.CreatedAt.Format(time.RFC3339))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tKIND\tSTATE\tRESOURCES\tLAST APPLIED\t")
+	for _, s := range statuses {
+		resources, lastApplied := "-", "-"
+		if s.Kind == "terraform" && s.Backend == "" {
+			resources = fmt.Sprint(s.Resources)
+		}
+		if s.Applied {
+			lastApplied = s.LastApplied.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t\n", s.Name, s.Kind, s.State(), resources, lastApplied)
+	}
+	w.Flush()
+
+	for _, s := range statuses {
+		switch {
+		case s.Backend != "":
+			fmt.Printf("\nThe state of group %s is kept in a %s backend.\n", s.Name, s.Backend)
+		case len(s.Outputs) > 0:
+			fmt.Printf("\nOutputs of group %s:\n", s.Name)
+			printSorted(s.Outputs)
+		case len(s.Images) > 0:
+			fmt.Printf("\nImages built by group %s:\n", s.Name)
+			printSorted(s.Images)
+		}
+	}
+}
+
+func printSorted(values map[string]string) {
+	keys := maps.Keys(values)
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("  %s = %s\n", k, values[k])
+	}
+}
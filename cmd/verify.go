@@ -0,0 +1,67 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmd defines command line utilities for ghpc
+package cmd
+
+import (
+	"fmt"
+	"hpc-toolkit/pkg/modulewriter"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	verifyCmd.Flags().BoolVar(&acceptDrift, "accept", false,
+		"Record the current files of the deployment as expected, so they are no longer reported as changed.")
+	rootCmd.AddCommand(verifyCmd)
+}
+
+var (
+	acceptDrift bool
+	verifyCmd   = &cobra.Command{
+		Use:   "verify DEPLOYMENT_DIR",
+		Short: "Detect manual changes to a deployment directory.",
+		Long: "Compares the files of each deployment group against the digests recorded " +
+			"when the deployment was created and lists modified, added and deleted files.",
+		Run:  runVerifyCmd,
+		Args: cobra.ExactArgs(1),
+	}
+)
+
+func runVerifyCmd(cmd *cobra.Command, args []string) {
+	deploymentDir := args[0]
+	if acceptDrift {
+		if err := modulewriter.AcceptDrift(deploymentDir); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Current files of deployment %s have been accepted.\n", deploymentDir)
+		return
+	}
+
+	drift, err := modulewriter.VerifyDeployment(deploymentDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(drift) == 0 {
+		fmt.Printf("No changes found in deployment %s.\n", deploymentDir)
+		return
+	}
+	for _, d := range drift {
+		fmt.Print(d.String())
+	}
+	os.Exit(1)
+}
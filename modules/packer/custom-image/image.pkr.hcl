@@ -93,5 +93,9 @@ build {
     }
   }
 
-  post-processor "manifest" {}
+  # ghpc reads the name of the image from this file to supply it to later
+  # deployment groups that refer to $(group.module.image_name)
+  post-processor "manifest" {
+    output = "packer-manifest.json"
+  }
 }
@@ -0,0 +1,193 @@
+/**
+ * Copyright 2022 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// backendSchema describes the configuration of a type of Terraform backend
+type backendSchema struct {
+	required []string
+	optional []string
+	// sensitive are the settings holding credentials, which are redacted
+	// wherever the blueprint is recorded
+	sensitive []string
+	// uniqueKey is the setting that keeps apart the states of deployment
+	// groups sharing a backend, if there is one
+	uniqueKey string
+	// uniqueValue returns the value of uniqueKey for a deployment group from
+	// the value inherited from terraform_backend_defaults, if any, or else
+	// from the path identifying the deployment. An empty value leaves
+	// uniqueKey unset.
+	uniqueValue func(inherited string, deployment string, group string) string
+}
+
+// uniquePrefix appends the deployment group to the inherited prefix, or else
+// to the path of the deployment
+func uniquePrefix(inherited string, deployment string, group string) string {
+	if inherited != "" {
+		return strings.TrimSuffix(inherited, "/") + "/" + group
+	}
+	return deployment + "/" + group
+}
+
+// uniqueStateFile places the state file of each deployment group in a
+// directory named after the group, next to the inherited state file or else
+// under the path of the deployment
+func uniqueStateFile(inherited string, deployment string, group string) string {
+	if inherited != "" {
+		return path.Join(path.Dir(inherited), group, path.Base(inherited))
+	}
+	return path.Join(deployment, group, "terraform.tfstate")
+}
+
+// uniqueLocalPath places the inherited local state file in a directory named
+// after the group; without one, the state is kept in the group directory
+func uniqueLocalPath(inherited string, deployment string, group string) string {
+	if inherited == "" {
+		return ""
+	}
+	return path.Join(path.Dir(inherited), group, path.Base(inherited))
+}
+
+// backendSchemas are the types of Terraform backends whose configuration is
+// validated. The configuration of other types is used as is.
+var backendSchemas = map[string]backendSchema{
+	"gcs": {
+		required: []string{"bucket"},
+		optional: []string{
+			"access_token", "credentials", "encryption_key", "impersonate_service_account",
+			"impersonate_service_account_delegates", "kms_encryption_key", "prefix",
+			"storage_custom_endpoint",
+		},
+		sensitive:   []string{"access_token", "credentials", "encryption_key"},
+		uniqueKey:   "prefix",
+		uniqueValue: uniquePrefix,
+	},
+	"s3": {
+		required: []string{"bucket"},
+		optional: []string{
+			"access_key", "acl", "assume_role", "assume_role_with_web_identity",
+			"custom_ca_bundle", "dynamodb_endpoint", "dynamodb_table", "ec2_metadata_service_endpoint",
+			"encrypt", "endpoint", "endpoints", "force_path_style", "iam_endpoint", "key",
+			"kms_key_id", "max_retries", "profile", "region", "role_arn", "secret_key",
+			"shared_config_files", "shared_credentials_file", "shared_credentials_files",
+			"skip_credentials_validation", "skip_metadata_api_check", "skip_region_validation",
+			"sse_customer_key", "sts_endpoint", "token", "use_path_style", "workspace_key_prefix",
+		},
+		sensitive:   []string{"access_key", "secret_key", "sse_customer_key", "token"},
+		uniqueKey:   "key",
+		uniqueValue: uniqueStateFile,
+	},
+	"azurerm": {
+		required: []string{"container_name", "storage_account_name"},
+		optional: []string{
+			"access_key", "client_certificate_password", "client_certificate_path", "client_id",
+			"client_secret", "endpoint", "environment", "key", "metadata_host", "msi_endpoint",
+			"oidc_request_token", "oidc_request_url", "oidc_token", "oidc_token_file_path",
+			"resource_group_name", "sas_token", "snapshot", "subscription_id", "tenant_id",
+			"use_azuread_auth", "use_msi", "use_oidc",
+		},
+		sensitive: []string{
+			"access_key", "client_certificate_password", "client_secret", "oidc_request_token",
+			"oidc_token", "sas_token",
+		},
+		uniqueKey:   "key",
+		uniqueValue: uniqueStateFile,
+	},
+	// local state is kept in the directory of each deployment group
+	"local": {
+		optional:    []string{"path", "workspace_dir"},
+		uniqueKey:   "path",
+		uniqueValue: uniqueLocalPath,
+	},
+	"http": {
+		required: []string{"address"},
+		optional: []string{
+			"client_ca_certificate_pem", "client_certificate_pem", "client_private_key_pem",
+			"lock_address", "lock_method", "password", "retry_max", "retry_wait_max",
+			"retry_wait_min", "skip_cert_verification", "unlock_address", "unlock_method",
+			"update_method", "username",
+		},
+		sensitive: []string{"client_private_key_pem", "password"},
+	},
+	"consul": {
+		optional: []string{
+			"access_token", "address", "ca_file", "cert_file", "datacenter", "gzip",
+			"http_auth", "key_file", "lock", "path", "scheme",
+		},
+		sensitive:   []string{"access_token", "http_auth"},
+		uniqueKey:   "path",
+		uniqueValue: uniquePrefix,
+	},
+}
+
+// validateBackend verifies that the configuration of a backend of a known
+// type sets every required setting and no unknown setting
+func validateBackend(backend TerraformBackend) error {
+	schema, ok := backendSchemas[backend.Type]
+	if !ok {
+		return nil
+	}
+	for _, key := range schema.required {
+		if _, ok := backend.Configuration[key]; !ok {
+			return fmt.Errorf("%s backends require the setting %s", backend.Type, key)
+		}
+	}
+	keys := maps.Keys(backend.Configuration)
+	slices.Sort(keys)
+	for _, key := range keys {
+		if !slices.Contains(schema.required, key) && !slices.Contains(schema.optional, key) {
+			return fmt.Errorf("%s backends have no setting %s, expected one of %s",
+				backend.Type, key, strings.Join(append(slices.Clone(schema.required), schema.optional...), ", "))
+		}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the backend in which the settings holding
+// credentials are redacted
+func (b TerraformBackend) Redacted() TerraformBackend {
+	return b.replaceCredentials(func(c map[string]interface{}, key string) { c[key] = redactedValue })
+}
+
+// WithoutCredentials returns a copy of the backend without the settings
+// holding credentials, which are then read from the environment
+func (b TerraformBackend) WithoutCredentials() TerraformBackend {
+	return b.replaceCredentials(func(c map[string]interface{}, key string) { delete(c, key) })
+}
+
+func (b TerraformBackend) replaceCredentials(replace func(map[string]interface{}, string)) TerraformBackend {
+	schema, ok := backendSchemas[b.Type]
+	if !ok || b.Configuration == nil {
+		return b
+	}
+	r := b
+	r.Configuration = maps.Clone(b.Configuration)
+	for _, key := range schema.sensitive {
+		if _, ok := r.Configuration[key]; ok {
+			replace(r.Configuration, key)
+		}
+	}
+	return r
+}
@@ -19,16 +19,20 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/zclconf/go-cty/cty"
 	"github.com/zclconf/go-cty/cty/gocty"
 	ctyJson "github.com/zclconf/go-cty/cty/json"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"gopkg.in/yaml.v3"
 
 	"hpc-toolkit/pkg/modulereader"
@@ -56,9 +60,10 @@ var errorMessages = map[string]string{
 	"varNotFound":          "Could not find source of variable",
 	"varInAnotherGroup":    "References to other groups are not yet supported",
 	"intergroupImplicit":   "References to outputs from other groups must explicitly identify the group",
-	"intergroupOrder":      "References to outputs from other groups must be to earlier groups",
+	"intergroupOrder":      "References to outputs from other groups must be to groups deployed before them",
 	"referenceWrongGroup":  "Reference specified the wrong group for the module",
 	"noOutput":             "Output not found for a variable",
+	"packerImageOutput":    "References to Packer modules in other groups must be to image_name",
 	// validator
 	"emptyID":            "a module id cannot be empty",
 	"emptySource":        "a module source cannot be empty",
@@ -71,7 +76,14 @@ var errorMessages = map[string]string{
 	"duplicateID":        "module IDs must be unique",
 	"emptyGroupName":     "group name must be set for each deployment group",
 	"illegalChars":       "invalid character(s) found in group name",
+	"invalidRename":      "renamed_from must be the previous ID of a module that is no longer used",
 	"invalidOutput":      "requested output was not found in the module",
+	"invalidBackend":     "invalid Terraform backend configuration",
+	"invalidExternalRef": "invalid reference to the outputs of another deployment",
+	"invalidDepOutput":   "deployment outputs must have a unique name and reference the output of a module",
+	"invalidGroupDeps":   "depends_on must list the names of other deployment groups without cycles",
+	"invalidDependsOn":   "depends_on must list the IDs of other Terraform modules in the same deployment group",
+	"invalidImport":      "imports must map the address of a resource in the module to the ID of an existing resource",
 	"varNotDefined":      "variable not defined",
 	"valueNotString":     "value was not of type string",
 	"valueEmptyString":   "value is an empty string",
@@ -90,6 +102,81 @@ type DeploymentGroup struct {
 	TerraformBackend TerraformBackend `yaml:"terraform_backend"`
 	Modules          []Module         `yaml:"modules"`
 	Kind             string
+	// DependsOn lists the deployment groups that must be deployed before this
+	// one. A group that does not list it depends on the group before it.
+	DependsOn GroupNames `yaml:"depends_on,omitempty"`
+	// PackerImages are the images built by Packer modules of earlier groups
+	// that are referenced by the modules of this group
+	PackerImages []PackerImage `yaml:"-"`
+	// ExternalOutputs are the groups of other deployments whose outputs are
+	// referenced by the modules of this group
+	ExternalOutputs []ExternalOutputs `yaml:"-"`
+	// DeploymentOutputs are the outputs of the deployment that are written to
+	// this group because they reference one of its modules
+	DeploymentOutputs []GroupOutput `yaml:"-"`
+	// SensitiveVars are the deployment variables that are passed to sensitive
+	// inputs of the modules of this group
+	SensitiveVars []string `yaml:"-"`
+	// SensitiveOutputs are the outputs written to this group whose values are
+	// sensitive outputs of its modules
+	SensitiveOutputs []string `yaml:"-"`
+}
+
+// PackerImageOutput is the name used to reference the image built by a Packer
+// module from a later deployment group
+const PackerImageOutput = "image_name"
+
+// PackerImage identifies an image built by a Packer module
+type PackerImage struct {
+	Group    string
+	ModuleID string
+}
+
+// Variable returns the name of the Terraform variable that supplies the name
+// of the image to a deployment group
+func (img PackerImage) Variable() string {
+	return fmt.Sprintf("%s_%s", PackerImageOutput, img.ModuleID)
+}
+
+// ExternalDeployment is another deployment whose outputs can be referenced as
+// $(deployment:NAME.GROUP.MODULE.OUTPUT)
+type ExternalDeployment struct {
+	// DeploymentDir is the directory the deployment was written to, whose
+	// manifest records the Terraform backend of each group
+	DeploymentDir string `yaml:"deployment_dir"`
+}
+
+// externalReferencePrefix starts references to the outputs of another
+// deployment
+const externalReferencePrefix = "deployment:"
+
+// ExternalOutputs identifies a deployment group of another deployment
+type ExternalOutputs struct {
+	Deployment    string
+	Group         string
+	DeploymentDir string
+}
+
+// DataSource returns the name of the terraform_remote_state data source that
+// reads the outputs of the group
+func (ext ExternalOutputs) DataSource() string {
+	return fmt.Sprintf("%s_%s", ext.Deployment, ext.Group)
+}
+
+// DeploymentOutput is a named output of the deployment whose value is the
+// output of a module: $(module_id.output_name)
+type DeploymentOutput struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description,omitempty"`
+	Value       string `yaml:"value"`
+}
+
+// GroupOutput is a deployment output resolved to the module that supplies it
+type GroupOutput struct {
+	Name        string
+	Description string
+	ModuleID    string
+	Output      string
 }
 
 func (g DeploymentGroup) getModuleByID(modID string) Module {
@@ -196,6 +283,40 @@ type Module struct {
 	Outputs          []string `yaml:"outputs,omitempty"`
 	Settings         map[string]interface{}
 	RequiredApis     map[string][]string `yaml:"required_apis"`
+	// RenamedFrom is the previous ID of a Terraform module, whose resources
+	// are moved to the new ID rather than destroyed and recreated
+	RenamedFrom string `yaml:"renamed_from,omitempty"`
+	// Imports maps the addresses of resources within a Terraform module to the
+	// IDs of existing cloud resources that are imported into it
+	Imports map[string]string `yaml:"imports,omitempty"`
+	// DependsOn lists the IDs of modules of the same deployment group that
+	// must be applied before this one, when no output of theirs is used
+	DependsOn []string `yaml:"depends_on,omitempty"`
+	// SensitiveSettings are the settings of sensitive inputs of the module
+	SensitiveSettings []string `yaml:"-"`
+	// settingsOrder records the order in which settings were declared in the
+	// blueprint. It is left empty when that order is lexical, the default.
+	settingsOrder []string
+}
+
+// OrderedSettingNames returns the names of the module settings in the order
+// they were declared in the blueprint, followed by any settings added during
+// expansion in lexical order.
+func (m Module) OrderedSettingNames() []string {
+	names := make([]string, 0, len(m.Settings))
+	for _, name := range m.settingsOrder {
+		if _, ok := m.Settings[name]; ok {
+			names = append(names, name)
+		}
+	}
+	var added []string
+	for name := range m.Settings {
+		if !slices.Contains(names, name) {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	return append(names, added...)
 }
 
 // createWrapSettingsWith ensures WrapSettingsWith field is not nil, if it is
@@ -217,6 +338,15 @@ type Blueprint struct {
 	Vars                     map[string]interface{}
 	DeploymentGroups         []DeploymentGroup `yaml:"deployment_groups"`
 	TerraformBackendDefaults TerraformBackend  `yaml:"terraform_backend_defaults"`
+	// PreserveFiles lists patterns of files that users add to deployment
+	// groups and that are kept when the deployment is overwritten
+	PreserveFiles []string `yaml:"preserve_files,omitempty"`
+	// ExternalDeployments are the deployments whose outputs are referenced by
+	// the blueprint, indexed by the name used in references
+	ExternalDeployments map[string]ExternalDeployment `yaml:"external_deployments,omitempty"`
+	// Outputs name key values of the deployment, such as addresses of login
+	// nodes, that are collected by "ghpc outputs"
+	Outputs []DeploymentOutput `yaml:"outputs,omitempty"`
 }
 
 // ConnectionKind defines the kind of module connection, defined by the source
@@ -264,6 +394,9 @@ type DeploymentConfig struct {
 	ModuleToGroup     map[string]int
 	expanded          bool
 	moduleConnections []ModConnection
+	// backendOverrides are the backend settings of deployment groups set at
+	// CLI, which replace the backend of a group if they set its type
+	backendOverrides map[string]TerraformBackend
 }
 
 // ExpandConfig expands the yaml config in place
@@ -272,10 +405,18 @@ func (dc *DeploymentConfig) ExpandConfig() error {
 		return err
 	}
 	dc.addKindToModules()
-	dc.setModulesInfo()
-	dc.validateConfig()
-	dc.expand()
-	dc.validate()
+	if err := dc.setModulesInfo(); err != nil {
+		return err
+	}
+	if err := dc.validateConfig(); err != nil {
+		return err
+	}
+	if err := dc.expand(); err != nil {
+		return err
+	}
+	if err := dc.validate(); err != nil {
+		return err
+	}
 	dc.expanded = true
 	return nil
 }
@@ -341,6 +482,7 @@ func importBlueprint(blueprintFilename string) (Blueprint, error) {
 		return blueprint, fmt.Errorf("%s, filename=%s: %v",
 			errorMessages["fileLoadError"], blueprintFilename, err)
 	}
+	defer reader.Close()
 
 	decoder := yaml.NewDecoder(reader)
 	decoder.KnownFields(true)
@@ -353,6 +495,17 @@ func importBlueprint(blueprintFilename string) (Blueprint, error) {
 			errorMessages["yamlUnmarshalError"], blueprintFilename, err)
 	}
 
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return blueprint, fmt.Errorf("%s, filename=%s: %v",
+			errorMessages["fileLoadError"], blueprintFilename, err)
+	}
+	var root yaml.Node
+	if err := yaml.NewDecoder(reader).Decode(&root); err != nil {
+		return blueprint, fmt.Errorf("%s filename=%s: %v",
+			errorMessages["yamlUnmarshalError"], blueprintFilename, err)
+	}
+	blueprint.recordSettingsOrder(&root)
+
 	// Ensure Vars is not a nil map if not set by the user
 	if len(blueprint.Vars) == 0 {
 		blueprint.Vars = make(map[string]interface{})
@@ -371,13 +524,182 @@ func importBlueprint(blueprintFilename string) (Blueprint, error) {
 	return blueprint, nil
 }
 
-// ExportBlueprint exports the internal representation of a blueprint config
-func (dc DeploymentConfig) ExportBlueprint(outputFilename string) ([]byte, error) {
+// mappingValue returns the value of key within a YAML mapping node
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// recordSettingsOrder saves the order in which the settings of each module
+// appear in the parsed blueprint. Decoding into a Go map discards it.
+func (b *Blueprint) recordSettingsOrder(root *yaml.Node) {
+	if root.Kind != yaml.DocumentNode || len(root.Content) != 1 {
+		return
+	}
+	groups := mappingValue(root.Content[0], "deployment_groups")
+	if groups == nil || groups.Kind != yaml.SequenceNode {
+		return
+	}
+	for iGrp, grpNode := range groups.Content {
+		if iGrp >= len(b.DeploymentGroups) {
+			return
+		}
+		mods := mappingValue(grpNode, "modules")
+		if mods == nil || mods.Kind != yaml.SequenceNode {
+			continue
+		}
+		for iMod, modNode := range mods.Content {
+			if iMod >= len(b.DeploymentGroups[iGrp].Modules) {
+				break
+			}
+			settings := mappingValue(modNode, "settings")
+			if settings == nil || settings.Kind != yaml.MappingNode {
+				continue
+			}
+			var order []string
+			for i := 0; i+1 < len(settings.Content); i += 2 {
+				order = append(order, settings.Content[i].Value)
+			}
+			if !sort.StringsAreSorted(order) {
+				b.DeploymentGroups[iGrp].Modules[iMod].settingsOrder = order
+			}
+		}
+	}
+}
+
+// cloneValue returns a deep copy of a value decoded from a blueprint
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return cloneSettings(v)
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, elem := range v {
+			c[i] = cloneValue(elem)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+func cloneSettings(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = cloneValue(v)
+	}
+	return c
+}
+
+func cloneLists(m map[string][]string) map[string][]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string][]string, len(m))
+	for k, v := range m {
+		c[k] = slices.Clone(v)
+	}
+	return c
+}
+
+// Clone returns a deep copy of the blueprint, which can be changed, for
+// example by writing a deployment, without changing the blueprint
+func (bp Blueprint) Clone() Blueprint {
+	c := bp
+	c.Validators = slices.Clone(bp.Validators)
+	for i, v := range c.Validators {
+		c.Validators[i].Inputs = cloneSettings(v.Inputs)
+	}
+	c.Vars = cloneSettings(bp.Vars)
+	c.TerraformBackendDefaults.Configuration = cloneSettings(bp.TerraformBackendDefaults.Configuration)
+	c.PreserveFiles = slices.Clone(bp.PreserveFiles)
+	c.ExternalDeployments = maps.Clone(bp.ExternalDeployments)
+	c.Outputs = slices.Clone(bp.Outputs)
+	c.DeploymentGroups = slices.Clone(bp.DeploymentGroups)
+	for iGrp, grp := range c.DeploymentGroups {
+		grp.TerraformBackend.Configuration = cloneSettings(grp.TerraformBackend.Configuration)
+		grp.DependsOn = slices.Clone(grp.DependsOn)
+		grp.PackerImages = slices.Clone(grp.PackerImages)
+		grp.ExternalOutputs = slices.Clone(grp.ExternalOutputs)
+		grp.DeploymentOutputs = slices.Clone(grp.DeploymentOutputs)
+		grp.SensitiveVars = slices.Clone(grp.SensitiveVars)
+		grp.SensitiveOutputs = slices.Clone(grp.SensitiveOutputs)
+		grp.Modules = slices.Clone(grp.Modules)
+		for iMod, mod := range grp.Modules {
+			mod.Use = slices.Clone(mod.Use)
+			mod.WrapSettingsWith = cloneLists(mod.WrapSettingsWith)
+			mod.Outputs = slices.Clone(mod.Outputs)
+			mod.Settings = cloneSettings(mod.Settings)
+			mod.RequiredApis = cloneLists(mod.RequiredApis)
+			mod.Imports = maps.Clone(mod.Imports)
+			mod.DependsOn = slices.Clone(mod.DependsOn)
+			mod.SensitiveSettings = slices.Clone(mod.SensitiveSettings)
+			mod.settingsOrder = slices.Clone(mod.settingsOrder)
+			grp.Modules[iMod] = mod
+		}
+		c.DeploymentGroups[iGrp] = grp
+	}
+	return c
+}
+
+// redactedValue replaces the values of sensitive settings and deployment
+// variables in exported blueprints
+const redactedValue = "(sensitive)"
+
+// Redacted returns a copy of the expanded blueprint in which the literal
+// values of sensitive module inputs, and of the deployment variables passed to
+// them, and the credentials of Terraform backends are redacted
+func (bp Blueprint) Redacted() Blueprint {
+	r := bp
+	r.Vars = maps.Clone(bp.Vars)
+	r.TerraformBackendDefaults = bp.TerraformBackendDefaults.Redacted()
+	r.DeploymentGroups = slices.Clone(bp.DeploymentGroups)
+	for iGrp, grp := range r.DeploymentGroups {
+		for _, name := range grp.SensitiveVars {
+			r.Vars[name] = redactedValue
+		}
+		grp.TerraformBackend = grp.TerraformBackend.Redacted()
+		grp.Modules = slices.Clone(grp.Modules)
+		for iMod, mod := range grp.Modules {
+			mod.Settings = maps.Clone(mod.Settings)
+			for _, name := range mod.SensitiveSettings {
+				// references to other values are kept, they are redacted
+				// where they are defined
+				if str, isString := mod.Settings[name].(string); isString && IsLiteralVariable(str) {
+					continue
+				}
+				mod.Settings[name] = redactedValue
+			}
+			grp.Modules[iMod] = mod
+		}
+		r.DeploymentGroups[iGrp] = grp
+	}
+	return r
+}
+
+// ExportBlueprint exports the internal representation of a blueprint config.
+// The values of sensitive settings and variables are redacted, unless
+// showSensitive is set.
+func (dc DeploymentConfig) ExportBlueprint(outputFilename string, showSensitive bool) ([]byte, error) {
 	var buf bytes.Buffer
 	encoder := yaml.NewEncoder(&buf)
 	encoder.SetIndent(2)
 
-	err := encoder.Encode(&dc.Config)
+	bp := dc.Config
+	if !showSensitive {
+		bp = bp.Redacted()
+	}
+	err := encoder.Encode(&bp)
 	encoder.Close()
 	d := buf.Bytes()
 	if err != nil {
@@ -397,20 +719,20 @@ func (dc DeploymentConfig) ExportBlueprint(outputFilename string) ([]byte, error
 }
 
 func createModuleInfo(
-	deploymentGroup DeploymentGroup) map[string]modulereader.ModuleInfo {
+	deploymentGroup DeploymentGroup) (map[string]modulereader.ModuleInfo, error) {
 	modsInfo := make(map[string]modulereader.ModuleInfo)
 	for _, mod := range deploymentGroup.Modules {
 		if _, exists := modsInfo[mod.Source]; !exists {
 			ri, err := modulereader.GetModuleInfo(mod.Source, mod.Kind)
 			if err != nil {
-				log.Fatalf(
-					"failed to get info for module at %s while setting dc.ModulesInfo: %e",
+				return nil, fmt.Errorf(
+					"failed to get info for module at %s while setting dc.ModulesInfo: %v",
 					mod.Source, err)
 			}
 			modsInfo[mod.Source] = ri
 		}
 	}
-	return modsInfo
+	return modsInfo, nil
 }
 
 // addKindToModules sets the kind to 'terraform' when empty.
@@ -426,25 +748,31 @@ func (dc *DeploymentConfig) addKindToModules() {
 }
 
 // setModulesInfo populates needed information from modules
-func (dc *DeploymentConfig) setModulesInfo() {
+func (dc *DeploymentConfig) setModulesInfo() error {
 	dc.ModulesInfo = make(map[string]map[string]modulereader.ModuleInfo)
 	for _, grp := range dc.Config.DeploymentGroups {
-		dc.ModulesInfo[grp.Name] = createModuleInfo(grp)
+		modsInfo, err := createModuleInfo(grp)
+		if err != nil {
+			return err
+		}
+		dc.ModulesInfo[grp.Name] = modsInfo
 	}
+	return nil
 }
 
-func validateGroupName(name string, usedNames map[string]bool) {
+func validateGroupName(name string, usedNames map[string]bool) error {
 	if name == "" {
-		log.Fatal(errorMessages["emptyGroupName"])
+		return fmt.Errorf("%s", errorMessages["emptyGroupName"])
 	}
 	if hasIllegalChars(name) {
-		log.Fatalf("%s %s", errorMessages["illegalChars"], name)
+		return fmt.Errorf("%s %s", errorMessages["illegalChars"], name)
 	}
 	if _, ok := usedNames[name]; ok {
-		log.Fatalf(
+		return fmt.Errorf(
 			"%s: %s used more than once", errorMessages["duplicateGroup"], name)
 	}
 	usedNames[name] = true
+	return nil
 }
 
 // checkModuleAndGroupNames checks and imports module and resource group IDs
@@ -454,7 +782,9 @@ func checkModuleAndGroupNames(
 	moduleToGroup := make(map[string]int)
 	groupNames := make(map[string]bool)
 	for iGrp, grp := range depGroups {
-		validateGroupName(grp.Name, groupNames)
+		if err := validateGroupName(grp.Name, groupNames); err != nil {
+			return moduleToGroup, err
+		}
 		for _, mod := range grp.Modules {
 			// Verify no duplicate module names
 			if _, ok := moduleToGroup[mod.ID]; ok {
@@ -500,24 +830,24 @@ func checkUsedModuleNames(
 }
 
 // validateConfig runs a set of simple early checks on the imported input YAML
-func (dc *DeploymentConfig) validateConfig() {
+func (dc *DeploymentConfig) validateConfig() error {
 	_, err := dc.Config.DeploymentName()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	err = dc.Config.checkBlueprintName()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	moduleToGroup, err := checkModuleAndGroupNames(dc.Config.DeploymentGroups)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	dc.ModuleToGroup = moduleToGroup
-	if err = checkUsedModuleNames(
-		dc.Config.DeploymentGroups, dc.ModuleToGroup); err != nil {
-		log.Fatal(err)
+	if err = dc.Config.checkGroupDependencies(); err != nil {
+		return err
 	}
+	dc.ModuleToGroup = moduleToGroup
+	return checkUsedModuleNames(dc.Config.DeploymentGroups, dc.ModuleToGroup)
 }
 
 // SetCLIVariables sets the variables at CLI
@@ -543,13 +873,12 @@ func (dc *DeploymentConfig) SetCLIVariables(cliVariables []string) error {
 	return nil
 }
 
-// SetBackendConfig sets the backend config variables at CLI
+// SetBackendConfig sets the backend config variables at CLI. Variables named
+// group:name apply to that deployment group only.
 func (dc *DeploymentConfig) SetBackendConfig(cliBEConfigVars []string) error {
-	// Set "gcs" as default value when --backend-config is specified at CLI
-	if len(cliBEConfigVars) > 0 {
-		dc.Config.TerraformBackendDefaults.Type = "gcs"
-		dc.Config.TerraformBackendDefaults.Configuration = make(map[string]interface{})
-	}
+	defaultsType := ""
+	defaultsConfiguration := make(map[string]interface{})
+	setDefaults := false
 
 	for _, config := range cliBEConfigVars {
 		arr := strings.SplitN(config, "=", 2)
@@ -559,15 +888,75 @@ func (dc *DeploymentConfig) SetBackendConfig(cliBEConfigVars []string) error {
 		}
 
 		key, value := arr[0], arr[1]
+		if group, groupKey, found := strings.Cut(key, ":"); found {
+			if err := dc.setGroupBackendConfig(group, groupKey, value); err != nil {
+				return err
+			}
+			continue
+		}
+		setDefaults = true
 		switch key {
 		case "type":
-			dc.Config.TerraformBackendDefaults.Type = value
+			defaultsType = value
 		default:
-			dc.Config.TerraformBackendDefaults.Configuration[key] = value
+			defaultsConfiguration[key] = value
+		}
+
+	}
+	// The backend defaults of the blueprint are replaced, "gcs" is set as
+	// default type when --backend-config is specified at CLI
+	if setDefaults {
+		if defaultsType == "" {
+			defaultsType = "gcs"
 		}
+		dc.Config.TerraformBackendDefaults = TerraformBackend{
+			Type: defaultsType, Configuration: defaultsConfiguration}
+	}
+	return nil
+}
 
+// overrideBackend applies settings of a deployment group from the CLI to its
+// backend. Its settings are kept, unless the CLI selects another type of
+// backend.
+func overrideBackend(
+	backend TerraformBackend, backendType string, configuration map[string]interface{}) TerraformBackend {
+	if backendType == "" {
+		backendType = backend.Type
+	}
+	// Set "gcs" as default value when the blueprint has no backend either
+	if backendType == "" {
+		backendType = "gcs"
+	}
+	if backendType == backend.Type {
+		for k, v := range backend.Configuration {
+			if _, ok := configuration[k]; !ok {
+				configuration[k] = v
+			}
+		}
 	}
+	return TerraformBackend{Type: backendType, Configuration: configuration}
+}
 
+// setGroupBackendConfig records a backend setting of a deployment group from
+// the CLI, which is applied once the group inherited the backend defaults
+func (dc *DeploymentConfig) setGroupBackendConfig(group string, key string, value string) error {
+	if !slices.ContainsFunc(dc.Config.DeploymentGroups, func(g DeploymentGroup) bool { return g.Name == group }) {
+		return fmt.Errorf("invalid backend config '%s:%s': deployment group %s was not found in the blueprint",
+			group, key, group)
+	}
+	if dc.backendOverrides == nil {
+		dc.backendOverrides = make(map[string]TerraformBackend)
+	}
+	override, ok := dc.backendOverrides[group]
+	if !ok {
+		override.Configuration = make(map[string]interface{})
+	}
+	if key == "type" {
+		override.Type = value
+	} else {
+		override.Configuration[key] = value
+	}
+	dc.backendOverrides[group] = override
 	return nil
 }
 
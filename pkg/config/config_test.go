@@ -31,6 +31,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/zclconf/go-cty/cty"
 	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -281,7 +282,7 @@ func getDeploymentConfigWithTestModuleEmptyKind() DeploymentConfig {
 // config.go
 func (s *MySuite) TestExpandConfig(c *C) {
 	dc := getBasicDeploymentConfigWithTestModule()
-	dc.ExpandConfig()
+	c.Assert(dc.ExpandConfig(), IsNil)
 }
 
 func (s *MySuite) TestIsEmpty(c *C) {
@@ -395,12 +396,13 @@ func (s *MySuite) TestAddKindToModules(c *C) {
 
 func (s *MySuite) TestSetModulesInfo(c *C) {
 	dc := getBasicDeploymentConfigWithTestModule()
-	dc.setModulesInfo()
+	c.Assert(dc.setModulesInfo(), IsNil)
 }
 
 func (s *MySuite) TestCreateModuleInfo(c *C) {
 	dc := getBasicDeploymentConfigWithTestModule()
-	createModuleInfo(dc.Config.DeploymentGroups[0])
+	_, err := createModuleInfo(dc.Config.DeploymentGroups[0])
+	c.Assert(err, IsNil)
 }
 
 func (s *MySuite) TestGetResouceByID(c *C) {
@@ -547,7 +549,7 @@ func (s *MySuite) TestCheckBlueprintName(c *C) {
 func (s *MySuite) TestNewBlueprint(c *C) {
 	dc := getDeploymentConfigForTest()
 	outFile := filepath.Join(tmpTestDir, "out_TestNewBlueprint.yaml")
-	dc.ExportBlueprint(outFile)
+	dc.ExportBlueprint(outFile, false)
 	newDC, err := NewDeploymentConfig(outFile)
 	c.Assert(err, IsNil)
 	c.Assert(dc.Config, DeepEquals, newDC.Config)
@@ -567,6 +569,48 @@ func (s *MySuite) TestImportBlueprint(c *C) {
 		Equals, expectedSimpleBlueprint.DeploymentGroups[0].Modules[0].ID)
 }
 
+func (s *MySuite) TestImportBlueprint_SettingsOrder(c *C) {
+	yaml := []byte(`
+blueprint_name: settings-order
+deployment_groups:
+- group: primary
+  modules:
+  - id: unordered
+    source: ./modules/network/vpc
+    settings:
+      zone: us-central1-a
+      project_id: test-project
+      network_name: test-net
+  - id: ordered
+    source: ./modules/network/vpc
+    settings:
+      a: 1
+      b: 2
+`)
+	file, _ := ioutil.TempFile("", "*.yaml")
+	file.Write(yaml)
+	filename := file.Name()
+	file.Close()
+	defer os.Remove(filename)
+
+	bp, err := importBlueprint(filename)
+	c.Assert(err, IsNil)
+	unordered := bp.DeploymentGroups[0].Modules[0]
+	c.Check(unordered.OrderedSettingNames(), DeepEquals,
+		[]string{"zone", "project_id", "network_name"})
+
+	// settings added during expansion follow in lexical order
+	unordered.Settings["labels"] = map[string]interface{}{}
+	unordered.Settings["deployment_name"] = "((var.deployment_name))"
+	c.Check(unordered.OrderedSettingNames(), DeepEquals,
+		[]string{"zone", "project_id", "network_name", "deployment_name", "labels"})
+
+	// lexical declaration order is the default and is not recorded
+	ordered := bp.DeploymentGroups[0].Modules[1]
+	c.Check(ordered.settingsOrder, IsNil)
+	c.Check(ordered.OrderedSettingNames(), DeepEquals, []string{"a", "b"})
+}
+
 func (s *MySuite) TestImportBlueprint_ExtraField_ThrowsError(c *C) {
 	yaml := []byte(`
 blueprint_name: hpc-cluster-high-io
@@ -586,14 +630,14 @@ func (s *MySuite) TestExportBlueprint(c *C) {
 	// Return bytes
 	dc := DeploymentConfig{}
 	dc.Config = expectedSimpleBlueprint
-	obtainedYaml, err := dc.ExportBlueprint("")
+	obtainedYaml, err := dc.ExportBlueprint("", false)
 	c.Assert(err, IsNil)
 	c.Assert(obtainedYaml, Not(IsNil))
 
 	// Write file
 	outFilename := "out_TestExportBlueprint.yaml"
 	outFile := filepath.Join(tmpTestDir, outFilename)
-	dc.ExportBlueprint(outFile)
+	dc.ExportBlueprint(outFile, false)
 	fileInfo, err := os.Stat(outFile)
 	c.Assert(err, IsNil)
 	c.Assert(fileInfo.Name(), Equals, outFilename)
@@ -601,6 +645,135 @@ func (s *MySuite) TestExportBlueprint(c *C) {
 	c.Assert(fileInfo.IsDir(), Equals, false)
 }
 
+func (s *MySuite) TestExportBlueprint_Redacted(c *C) {
+	dc := getDeploymentConfigForTest()
+	dc.Config.Vars["admin_password"] = "hunter2"
+	mods := dc.Config.DeploymentGroups[0].Modules
+	mods[0].Settings["password"] = "((var.admin_password))"
+	mods[1].Settings["password"] = "s3cr3t"
+	dc.ModulesInfo["group1"]["testSource"] = modulereader.ModuleInfo{
+		Inputs: []modulereader.VarInfo{{Name: "password", Sensitive: true}},
+	}
+	dc.ModulesInfo["group1"]["./role/source"] = dc.ModulesInfo["group1"]["testSource"]
+	dc.expandSensitive()
+	c.Assert(mods[1].SensitiveSettings, DeepEquals, []string{"password"})
+	// credentials of backends are redacted too
+	dc.Config.TerraformBackendDefaults = TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "b", "credentials": "gcs-k3y"}}
+	dc.Config.DeploymentGroups[0].TerraformBackend = TerraformBackend{
+		Type: "s3", Configuration: map[string]interface{}{"bucket": "b", "secret_key": "s3-k3y"}}
+
+	obtainedYaml, err := dc.ExportBlueprint("", false)
+	c.Assert(err, IsNil)
+	c.Assert(string(obtainedYaml), Not(Matches), "(?s).*(hunter2|s3cr3t|k3y).*")
+	c.Assert(string(obtainedYaml), Matches, `(?s).*password: \(\(var.admin_password\)\).*`)
+	c.Assert(string(obtainedYaml), Matches, `(?s).*bucket: b.*`)
+
+	obtainedYaml, err = dc.ExportBlueprint("", true)
+	c.Assert(err, IsNil)
+	c.Assert(string(obtainedYaml), Matches, "(?s).*hunter2.*s3cr3t.*")
+	c.Assert(string(obtainedYaml), Matches, "(?s).*gcs-k3y.*")
+	c.Assert(string(obtainedYaml), Matches, "(?s).*s3-k3y.*")
+
+	// the deployment config itself is unchanged
+	c.Assert(dc.Config.Vars["admin_password"], Equals, "hunter2")
+	c.Assert(mods[1].Settings["password"], Equals, "s3cr3t")
+	c.Assert(dc.Config.TerraformBackendDefaults.Configuration["credentials"], Equals, "gcs-k3y")
+}
+
+func (s *MySuite) TestBlueprintClone(c *C) {
+	bp := getDeploymentConfigForTest().Config
+	bp.Vars["labels"] = map[string]interface{}{"a": "b"}
+	bp.DeploymentGroups[0].Modules[0].Settings["list"] = []interface{}{"x"}
+	clone := bp.Clone()
+	c.Assert(clone, DeepEquals, bp)
+
+	// changing the clone leaves the blueprint unchanged
+	clone.Vars["labels"].(map[string]interface{})["a"] = "c"
+	clone.DeploymentGroups[0].Name = "changed"
+	clone.DeploymentGroups[0].Modules[0].ModuleName = "changed"
+	clone.DeploymentGroups[0].Modules[0].Settings["list"].([]interface{})[0] = "y"
+	c.Check(bp.Vars["labels"], DeepEquals, map[string]interface{}{"a": "b"})
+	c.Check(bp.DeploymentGroups[0].Name, Equals, "group1")
+	c.Check(bp.DeploymentGroups[0].Modules[0].ModuleName, Not(Equals), "changed")
+	c.Check(bp.DeploymentGroups[0].Modules[0].Settings["list"], DeepEquals, []interface{}{"x"})
+}
+
+func (s *MySuite) TestGroupDependencies(c *C) {
+	// each group depends on the group before it by default
+	bp := Blueprint{DeploymentGroups: []DeploymentGroup{
+		{Name: "network"}, {Name: "image"}, {Name: "cluster"},
+	}}
+	c.Assert(bp.checkGroupDependencies(), IsNil)
+	c.Check(bp.GroupDependencies(0), DeepEquals, []string{})
+	c.Check(bp.GroupDependencies(2), DeepEquals, []string{"image"})
+	c.Check(bp.dependsOnGroup(2, 0), Equals, true)
+	c.Check(bp.dependsOnGroup(0, 2), Equals, false)
+	c.Check(bp.DeploymentOrder(), DeepEquals, []int{0, 1, 2})
+
+	// groups may depend on groups listed after them, or on none
+	bp = Blueprint{DeploymentGroups: []DeploymentGroup{
+		{Name: "cluster", DependsOn: []string{"image-a", "image-b"}},
+		{Name: "image-a", DependsOn: []string{"network"}},
+		{Name: "image-b", DependsOn: []string{"network"}},
+		{Name: "network", DependsOn: []string{}},
+		{Name: "login", DependsOn: []string{"cluster"}},
+	}}
+	c.Assert(bp.checkGroupDependencies(), IsNil)
+	c.Check(bp.GroupDependencies(3), DeepEquals, []string{})
+	c.Check(bp.dependsOnGroup(4, 3), Equals, true)
+	c.Check(bp.dependsOnGroup(2, 1), Equals, false)
+	c.Check(bp.DeploymentOrder(), DeepEquals, []int{3, 1, 2, 0, 4})
+
+	// groups that do not list their dependencies still depend on the group
+	// before them
+	bp = Blueprint{DeploymentGroups: []DeploymentGroup{
+		{Name: "network"},
+		{Name: "image", DependsOn: []string{"network"}},
+		{Name: "cluster"},
+		{Name: "storage", DependsOn: []string{}},
+	}}
+	c.Assert(bp.checkGroupDependencies(), IsNil)
+	c.Check(bp.GroupDependencies(0), DeepEquals, []string{})
+	c.Check(bp.GroupDependencies(2), DeepEquals, []string{"image"})
+	c.Check(bp.GroupDependencies(3), DeepEquals, []string{})
+	c.Check(bp.dependsOnGroup(2, 0), Equals, true)
+
+	// an empty depends_on is kept when the blueprint is exported
+	var grp DeploymentGroup
+	c.Assert(yaml.Unmarshal([]byte("group: storage\ndepends_on: []\n"), &grp), IsNil)
+	c.Check(grp.DependsOn, DeepEquals, GroupNames{})
+	out, err := yaml.Marshal(&grp)
+	c.Assert(err, IsNil)
+	c.Check(string(out), Matches, "(?s).*depends_on: \\[\\].*")
+	out, err = yaml.Marshal(&DeploymentGroup{Name: "network"})
+	c.Assert(err, IsNil)
+	c.Check(string(out), Not(Matches), "(?s).*depends_on.*")
+
+	bp = Blueprint{DeploymentGroups: []DeploymentGroup{
+		{Name: "cluster", DependsOn: []string{"image-a", "image-b"}},
+		{Name: "image-a", DependsOn: []string{"network"}},
+		{Name: "image-b", DependsOn: []string{"network"}},
+		{Name: "network", DependsOn: []string{}},
+		{Name: "login", DependsOn: []string{"cluster"}},
+	}}
+
+	// Failure: cycle
+	bp.DeploymentGroups[3].DependsOn = []string{"login"}
+	c.Assert(bp.checkGroupDependencies(), ErrorMatches, errorMessages["invalidGroupDeps"]+
+		": deployment groups depend on each other in a cycle: "+
+		"cluster -> image-a -> network -> login -> cluster")
+	bp.DeploymentGroups[3].DependsOn = []string{"network"}
+	c.Assert(bp.checkGroupDependencies(), ErrorMatches, errorMessages["invalidGroupDeps"]+
+		": deployment group network depends on itself")
+	bp.DeploymentGroups[3].DependsOn = []string{"storage"}
+	c.Assert(bp.checkGroupDependencies(), ErrorMatches, errorMessages["invalidGroupDeps"]+
+		": deployment group network depends on storage, which is not in the blueprint")
+	bp.DeploymentGroups[3].DependsOn = []string{"login", "login"}
+	c.Assert(bp.checkGroupDependencies(), ErrorMatches, errorMessages["invalidGroupDeps"]+
+		": deployment group network depends on login more than once")
+}
+
 func (s *MySuite) TestSetCLIVariables(c *C) {
 	// Success
 	dc := getBasicDeploymentConfigWithTestModule()
@@ -728,6 +901,38 @@ func (s *MySuite) TestSetBackendConfig(c *C) {
 
 	expErr := "invalid format: .*"
 	c.Assert(err, ErrorMatches, expErr)
+
+	// Success: the backend defaults of the blueprint are replaced by a gcs
+	// backend, as they always were
+	dc = getDeploymentConfigForTest()
+	dc.Config.TerraformBackendDefaults = TerraformBackend{
+		Type:          "s3",
+		Configuration: map[string]interface{}{"bucket": "bp_bucket", "region": "us-east-1"},
+	}
+	c.Assert(dc.SetBackendConfig([]string{"bucket=cli_bucket"}), IsNil)
+	c.Assert(dc.Config.TerraformBackendDefaults, DeepEquals, TerraformBackend{
+		Type:          "gcs",
+		Configuration: map[string]interface{}{"bucket": "cli_bucket"},
+	})
+
+	// Success: the type set at CLI is used
+	c.Assert(dc.SetBackendConfig([]string{"type=s3", "bucket=cli_bucket"}), IsNil)
+	c.Assert(dc.Config.TerraformBackendDefaults, DeepEquals, TerraformBackend{
+		Type:          "s3",
+		Configuration: map[string]interface{}{"bucket": "cli_bucket"},
+	})
+
+	// Success: settings of a group are recorded apart from the defaults
+	dc = getDeploymentConfigForTest()
+	c.Assert(dc.SetBackendConfig([]string{"group1:prefix=p", "group1:type=s3", "group1:key=k"}), IsNil)
+	c.Assert(dc.Config.TerraformBackendDefaults.Type, Equals, "")
+	c.Assert(dc.backendOverrides, DeepEquals, map[string]TerraformBackend{
+		"group1": {Type: "s3", Configuration: map[string]interface{}{"prefix": "p", "key": "k"}},
+	})
+
+	// Failure: unknown group
+	err = dc.SetBackendConfig([]string{"group2:bucket=b"})
+	c.Assert(err, ErrorMatches, ".*deployment group group2 was not found in the blueprint")
 }
 
 func TestMain(m *testing.M) {
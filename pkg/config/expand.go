@@ -24,6 +24,7 @@ import (
 
 	"hpc-toolkit/pkg/modulereader"
 
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 )
 
@@ -47,37 +48,50 @@ const (
 
 // expand expands variables and strings in the yaml config. Used directly by
 // ExpandConfig for the create and expand commands.
-func (dc *DeploymentConfig) expand() {
+func (dc *DeploymentConfig) expand() error {
 	dc.addSettingsToModules()
 	if err := dc.addMetadataToModules(); err != nil {
 		log.Printf("could not determine required APIs: %v", err)
 	}
 
 	if err := dc.expandBackends(); err != nil {
-		log.Fatalf("failed to apply default backend to deployment groups: %v", err)
+		return fmt.Errorf("failed to apply default backend to deployment groups: %v", err)
 	}
 
 	if err := dc.addDefaultValidators(); err != nil {
-		log.Fatalf(
+		return fmt.Errorf(
 			"failed to update validators when expanding the config: %v", err)
 	}
 
 	if err := dc.combineLabels(); err != nil {
-		log.Fatalf(
+		return fmt.Errorf(
 			"failed to update module labels when expanding the config: %v", err)
 	}
 
 	if err := dc.applyUseModules(); err != nil {
-		log.Fatalf(
+		return fmt.Errorf(
 			"failed to apply \"use\" modules when expanding the config: %v", err)
 	}
 
 	if err := dc.applyGlobalVariables(); err != nil {
-		log.Fatalf(
+		return fmt.Errorf(
 			"failed to apply deployment variables in modules when expanding the config: %v",
 			err)
 	}
-	dc.expandVariables()
+	if err := dc.expandVariables(); err != nil {
+		return fmt.Errorf("expandVariables: %v", err)
+	}
+
+	if err := dc.expandImports(); err != nil {
+		return fmt.Errorf("failed to expand the IDs of imported resources: %v", err)
+	}
+
+	if err := dc.expandDeploymentOutputs(); err != nil {
+		return fmt.Errorf("failed to expand the outputs of the deployment: %v", err)
+	}
+
+	dc.expandSensitive()
+	return nil
 }
 
 func (dc *DeploymentConfig) addSettingsToModules() {
@@ -122,28 +136,59 @@ func (dc *DeploymentConfig) expandBackends() error {
 	// 2. If top-level TerraformBackendDefaults is defined, insert that
 	//    backend into resource groups which have no explicit
 	//    TerraformBackend
-	// 3. In all cases, add a prefix for GCS backends if one is not defined
+	// 3. Apply the settings of each group set at CLI
+	// 4. In all cases, set the setting that keeps the state of each group
+	//    apart, for the types of backends that have one, unless the group
+	//    sets it. Values inherited from TerraformBackendDefaults get the
+	//    name of the group appended.
 	blueprint := &dc.Config
-	if blueprint.TerraformBackendDefaults.Type != "" {
-		for i := range blueprint.DeploymentGroups {
-			grp := &blueprint.DeploymentGroups[i]
-			if grp.TerraformBackend.Type == "" {
-				grp.TerraformBackend.Type = blueprint.TerraformBackendDefaults.Type
-				grp.TerraformBackend.Configuration = make(map[string]interface{})
-				for k, v := range blueprint.TerraformBackendDefaults.Configuration {
-					grp.TerraformBackend.Configuration[k] = v
-				}
+	deployment := blueprint.BlueprintName
+	if deploymentName, ok := blueprint.Vars["deployment_name"].(string); ok {
+		deployment += "/" + deploymentName
+	}
+	for i := range blueprint.DeploymentGroups {
+		grp := &blueprint.DeploymentGroups[i]
+		inheritsDefaults := false
+		if grp.TerraformBackend.Type == "" && blueprint.TerraformBackendDefaults.Type != "" {
+			inheritsDefaults = true
+			grp.TerraformBackend.Type = blueprint.TerraformBackendDefaults.Type
+			grp.TerraformBackend.Configuration = make(map[string]interface{})
+			for k, v := range blueprint.TerraformBackendDefaults.Configuration {
+				grp.TerraformBackend.Configuration[k] = v
 			}
-			if grp.TerraformBackend.Type == "gcs" && grp.TerraformBackend.Configuration["prefix"] == nil {
-				DeploymentName := blueprint.Vars["deployment_name"]
-				prefix := blueprint.BlueprintName
-				if DeploymentName != nil {
-					prefix += "/" + DeploymentName.(string)
-				}
-				prefix += "/" + grp.Name
-				grp.TerraformBackend.Configuration["prefix"] = prefix
+		}
+		schema, ok := backendSchemas[grp.TerraformBackend.Type]
+		inherited := ""
+		if ok && inheritsDefaults {
+			inherited, _ = grp.TerraformBackend.Configuration[schema.uniqueKey].(string)
+		}
+		if override, ok := dc.backendOverrides[grp.Name]; ok {
+			if _, set := override.Configuration[schema.uniqueKey]; set || override.Type != "" {
+				inherited = ""
 			}
+			if override.Type != "" {
+				// the backend of the group is replaced
+				grp.TerraformBackend = TerraformBackend{}
+			}
+			grp.TerraformBackend = overrideBackend(
+				grp.TerraformBackend, override.Type, maps.Clone(override.Configuration))
+		}
+
+		schema, ok = backendSchemas[grp.TerraformBackend.Type]
+		if !ok || schema.uniqueKey == "" {
+			continue
+		}
+		if _, set := grp.TerraformBackend.Configuration[schema.uniqueKey]; set && inherited == "" {
+			continue
+		}
+		value := schema.uniqueValue(inherited, deployment, grp.Name)
+		if value == "" {
+			continue
+		}
+		if grp.TerraformBackend.Configuration == nil {
+			grp.TerraformBackend.Configuration = make(map[string]interface{})
 		}
+		grp.TerraformBackend.Configuration[schema.uniqueKey] = value
 	}
 	return nil
 }
@@ -473,7 +518,7 @@ func (dg *DeploymentGroup) identifySimpleVariable(yamlReference string) (varRefe
 }
 
 // this function validates every field within a varReference struct and that
-// the reference must be to the same or earlier group.
+// the reference must be to the same group or a group it depends on.
 // ref.GroupID: this group must exist or be the value "deployment"
 // ref.ID: must be an existing module ID or "vars" (if groupID is "deployment")
 // ref.Name: must match a module output name or deployment variable name
@@ -503,15 +548,17 @@ func validateReference(ref varReference, context varContext, modToGrp map[string
 	refGrp := context.blueprint.DeploymentGroups[refGrpIndex]
 
 	// at this point, we know the target module exists. now record whether it
-	// is intergroup and whether it comes in a (disallowed) later group
+	// is intergroup and whether its group is (as required) deployed first
 	isInterGroupReference := refGrpIndex != context.groupIndex
-	isLaterGroup := refGrpIndex > context.groupIndex
+	isDeployedBefore := context.blueprint.dependsOnGroup(context.groupIndex, refGrpIndex)
 
-	// intergroup references must be explicit about group and refer to an earlier group;
+	// intergroup references must be explicit about group and refer to a group
+	// that the calling group depends on;
 	if isInterGroupReference {
-		if isLaterGroup {
-			return fmt.Errorf("%s: %s is in a later group",
-				errorMessages["intergroupOrder"], context.varString)
+		if !isDeployedBefore {
+			return fmt.Errorf("%s: %s is in group %s, which group %s does not depend on",
+				errorMessages["intergroupOrder"], context.varString,
+				refGrp.Name, context.blueprint.DeploymentGroups[context.groupIndex].Name)
 		}
 
 		if !ref.ExplicitInterGroup {
@@ -534,10 +581,19 @@ func validateReference(ref varReference, context varContext, modToGrp map[string
 			context.varString)
 	}
 	refMod := refGrp.Modules[refModIndex]
+	// Packer modules have no outputs; later groups may only reference the
+	// image they build, which is read from the Packer manifest when deploying
+	if isInterGroupReference && refMod.Kind == "packer" {
+		if ref.Name != PackerImageOutput {
+			return fmt.Errorf("%s: %s",
+				errorMessages["packerImageOutput"], context.varString)
+		}
+		return nil
+	}
 	modInfo, err := modulereader.GetModuleInfo(refMod.Source, refMod.Kind)
 	if err != nil {
-		log.Fatalf(
-			"failed to get info for module at %s while expanding variables: %e",
+		return fmt.Errorf(
+			"failed to get info for module at %s while expanding variables: %v",
 			refMod.Source, err)
 	}
 	found := slices.ContainsFunc(modInfo.Outputs, func(o modulereader.VarInfo) bool { return o.Name == ref.Name })
@@ -565,6 +621,9 @@ func expandSimpleVariable(
 
 	callingGroup := context.blueprint.DeploymentGroups[context.groupIndex]
 	refStr := contents[1]
+	if strings.HasPrefix(refStr, externalReferencePrefix) {
+		return expandExternalReference(context, strings.TrimPrefix(refStr, externalReferencePrefix))
+	}
 
 	ref, err := callingGroup.identifySimpleVariable(refStr)
 	if err != nil {
@@ -581,15 +640,72 @@ func expandSimpleVariable(
 		expandedVariable = fmt.Sprintf("((var.%s))", ref.Name)
 	} else {
 		if ref.ExplicitInterGroup {
-			expandedVariable = fmt.Sprintf("((var.%s_%s))", ref.Name, ref.ID)
-			return "", fmt.Errorf("%s: %s is an intergroup reference",
-				errorMessages["varInAnotherGroup"], context.varString)
+			refGrp := context.blueprint.DeploymentGroups[modToGrp[ref.ID]]
+			if refGrp.getModuleByID(ref.ID).Kind != "packer" {
+				return "", fmt.Errorf("%s: %s is an intergroup reference",
+					errorMessages["varInAnotherGroup"], context.varString)
+			}
+			// the deployment groups are shared with the blueprint being expanded
+			img := PackerImage{Group: ref.GroupID, ModuleID: ref.ID}
+			if !slices.Contains(callingGroup.PackerImages, img) {
+				context.blueprint.DeploymentGroups[context.groupIndex].PackerImages = append(
+					callingGroup.PackerImages, img)
+			}
+			return fmt.Sprintf("((var.%s))", img.Variable()), nil
 		}
 		expandedVariable = fmt.Sprintf("((module.%s.%s))", ref.ID, ref.Name)
 	}
 	return expandedVariable, nil
 }
 
+// expandExternalReference expands a reference to an output of a deployment
+// group of another deployment, NAME.GROUP.MODULE.OUTPUT, which is read from
+// its Terraform state
+func expandExternalReference(context varContext, refStr string) (string, error) {
+	callingGroup := context.blueprint.DeploymentGroups[context.groupIndex]
+	components := strings.Split(refStr, ".")
+	if len(components) != 4 || slices.Contains(components, "") {
+		return "", fmt.Errorf("%s: %s, expected format: $(deployment:name.group.module_id.output_name)",
+			errorMessages["invalidExternalRef"], context.varString)
+	}
+	name, group, modID, output := components[0], components[1], components[2], components[3]
+	if callingGroup.Kind == "packer" {
+		return "", fmt.Errorf("%s: %s, only Terraform groups can reference other deployments",
+			errorMessages["invalidExternalRef"], context.varString)
+	}
+	ext, ok := context.blueprint.ExternalDeployments[name]
+	if !ok {
+		return "", fmt.Errorf("%s: %s, deployment %s is not declared in external_deployments",
+			errorMessages["invalidExternalRef"], context.varString, name)
+	}
+
+	// the outputs of a group are named after the output and the module
+	groupOutput := fmt.Sprintf("%s_%s", output, modID)
+	deploymentDir, err := filepath.Abs(ext.DeploymentDir)
+	if err != nil {
+		return "", err
+	}
+	groupDir := filepath.Join(deploymentDir, group)
+	groupInfo, err := modulereader.GetModuleInfo(groupDir, "terraform")
+	if err != nil {
+		return "", fmt.Errorf("%s: %s, failed to read deployment group %s of deployment %s: %v",
+			errorMessages["invalidExternalRef"], context.varString, group, name, err)
+	}
+	if _, ok := groupInfo.GetOutputsAsMap()[groupOutput]; !ok {
+		return "", fmt.Errorf("%s: %s, deployment group %s of deployment %s has no output %s, "+
+			"add %s to the outputs of module %s",
+			errorMessages["invalidExternalRef"], context.varString, group, name, groupOutput, output, modID)
+	}
+
+	// the deployment groups are shared with the blueprint being expanded
+	ref := ExternalOutputs{Deployment: name, Group: group, DeploymentDir: deploymentDir}
+	if !slices.Contains(callingGroup.ExternalOutputs, ref) {
+		context.blueprint.DeploymentGroups[context.groupIndex].ExternalOutputs = append(
+			callingGroup.ExternalOutputs, ref)
+	}
+	return fmt.Sprintf("((data.terraform_remote_state.%s.outputs.%s))", ref.DataSource(), groupOutput), nil
+}
+
 func expandVariable(
 	context varContext,
 	modToGrp map[string]int) (string, error) {
@@ -699,11 +815,11 @@ func updateVariables(
 
 // expandVariables recurses through the data structures in the yaml config and
 // expands all variables
-func (dc *DeploymentConfig) expandVariables() {
+func (dc *DeploymentConfig) expandVariables() error {
 	for _, validator := range dc.Config.Validators {
 		err := updateVariables(varContext{blueprint: dc.Config}, validator.Inputs, make(map[string]int))
 		if err != nil {
-			log.Fatalf("expandVariables: %v", err)
+			return err
 		}
 	}
 
@@ -719,7 +835,7 @@ func (dc *DeploymentConfig) expandVariables() {
 				mod.Settings,
 				dc.ModuleToGroup)
 			if err != nil {
-				log.Fatalf("expandVariables: %v", err)
+				return err
 			}
 
 			// ensure that variable references to projects in required APIs are expanded
@@ -727,7 +843,7 @@ func (dc *DeploymentConfig) expandVariables() {
 				if isDeploymentVariable(projectID) {
 					s, err := handleVariable(projectID, varContext{blueprint: dc.Config}, make(map[string]int))
 					if err != nil {
-						log.Fatalf("expandVariables: %v", err)
+						return err
 					}
 					mod.RequiredApis[s.(string)] = slices.Clone(requiredAPIs)
 					delete(mod.RequiredApis, projectID)
@@ -735,6 +851,42 @@ func (dc *DeploymentConfig) expandVariables() {
 			}
 		}
 	}
+	return nil
+}
+
+// expandImports replaces the deployment variables in the IDs of the resources
+// imported by modules with their values, as Terraform must know the ID of a
+// resource to import it before planning
+func (dc *DeploymentConfig) expandImports() error {
+	re := regexp.MustCompile(`\$\(vars\.([^)]*)\)`)
+	for _, grp := range dc.Config.DeploymentGroups {
+		for _, mod := range grp.Modules {
+			for address, id := range mod.Imports {
+				var err error
+				expanded := re.ReplaceAllStringFunc(id, func(ref string) string {
+					name := re.FindStringSubmatch(ref)[1]
+					switch val := dc.Config.Vars[name].(type) {
+					case string, int, float64, bool:
+						return fmt.Sprint(val)
+					case nil:
+						err = fmt.Errorf("%s: %s", errorMessages["varNotFound"], ref)
+					default:
+						err = fmt.Errorf("deployment variable %s must be a string or a number to be used in an import ID", name)
+					}
+					return ref
+				})
+				if err != nil {
+					return fmt.Errorf("module %s imports %s: %w", mod.ID, address, err)
+				}
+				if hasVariable(expanded) {
+					return fmt.Errorf("module %s imports %s: only deployment variables can be used in import IDs: %s",
+						mod.ID, address, id)
+				}
+				mod.Imports[address] = expanded
+			}
+		}
+	}
+	return nil
 }
 
 // this function adds default validators to the blueprint if none have been
@@ -810,3 +962,122 @@ func (dc *DeploymentConfig) addDefaultValidators() error {
 
 	return nil
 }
+
+// expandDeploymentOutputs resolves the module outputs referenced by the
+// deployment outputs and assigns each output to the group of its module
+func (dc *DeploymentConfig) expandDeploymentOutputs() error {
+	re := regexp.MustCompile(simpleVariableExp)
+	for _, out := range dc.Config.Outputs {
+		match := re.FindStringSubmatch(out.Value)
+		if match == nil {
+			return fmt.Errorf("%s: output %s has value %q, expected format: $(module_id.output_name)",
+				errorMessages["invalidDepOutput"], out.Name, out.Value)
+		}
+		modID, output, found := strings.Cut(match[1], ".")
+		if !found || modID == "" || output == "" || strings.Contains(output, ".") {
+			return fmt.Errorf("%s: output %s has value %q, expected format: $(module_id.output_name)",
+				errorMessages["invalidDepOutput"], out.Name, out.Value)
+		}
+		groupIndex, ok := dc.ModuleToGroup[modID]
+		if !ok {
+			return fmt.Errorf("%s: output %s references module %s that is not in the blueprint",
+				errorMessages["invalidDepOutput"], out.Name, modID)
+		}
+		grp := &dc.Config.DeploymentGroups[groupIndex]
+		if grp.Kind == "packer" {
+			return fmt.Errorf("%s: output %s references Packer module %s, "+
+				"only the outputs of Terraform modules can be outputs of the deployment",
+				errorMessages["invalidDepOutput"], out.Name, modID)
+		}
+		mod := grp.getModuleByID(modID)
+		modInfo := dc.ModulesInfo[grp.Name][mod.Source]
+		if _, ok := modInfo.GetOutputsAsMap()[output]; !ok {
+			return fmt.Errorf("%s: output %s references %s, module: %s output: %s",
+				errorMessages["invalidDepOutput"], out.Name, out.Value, modID, output)
+		}
+		grp.DeploymentOutputs = append(grp.DeploymentOutputs, GroupOutput{
+			Name:        out.Name,
+			Description: out.Description,
+			ModuleID:    modID,
+			Output:      output,
+		})
+	}
+	return nil
+}
+
+// settingStrings returns the strings found in the value of a setting
+func settingStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		strs := []string{}
+		for _, item := range v {
+			strs = append(strs, settingStrings(item)...)
+		}
+		return strs
+	case map[string]interface{}:
+		strs := []string{}
+		for _, k := range maps.Keys(v) {
+			strs = append(strs, settingStrings(v[k])...)
+		}
+		return strs
+	default:
+		return nil
+	}
+}
+
+// expandSensitive records the settings of sensitive module inputs, and the
+// deployment variables and the outputs of each Terraform group that hold
+// values of sensitive module inputs and outputs, so that Terraform does not
+// display them and ghpc does not record them
+func (dc *DeploymentConfig) expandSensitive() {
+	varRe := regexp.MustCompile(`\bvar\.([A-Za-z_][\w-]*)`)
+	for iGrp := range dc.Config.DeploymentGroups {
+		grp := &dc.Config.DeploymentGroups[iGrp]
+		grp.SensitiveVars, grp.SensitiveOutputs = nil, nil
+		for iMod := range grp.Modules {
+			mod := &grp.Modules[iMod]
+			mod.SensitiveSettings = nil
+			for _, input := range dc.ModulesInfo[grp.Name][mod.Source].Inputs {
+				if _, ok := mod.Settings[input.Name]; ok && input.Sensitive {
+					mod.SensitiveSettings = append(mod.SensitiveSettings, input.Name)
+				}
+			}
+		}
+		if grp.Kind == "packer" {
+			continue
+		}
+		sensitiveOutputs := make(map[string]map[string]bool)
+		for _, mod := range grp.Modules {
+			modInfo := dc.ModulesInfo[grp.Name][mod.Source]
+			for _, input := range modInfo.Inputs {
+				if !input.Sensitive {
+					continue
+				}
+				for _, str := range settingStrings(mod.Settings[input.Name]) {
+					for _, match := range varRe.FindAllStringSubmatch(str, -1) {
+						if _, ok := dc.Config.Vars[match[1]]; ok && !slices.Contains(grp.SensitiveVars, match[1]) {
+							grp.SensitiveVars = append(grp.SensitiveVars, match[1])
+						}
+					}
+				}
+			}
+			sensitiveOutputs[mod.ID] = make(map[string]bool)
+			for _, output := range modInfo.Outputs {
+				sensitiveOutputs[mod.ID][output.Name] = output.Sensitive
+			}
+			for _, output := range mod.Outputs {
+				if sensitiveOutputs[mod.ID][output] {
+					grp.SensitiveOutputs = append(grp.SensitiveOutputs, fmt.Sprintf("%s_%s", output, mod.ID))
+				}
+			}
+		}
+		for _, out := range grp.DeploymentOutputs {
+			if sensitiveOutputs[out.ModuleID][out.Output] {
+				grp.SensitiveOutputs = append(grp.SensitiveOutputs, out.Name)
+			}
+		}
+		slices.Sort(grp.SensitiveVars)
+	}
+}
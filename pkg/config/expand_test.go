@@ -17,6 +17,9 @@ package config
 import (
 	"fmt"
 	"hpc-toolkit/pkg/modulereader"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
 
 	. "gopkg.in/check.v1"
@@ -24,7 +27,7 @@ import (
 
 func (s *MySuite) TestExpand(c *C) {
 	dc := getDeploymentConfigForTest()
-	dc.expand()
+	c.Assert(dc.expand(), IsNil)
 }
 
 func (s *MySuite) TestExpandBackends(c *C) {
@@ -63,6 +66,126 @@ func (s *MySuite) TestExpandBackends(c *C) {
 	c.Assert(gotPrefix, Equals, expPrefix)
 }
 
+func (s *MySuite) TestExpandBackends_UniqueKeys(c *C) {
+	newDC := func(defaults TerraformBackend) DeploymentConfig {
+		dc := getDeploymentConfigForTest()
+		dc.Config.TerraformBackendDefaults = defaults
+		dc.Config.DeploymentGroups = append(dc.Config.DeploymentGroups, DeploymentGroup{Name: "group2"})
+		return dc
+	}
+	backendOf := func(dc DeploymentConfig, i int) map[string]interface{} {
+		return dc.Config.DeploymentGroups[i].TerraformBackend.Configuration
+	}
+
+	// keys of s3 state files are generated for each group
+	dc := newDC(TerraformBackend{Type: "s3", Configuration: map[string]interface{}{"bucket": "b"}})
+	c.Assert(dc.expandBackends(), IsNil)
+	c.Check(backendOf(dc, 0)["key"], Equals, "simple/deployment_name/group1/terraform.tfstate")
+	c.Check(backendOf(dc, 1)["key"], Equals, "simple/deployment_name/group2/terraform.tfstate")
+
+	dc = newDC(TerraformBackend{Type: "azurerm", Configuration: map[string]interface{}{}})
+	c.Assert(dc.expandBackends(), IsNil)
+	c.Check(backendOf(dc, 1)["key"], Equals, "simple/deployment_name/group2/terraform.tfstate")
+
+	// local state is kept in the directory of each group
+	dc = newDC(TerraformBackend{Type: "local"})
+	c.Assert(dc.expandBackends(), IsNil)
+	c.Check(backendOf(dc, 1)["path"], IsNil)
+
+	// settings of a group are kept, even without defaults
+	dc = newDC(TerraformBackend{})
+	dc.Config.DeploymentGroups[1].TerraformBackend = TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "b", "prefix": "own"}}
+	dc.Config.DeploymentGroups[0].TerraformBackend = TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "b"}}
+	c.Assert(dc.expandBackends(), IsNil)
+	c.Check(backendOf(dc, 0)["prefix"], Equals, "simple/deployment_name/group1")
+	c.Check(backendOf(dc, 1)["prefix"], Equals, "own")
+}
+
+func (s *MySuite) TestExpandBackends_InheritedUniqueKeys(c *C) {
+	newDC := func(defaults TerraformBackend) DeploymentConfig {
+		dc := getDeploymentConfigForTest()
+		dc.Config.DeploymentGroups = append(dc.Config.DeploymentGroups, DeploymentGroup{Name: "group2"})
+		dc.Config.TerraformBackendDefaults = defaults
+		return dc
+	}
+
+	// the group is appended to an inherited prefix
+	dc := newDC(TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "b", "prefix": "p"}})
+	c.Assert(dc.expandBackends(), IsNil)
+	for _, grp := range dc.Config.DeploymentGroups {
+		c.Check(grp.TerraformBackend, DeepEquals, TerraformBackend{
+			Type: "gcs", Configuration: map[string]interface{}{"bucket": "b", "prefix": "p/" + grp.Name}})
+	}
+
+	// inherited state files are placed in a directory named after the group
+	dc = newDC(TerraformBackend{
+		Type: "s3", Configuration: map[string]interface{}{"bucket": "b", "key": "states/prod.tfstate"}})
+	c.Assert(dc.expandBackends(), IsNil)
+	c.Check(dc.Config.DeploymentGroups[1].TerraformBackend.Configuration["key"],
+		Equals, "states/group2/prod.tfstate")
+
+	dc = newDC(TerraformBackend{
+		Type: "local", Configuration: map[string]interface{}{"path": "/states/terraform.tfstate"}})
+	c.Assert(dc.expandBackends(), IsNil)
+	c.Check(dc.Config.DeploymentGroups[1].TerraformBackend.Configuration["path"],
+		Equals, "/states/group2/terraform.tfstate")
+
+	// --backend-config replaces the defaults of the blueprint
+	dc = newDC(TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "b", "prefix": "p"}})
+	c.Assert(dc.SetBackendConfig([]string{"bucket=cli"}), IsNil)
+	c.Assert(dc.expandBackends(), IsNil)
+	c.Check(dc.Config.DeploymentGroups[1].TerraformBackend, DeepEquals, TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{
+			"bucket": "cli", "prefix": "simple/deployment_name/group2"}})
+}
+
+func (s *MySuite) TestExpandConfig_SharedBackendDefaults(c *C) {
+	dc := getBasicDeploymentConfigWithTestModule()
+	one := dc.Config.DeploymentGroups[0]
+	one.Name = "one"
+	two := DeploymentGroup{Name: "two", Modules: []Module{one.Modules[0]}}
+	two.Modules[0].ID = "TestModule2"
+	dc.Config.DeploymentGroups = []DeploymentGroup{one, two}
+	dc.Config.TerraformBackendDefaults = TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "b", "prefix": "p"}}
+
+	c.Assert(dc.ExpandConfig(), IsNil)
+	c.Assert(dc.validateBackends(), IsNil)
+	c.Check(dc.Config.DeploymentGroups[0].TerraformBackend.Configuration["prefix"], Equals, "p/one")
+	c.Check(dc.Config.DeploymentGroups[1].TerraformBackend.Configuration["prefix"], Equals, "p/two")
+}
+
+func (s *MySuite) TestExpandBackends_GroupOverrides(c *C) {
+	dc := getDeploymentConfigForTest()
+	dc.Config.DeploymentGroups = append(dc.Config.DeploymentGroups,
+		DeploymentGroup{Name: "group2"},
+		DeploymentGroup{Name: "group3", TerraformBackend: TerraformBackend{
+			Type: "gcs", Configuration: map[string]interface{}{"bucket": "own", "prefix": "own"}}})
+	dc.Config.TerraformBackendDefaults = TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "b", "prefix": "p"}}
+	c.Assert(dc.SetBackendConfig([]string{
+		"group1:bucket=ci",
+		"group2:type=gcs", "group2:bucket=other",
+		"group3:prefix=ci",
+	}), IsNil)
+	c.Assert(dc.expandBackends(), IsNil)
+
+	// settings are merged into the inherited backend
+	c.Check(dc.Config.DeploymentGroups[0].TerraformBackend, DeepEquals, TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "ci", "prefix": "p/group1"}})
+	// setting the type replaces the backend
+	c.Check(dc.Config.DeploymentGroups[1].TerraformBackend, DeepEquals, TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{
+			"bucket": "other", "prefix": "simple/deployment_name/group2"}})
+	// settings are merged into the backend of the group
+	c.Check(dc.Config.DeploymentGroups[2].TerraformBackend, DeepEquals, TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "own", "prefix": "ci"}})
+}
+
 func (s *MySuite) TestGetModuleVarName(c *C) {
 	modID := "modID"
 	varName := "varName"
@@ -634,3 +757,211 @@ func (s *MySuite) TestExpandSimpleVariable(c *C) {
 	got, err = expandSimpleVariable(testVarContext1, testModToGrp)
 	c.Assert(err, ErrorMatches, fmt.Sprintf("%s: %s .*", errorMessages["varInAnotherGroup"], regexp.QuoteMeta(testVarContext1.varString)))
 }
+
+func (s *MySuite) TestExpandPackerImageVariable(c *C) {
+	testBlueprint := Blueprint{
+		BlueprintName: "test-blueprint",
+		Vars:          make(map[string]interface{}),
+		DeploymentGroups: []DeploymentGroup{
+			{
+				Name:    "packer",
+				Modules: []Module{{ID: "image", Kind: "packer", Source: "./modules/packer"}},
+			},
+			{
+				Name:    "cluster",
+				Modules: []Module{{ID: "vm", Kind: "terraform", Source: "./modules/vm"}},
+			},
+		},
+	}
+	testModToGrp, err := checkModuleAndGroupNames(testBlueprint.DeploymentGroups)
+	c.Assert(err, IsNil)
+	context := varContext{blueprint: testBlueprint, groupIndex: 1}
+
+	// Success: reference to the image built in an earlier group, recorded once
+	for i := 0; i < 2; i++ {
+		context.varString = "$(packer.image.image_name)"
+		got, err := expandSimpleVariable(context, testModToGrp)
+		c.Assert(err, IsNil)
+		c.Assert(got, Equals, "((var.image_name_image))")
+	}
+	c.Assert(testBlueprint.DeploymentGroups[1].PackerImages, DeepEquals,
+		[]PackerImage{{Group: "packer", ModuleID: "image"}})
+
+	// Failure: Packer modules have no other outputs
+	context.varString = "$(packer.image.image_id)"
+	_, err = expandSimpleVariable(context, testModToGrp)
+	c.Assert(err, ErrorMatches, fmt.Sprintf("%s: .*", errorMessages["packerImageOutput"]))
+
+	// Failure: reference must be explicit about the group
+	context.varString = "$(image.image_name)"
+	_, err = expandSimpleVariable(context, testModToGrp)
+	c.Assert(err, ErrorMatches, fmt.Sprintf("%s: .*", errorMessages["intergroupImplicit"]))
+
+	// Success: images built in a group deployed before through other groups
+	testBlueprint.DeploymentGroups = append(testBlueprint.DeploymentGroups, DeploymentGroup{
+		Name:      "login",
+		DependsOn: []string{"cluster"},
+		Modules:   []Module{{ID: "login", Kind: "terraform", Source: "./modules/vm"}},
+	})
+	testModToGrp["login"] = 2
+	testBlueprint.DeploymentGroups[1].DependsOn = []string{"packer"}
+	context = varContext{blueprint: testBlueprint, groupIndex: 2, varString: "$(packer.image.image_name)"}
+	_, err = expandSimpleVariable(context, testModToGrp)
+	c.Assert(err, IsNil)
+
+	// Failure: the group of the image is not deployed before
+	testBlueprint.DeploymentGroups[1].DependsOn = []string{"login"}
+	testBlueprint.DeploymentGroups[2].DependsOn = nil
+	context = varContext{blueprint: testBlueprint, groupIndex: 1, varString: "$(packer.image.image_name)"}
+	_, err = expandSimpleVariable(context, testModToGrp)
+	c.Assert(err, ErrorMatches, fmt.Sprintf("%s: .* is in group packer, which group cluster does not depend on",
+		errorMessages["intergroupOrder"]))
+}
+
+func (s *MySuite) TestExpandImports(c *C) {
+	dc := getDeploymentConfigForTest()
+	mod := dc.Config.DeploymentGroups[0].Modules[0]
+	mod.Imports = map[string]string{
+		"google_compute_network.network": "projects/$(vars.project_id)/global/networks/net",
+	}
+	dc.Config.DeploymentGroups[0].Modules[0] = mod
+
+	// Success: deployment variables are replaced by their value
+	c.Assert(dc.expandImports(), IsNil)
+	c.Assert(mod.Imports["google_compute_network.network"], Equals,
+		"projects/test-project/global/networks/net")
+
+	// Failure: the deployment variable does not exist
+	mod.Imports["google_compute_network.network"] = "$(vars.network_id)"
+	err := dc.expandImports()
+	c.Assert(err, ErrorMatches, fmt.Sprintf(".*: %s: .*", errorMessages["varNotFound"]))
+
+	// Failure: module outputs cannot be used
+	mod.Imports["google_compute_network.network"] = "$(testModuleWithLabels.network_id)"
+	err = dc.expandImports()
+	c.Assert(err, ErrorMatches, ".*: only deployment variables can be used in import IDs: .*")
+}
+
+func (s *MySuite) TestExpandDeploymentOutputs(c *C) {
+	dc := getDeploymentConfigForTest()
+	dc.ModuleToGroup = map[string]int{"testModule": 0, "testModuleWithLabels": 0}
+	dc.ModulesInfo["group1"]["testSource"] = modulereader.ModuleInfo{
+		Outputs: []modulereader.VarInfo{{Name: "login_ip"}},
+	}
+	dc.Config.Outputs = []DeploymentOutput{
+		{Name: "login_ip", Description: "IP of the login node", Value: "$(testModule.login_ip)"},
+	}
+
+	// Success: the output is assigned to the group of its module
+	c.Assert(dc.expandDeploymentOutputs(), IsNil)
+	c.Assert(dc.Config.DeploymentGroups[0].DeploymentOutputs, DeepEquals, []GroupOutput{
+		{Name: "login_ip", Description: "IP of the login node", ModuleID: "testModule", Output: "login_ip"},
+	})
+
+	// Failure: the module does not have the output
+	dc.Config.Outputs[0].Value = "$(testModuleWithLabels.login_ip)"
+	err := dc.expandDeploymentOutputs()
+	c.Assert(err, ErrorMatches, errorMessages["invalidDepOutput"]+": .*, module: testModuleWithLabels output: login_ip")
+
+	// Failure: the module is not in the blueprint
+	dc.Config.Outputs[0].Value = "$(login.login_ip)"
+	err = dc.expandDeploymentOutputs()
+	c.Assert(err, ErrorMatches, errorMessages["invalidDepOutput"]+": .* references module login .*")
+
+	// Failure: the value is not a module output
+	dc.Config.Outputs[0].Value = "$(vars.project_id.name)"
+	err = dc.expandDeploymentOutputs()
+	c.Assert(err, ErrorMatches, errorMessages["invalidDepOutput"]+": .* expected format: .*")
+}
+
+func (s *MySuite) TestExpandSensitive(c *C) {
+	dc := getDeploymentConfigForTest()
+	dc.Config.Vars["admin_password"] = "hunter2"
+	mod := dc.Config.DeploymentGroups[0].Modules[0]
+	mod.Outputs = []string{"password", "name"}
+	mod.Settings["password"] = "((var.admin_password))"
+	mod.Settings["name"] = "((var.deployment_name))"
+	dc.Config.DeploymentGroups[0].Modules[0] = mod
+	dc.ModulesInfo["group1"]["testSource"] = modulereader.ModuleInfo{
+		Inputs: []modulereader.VarInfo{
+			{Name: "password", Sensitive: true},
+			{Name: "name"},
+		},
+		Outputs: []modulereader.VarInfo{
+			{Name: "name"},
+			{Name: "password", Sensitive: true},
+		},
+	}
+	dc.Config.DeploymentGroups[0].DeploymentOutputs = []GroupOutput{
+		{Name: "admin_password", ModuleID: "testModule", Output: "password"},
+		{Name: "cluster_name", ModuleID: "testModule", Output: "name"},
+	}
+
+	dc.expandSensitive()
+	grp := dc.Config.DeploymentGroups[0]
+	c.Assert(grp.SensitiveVars, DeepEquals, []string{"admin_password"})
+	c.Assert(grp.SensitiveOutputs, DeepEquals, []string{"password_testModule", "admin_password"})
+
+	// Variables nested in settings are found
+	mod.Settings["password"] = map[string]interface{}{"users": []interface{}{"((var.project_id))"}}
+	dc.expandSensitive()
+	c.Assert(dc.Config.DeploymentGroups[0].SensitiveVars, DeepEquals, []string{"project_id"})
+}
+
+func (s *MySuite) TestExpandExternalReference(c *C) {
+	sharedDir := filepath.Join(tmpTestDir, "shared-net")
+	c.Assert(os.MkdirAll(filepath.Join(sharedDir, "primary"), 0755), IsNil)
+	outputs := `output "network_name_network1" {
+  value = module.network1.network_name
+}
+`
+	c.Assert(ioutil.WriteFile(filepath.Join(sharedDir, "primary", "outputs.tf"), []byte(outputs), 0644), IsNil)
+
+	testBlueprint := Blueprint{
+		BlueprintName:       "test-blueprint",
+		ExternalDeployments: map[string]ExternalDeployment{"shared-net": {DeploymentDir: sharedDir}},
+		DeploymentGroups: []DeploymentGroup{
+			{Name: "cluster", Kind: "terraform", Modules: []Module{{ID: "fs", Kind: "terraform"}}},
+			{Name: "packer", Kind: "packer", Modules: []Module{{ID: "image", Kind: "packer"}}},
+		},
+	}
+	context := varContext{blueprint: testBlueprint}
+
+	// Success: the output is read from the Terraform state, recorded once
+	for i := 0; i < 2; i++ {
+		context.varString = "$(deployment:shared-net.primary.network1.network_name)"
+		got, err := expandSimpleVariable(context, map[string]int{})
+		c.Assert(err, IsNil)
+		c.Assert(got, Equals,
+			"((data.terraform_remote_state.shared-net_primary.outputs.network_name_network1))")
+	}
+	c.Assert(testBlueprint.DeploymentGroups[0].ExternalOutputs, DeepEquals, []ExternalOutputs{
+		{Deployment: "shared-net", Group: "primary", DeploymentDir: sharedDir},
+	})
+
+	// Failure: the group does not have the output
+	context.varString = "$(deployment:shared-net.primary.network1.subnetwork_name)"
+	_, err := expandSimpleVariable(context, map[string]int{})
+	c.Assert(err, ErrorMatches, errorMessages["invalidExternalRef"]+": .* has no output subnetwork_name_network1, .*")
+
+	// Failure: the deployment has no such group
+	context.varString = "$(deployment:shared-net.secondary.network1.network_name)"
+	_, err = expandSimpleVariable(context, map[string]int{})
+	c.Assert(err, ErrorMatches, errorMessages["invalidExternalRef"]+": .*failed to read deployment group secondary.*")
+
+	// Failure: undeclared deployment
+	context.varString = "$(deployment:other.primary.network1.network_name)"
+	_, err = expandSimpleVariable(context, map[string]int{})
+	c.Assert(err, ErrorMatches, errorMessages["invalidExternalRef"]+": .*not declared in external_deployments")
+
+	// Failure: malformed reference
+	context.varString = "$(deployment:shared-net.network1.network_name)"
+	_, err = expandSimpleVariable(context, map[string]int{})
+	c.Assert(err, ErrorMatches, errorMessages["invalidExternalRef"]+": .*expected format.*")
+
+	// Failure: Packer groups cannot read Terraform state
+	context.groupIndex = 1
+	context.varString = "$(deployment:shared-net.primary.network1.network_name)"
+	_, err = expandSimpleVariable(context, map[string]int{})
+	c.Assert(err, ErrorMatches, errorMessages["invalidExternalRef"]+": .*only Terraform groups.*")
+}
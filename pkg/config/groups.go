@@ -0,0 +1,171 @@
+/**
+ * Copyright 2022 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// groupIndex returns the index of the deployment group with a name, or -1
+func (b Blueprint) groupIndex(name string) int {
+	return slices.IndexFunc(b.DeploymentGroups, func(g DeploymentGroup) bool { return g.Name == name })
+}
+
+// GroupNames lists deployment groups by name. An empty list, unlike a missing
+// one, is kept when the blueprint is exported, as it stands for a group that
+// does not depend on the group before it.
+type GroupNames []string
+
+// IsZero reports whether the list is missing, for the omitempty option of
+// yaml
+func (n GroupNames) IsZero() bool {
+	return n == nil
+}
+
+// GroupDependencies returns the names of the deployment groups that must be
+// deployed before a deployment group: those listed in its depends_on or, if it
+// does not list it, the group before it
+func (b Blueprint) GroupDependencies(groupIndex int) []string {
+	if deps := b.DeploymentGroups[groupIndex].DependsOn; deps != nil {
+		return append([]string{}, deps...)
+	}
+	if groupIndex == 0 {
+		return []string{}
+	}
+	return []string{b.DeploymentGroups[groupIndex-1].Name}
+}
+
+// dependsOnGroup reports whether a deployment group depends, directly or
+// through other groups, on another deployment group, which is then always
+// deployed before it
+func (b Blueprint) dependsOnGroup(groupIndex int, otherIndex int) bool {
+	visited := make(map[int]bool)
+	pending := []int{groupIndex}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for _, dep := range b.GroupDependencies(current) {
+			depIndex := b.groupIndex(dep)
+			if depIndex == otherIndex {
+				return true
+			}
+			if depIndex >= 0 && !visited[depIndex] {
+				visited[depIndex] = true
+				pending = append(pending, depIndex)
+			}
+		}
+	}
+	return false
+}
+
+// checkGroupDependencies verifies that the deployment groups listed in
+// depends_on exist and that the groups do not depend on each other in a cycle
+func (b Blueprint) checkGroupDependencies() error {
+	for _, grp := range b.DeploymentGroups {
+		seen := make(map[string]bool)
+		for _, dep := range grp.DependsOn {
+			switch {
+			case dep == grp.Name:
+				return fmt.Errorf("%s: deployment group %s depends on itself",
+					errorMessages["invalidGroupDeps"], grp.Name)
+			case seen[dep]:
+				return fmt.Errorf("%s: deployment group %s depends on %s more than once",
+					errorMessages["invalidGroupDeps"], grp.Name, dep)
+			case b.groupIndex(dep) < 0:
+				return fmt.Errorf("%s: deployment group %s depends on %s, which is not in the blueprint",
+					errorMessages["invalidGroupDeps"], grp.Name, dep)
+			}
+			seen[dep] = true
+		}
+	}
+
+	// depth-first search of the groups being visited, reporting the path back
+	// to a group already on it
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(b.DeploymentGroups))
+	var path []string
+	var visit func(int) error
+	visit = func(i int) error {
+		state[i] = visiting
+		path = append(path, b.DeploymentGroups[i].Name)
+		for _, dep := range b.GroupDependencies(i) {
+			depIndex := b.groupIndex(dep)
+			switch state[depIndex] {
+			case visiting:
+				cycle := append(path[slices.Index(path, dep):], dep)
+				return fmt.Errorf("%s: deployment groups depend on each other in a cycle: %s",
+					errorMessages["invalidGroupDeps"], strings.Join(cycle, " -> "))
+			case unvisited:
+				if err := visit(depIndex); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+	for i := range b.DeploymentGroups {
+		if state[i] == unvisited {
+			if err := visit(i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DeploymentOrder returns the indices of the deployment groups in an order in
+// which every group comes after the groups it depends on. Groups are otherwise
+// kept in the order of the blueprint.
+func (b Blueprint) DeploymentOrder() []int {
+	order := []int{}
+	done := make(map[string]bool)
+	for len(order) < len(b.DeploymentGroups) {
+		added := false
+		for i, grp := range b.DeploymentGroups {
+			if done[grp.Name] {
+				continue
+			}
+			if slices.ContainsFunc(b.GroupDependencies(i), func(dep string) bool { return !done[dep] }) {
+				continue
+			}
+			order = append(order, i)
+			done[grp.Name] = true
+			added = true
+			break
+		}
+		if !added {
+			// the remaining groups depend on each other in a cycle, which is
+			// reported by checkGroupDependencies
+			for i, grp := range b.DeploymentGroups {
+				if !done[grp.Name] {
+					order = append(order, i)
+					done[grp.Name] = true
+				}
+			}
+		}
+	}
+	return order
+}
@@ -19,6 +19,7 @@ package config
 import (
 	"fmt"
 	"log"
+	"reflect"
 	"regexp"
 	"strings"
 
@@ -48,28 +49,47 @@ func (err *InvalidSettingError) Error() string {
 }
 
 // validate is the top-level function for running the validation suite.
-func (dc DeploymentConfig) validate() {
+func (dc DeploymentConfig) validate() error {
 	// Drop the flags for log to improve readability only for running the validation suite
 	log.SetFlags(0)
 
 	if err := dc.validateVars(); err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	// variables should be validated before running validators
 	if err := dc.executeValidators(); err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	if err := dc.validateModules(); err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err := dc.validateRenamedModules(); err != nil {
+		return err
+	}
+	if err := dc.validateBackends(); err != nil {
+		return err
+	}
+	if err := dc.validateExternalDeployments(); err != nil {
+		return err
 	}
 	if err := dc.validateModuleSettings(); err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err := dc.validateModuleImports(); err != nil {
+		return err
+	}
+	if err := dc.validateModuleDependencies(); err != nil {
+		return err
+	}
+	if err := dc.validateDeploymentOutputs(); err != nil {
+		return err
 	}
 
 	// Set it back to the initial value
 	log.SetFlags(log.LstdFlags)
+	return nil
 }
 
 // performs validation of global variables
@@ -155,6 +175,83 @@ func (dc DeploymentConfig) validateVars() error {
 	return nil
 }
 
+// validateRenamedModules checks that modules are renamed from IDs that are no
+// longer used, at most once and only within Terraform deployment groups
+func (dc DeploymentConfig) validateRenamedModules() error {
+	ids := make(map[string]bool)
+	for _, grp := range dc.Config.DeploymentGroups {
+		for _, mod := range grp.Modules {
+			ids[mod.ID] = true
+		}
+	}
+	for _, grp := range dc.Config.DeploymentGroups {
+		renamed := make(map[string]bool)
+		for _, mod := range grp.Modules {
+			if mod.RenamedFrom == "" {
+				continue
+			}
+			if ids[mod.RenamedFrom] || renamed[mod.RenamedFrom] {
+				return fmt.Errorf("%s: module %s was renamed from %s",
+					errorMessages["invalidRename"], mod.ID, mod.RenamedFrom)
+			}
+			if mod.Kind != "terraform" {
+				return fmt.Errorf("%s: only Terraform modules can be renamed, module %s is of kind %s",
+					errorMessages["invalidRename"], mod.ID, mod.Kind)
+			}
+			renamed[mod.RenamedFrom] = true
+		}
+	}
+	return nil
+}
+
+// validateBackends verifies the configuration of the Terraform backends of
+// known types and that no two Terraform groups share the same state
+func (dc DeploymentConfig) validateBackends() error {
+	if err := validateBackend(dc.Config.TerraformBackendDefaults); err != nil {
+		return fmt.Errorf("%s: terraform_backend_defaults: %v", errorMessages["invalidBackend"], err)
+	}
+	var stateful []DeploymentGroup
+	for _, grp := range dc.Config.DeploymentGroups {
+		if grp.Kind == "packer" || grp.TerraformBackend.Type == "" {
+			continue
+		}
+		if err := validateBackend(grp.TerraformBackend); err != nil {
+			return fmt.Errorf("%s: deployment group %s: %v", errorMessages["invalidBackend"], grp.Name, err)
+		}
+		if grp.TerraformBackend.Type == "local" {
+			// local state is kept relative to the directory of each group
+			continue
+		}
+		for _, other := range stateful {
+			if reflect.DeepEqual(other.TerraformBackend, grp.TerraformBackend) {
+				return fmt.Errorf("%s: deployment groups %s and %s share the same Terraform state",
+					errorMessages["invalidBackend"], other.Name, grp.Name)
+			}
+		}
+		stateful = append(stateful, grp)
+	}
+	return nil
+}
+
+// validateExternalDeployments verifies that the deployments whose outputs are
+// referenced have names usable in Terraform and a deployment directory
+func (dc DeploymentConfig) validateExternalDeployments() error {
+	names := maps.Keys(dc.Config.ExternalDeployments)
+	slices.Sort(names)
+	for _, name := range names {
+		if !regexp.MustCompile(`^[a-zA-Z][\w-]*$`).MatchString(name) {
+			return fmt.Errorf("%s: the name of external deployment %q must start with a letter "+
+				"and only contain letters, numbers, dashes and underscores",
+				errorMessages["invalidExternalRef"], name)
+		}
+		if dc.Config.ExternalDeployments[name].DeploymentDir == "" {
+			return fmt.Errorf("%s: external deployment %s has no deployment_dir",
+				errorMessages["invalidExternalRef"], name)
+		}
+	}
+	return nil
+}
+
 func module2String(c Module) string {
 	cBytes, _ := yaml.Marshal(&c)
 	return string(cBytes)
@@ -276,6 +373,56 @@ func (dc DeploymentConfig) validateModuleSettings() error {
 	return nil
 }
 
+// validateImportAddress verifies that the address of an imported resource
+// refers to a resource managed by the module or to one of its child modules,
+// whose own resources are not inspected
+func validateImportAddress(address string, info modulereader.ModuleInfo) error {
+	parts := strings.Split(regexp.MustCompile(`\[[^\]]*\]`).ReplaceAllString(address, ""), ".")
+	if len(parts) > 2 && parts[0] == "module" {
+		if !slices.Contains(info.ModuleCalls, parts[1]) {
+			return fmt.Errorf("the module does not call a module named %s", parts[1])
+		}
+		return nil
+	}
+	if len(parts) != 2 {
+		return fmt.Errorf("%s is not the address of a managed resource", address)
+	}
+	if resource := parts[0] + "." + parts[1]; !slices.Contains(info.Resources, resource) {
+		return fmt.Errorf("the module has no resource %s", resource)
+	}
+	return nil
+}
+
+// validateModuleImports verifies that the resources imported into modules
+// exist in the module sources
+func (dc DeploymentConfig) validateModuleImports() error {
+	for _, grp := range dc.Config.DeploymentGroups {
+		for _, mod := range grp.Modules {
+			if len(mod.Imports) == 0 {
+				continue
+			}
+			if mod.Kind != "terraform" {
+				return fmt.Errorf("%s: only resources of Terraform modules can be imported, module %s is of kind %s",
+					errorMessages["invalidImport"], mod.ID, mod.Kind)
+			}
+			info := dc.ModulesInfo[grp.Name][mod.Source]
+			addresses := maps.Keys(mod.Imports)
+			slices.Sort(addresses)
+			for _, address := range addresses {
+				if mod.Imports[address] == "" {
+					return fmt.Errorf("%s: module %s imports %s from an empty ID",
+						errorMessages["invalidImport"], mod.ID, address)
+				}
+				if err := validateImportAddress(address, info); err != nil {
+					return fmt.Errorf("%s: module %s imports %s: %v",
+						errorMessages["invalidImport"], mod.ID, address, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (dc *DeploymentConfig) getValidators() map[string]func(validatorConfig) error {
 	allValidators := map[string]func(validatorConfig) error{
 		testApisEnabledName.String():   dc.testApisEnabled,
@@ -568,3 +715,80 @@ func (dc *DeploymentConfig) getStringValue(inputReference interface{}) (string,
 	}
 	return "", fmt.Errorf("the value %s is not a deployment variable or was not defined", inputReference)
 }
+
+// validateModuleDependencies ensures that modules only depend on other
+// Terraform modules of their own group. The modules of the groups that a group
+// depends on are always applied first.
+func (dc DeploymentConfig) validateModuleDependencies() error {
+	for iGrp, grp := range dc.Config.DeploymentGroups {
+		for _, mod := range grp.Modules {
+			if len(mod.DependsOn) == 0 {
+				continue
+			}
+			if mod.Kind != "terraform" {
+				return fmt.Errorf("%s: only Terraform modules can have dependencies, module %s is of kind %s",
+					errorMessages["invalidDependsOn"], mod.ID, mod.Kind)
+			}
+			seen := make(map[string]bool)
+			for _, dep := range mod.DependsOn {
+				depGroup, ok := dc.ModuleToGroup[dep]
+				switch {
+				case dep == mod.ID:
+					return fmt.Errorf("%s: module %s depends on itself",
+						errorMessages["invalidDependsOn"], mod.ID)
+				case seen[dep]:
+					return fmt.Errorf("%s: module %s depends on %s more than once",
+						errorMessages["invalidDependsOn"], mod.ID, dep)
+				case !ok:
+					return fmt.Errorf("%s: module %s depends on %s, which is not in the blueprint",
+						errorMessages["invalidDependsOn"], mod.ID, dep)
+				case depGroup != iGrp && dc.Config.dependsOnGroup(iGrp, depGroup):
+					return fmt.Errorf("%s: module %s depends on %s of deployment group %s, "+
+						"which is always deployed before group %s, remove it from depends_on",
+						errorMessages["invalidDependsOn"], mod.ID, dep,
+						dc.Config.DeploymentGroups[depGroup].Name, grp.Name)
+				case depGroup != iGrp:
+					return fmt.Errorf("%s: module %s depends on %s of deployment group %s, "+
+						"which is not deployed before group %s, move %s to group %s",
+						errorMessages["invalidDependsOn"], mod.ID, dep,
+						dc.Config.DeploymentGroups[depGroup].Name, grp.Name, dep, grp.Name)
+				}
+				seen[dep] = true
+			}
+		}
+	}
+	return nil
+}
+
+// validateDeploymentOutputs ensures that the outputs of the deployment can be
+// told apart from each other and from the outputs of modules in their group
+func (dc DeploymentConfig) validateDeploymentOutputs() error {
+	names := make(map[string]bool)
+	for _, out := range dc.Config.Outputs {
+		if !regexp.MustCompile(`^[a-zA-Z_][\w-]*$`).MatchString(out.Name) {
+			return fmt.Errorf("%s: the name of output %q must start with a letter or an underscore "+
+				"and only contain letters, numbers, dashes and underscores",
+				errorMessages["invalidDepOutput"], out.Name)
+		}
+		if names[out.Name] {
+			return fmt.Errorf("%s: output %s is defined more than once",
+				errorMessages["invalidDepOutput"], out.Name)
+		}
+		names[out.Name] = true
+	}
+
+	for _, grp := range dc.Config.DeploymentGroups {
+		for _, out := range grp.DeploymentOutputs {
+			for _, mod := range grp.Modules {
+				for _, output := range mod.Outputs {
+					if out.Name == fmt.Sprintf("%s_%s", output, mod.ID) {
+						return fmt.Errorf("%s: output %s has the same name as output %s of module %s "+
+							"in deployment group %s",
+							errorMessages["invalidDepOutput"], out.Name, output, mod.ID, grp.Name)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -56,6 +56,211 @@ func (s *MySuite) TestValidateVars(c *C) {
 	c.Assert(err, ErrorMatches, "vars.labels must be a map")
 }
 
+func (s *MySuite) TestValidateRenamedModules(c *C) {
+	dc := getDeploymentConfigForTest()
+	mods := dc.Config.DeploymentGroups[0].Modules
+	mods[0].RenamedFrom = "oldModule"
+	c.Assert(dc.validateRenamedModules(), IsNil)
+
+	// Fail: previous ID is still used
+	mods[0].RenamedFrom = mods[0].ID
+	err := dc.validateRenamedModules()
+	c.Assert(err, ErrorMatches, errorMessages["invalidRename"]+": .*")
+
+	// Fail: Packer modules cannot be renamed
+	mods[0].RenamedFrom = "oldModule"
+	mods[0].Kind = "packer"
+	err = dc.validateRenamedModules()
+	c.Assert(err, ErrorMatches, errorMessages["invalidRename"]+": only Terraform modules .*")
+}
+
+func (s *MySuite) TestValidateBackends(c *C) {
+	dc := getDeploymentConfigForTest()
+	dc.Config.DeploymentGroups = append(dc.Config.DeploymentGroups, DeploymentGroup{Name: "group2"})
+	c.Assert(dc.validateBackends(), IsNil)
+
+	dc.Config.DeploymentGroups[0].TerraformBackend = TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "b", "prefix": "p1"}}
+	dc.Config.DeploymentGroups[1].TerraformBackend = TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "b", "prefix": "p2"}}
+	c.Assert(dc.validateBackends(), IsNil)
+
+	// Success: backends of unknown types are not validated
+	dc.Config.DeploymentGroups[1].TerraformBackend = TerraformBackend{
+		Type: "remote", Configuration: map[string]interface{}{"organization": "o"}}
+	c.Assert(dc.validateBackends(), IsNil)
+
+	// Fail: missing required setting
+	dc.Config.DeploymentGroups[1].TerraformBackend = TerraformBackend{
+		Type: "azurerm", Configuration: map[string]interface{}{"storage_account_name": "a"}}
+	err := dc.validateBackends()
+	c.Assert(err, ErrorMatches, errorMessages["invalidBackend"]+
+		": deployment group group2: azurerm backends require the setting container_name")
+
+	// Fail: unknown setting
+	dc.Config.DeploymentGroups[1].TerraformBackend = TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "b", "prefx": "p2"}}
+	err = dc.validateBackends()
+	c.Assert(err, ErrorMatches, errorMessages["invalidBackend"]+
+		": deployment group group2: gcs backends have no setting prefx, .*")
+
+	dc.Config.TerraformBackendDefaults = TerraformBackend{
+		Type: "s3", Configuration: map[string]interface{}{"bucket": "b", "container_name": "c"}}
+	err = dc.validateBackends()
+	c.Assert(err, ErrorMatches, errorMessages["invalidBackend"]+
+		": terraform_backend_defaults: s3 backends have no setting container_name, .*")
+	dc.Config.TerraformBackendDefaults = TerraformBackend{}
+
+	// Fail: groups sharing the same state
+	dc.Config.DeploymentGroups[1].TerraformBackend = TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "b", "prefix": "p1"}}
+	err = dc.validateBackends()
+	c.Assert(err, ErrorMatches, errorMessages["invalidBackend"]+
+		": deployment groups group1 and group2 share the same Terraform state")
+
+	// Success: local state is kept in the directory of each group
+	dc.Config.DeploymentGroups[0].TerraformBackend = TerraformBackend{Type: "local"}
+	dc.Config.DeploymentGroups[1].TerraformBackend = TerraformBackend{Type: "local"}
+	c.Assert(dc.validateBackends(), IsNil)
+}
+
+func (s *MySuite) TestValidateExternalDeployments(c *C) {
+	dc := getDeploymentConfigForTest()
+	dc.Config.ExternalDeployments = map[string]ExternalDeployment{
+		"shared-net": {DeploymentDir: "../shared-net"},
+	}
+	c.Assert(dc.validateExternalDeployments(), IsNil)
+
+	// Fail: the name is used in Terraform identifiers
+	dc.Config.ExternalDeployments["1.shared"] = ExternalDeployment{DeploymentDir: "../shared"}
+	err := dc.validateExternalDeployments()
+	c.Assert(err, ErrorMatches, errorMessages["invalidExternalRef"]+": the name of external deployment .*")
+	delete(dc.Config.ExternalDeployments, "1.shared")
+
+	// Fail: no deployment directory
+	dc.Config.ExternalDeployments["shared-fs"] = ExternalDeployment{}
+	err = dc.validateExternalDeployments()
+	c.Assert(err, ErrorMatches, errorMessages["invalidExternalRef"]+": external deployment shared-fs has no deployment_dir")
+}
+
+func (s *MySuite) TestValidateModuleDependencies(c *C) {
+	dc := getDeploymentConfigForTest()
+	dc.Config.DeploymentGroups = append(dc.Config.DeploymentGroups, DeploymentGroup{
+		Name:    "group2",
+		Modules: []Module{{ID: "cluster", Kind: "terraform"}},
+	})
+	dc.ModuleToGroup = map[string]int{"testModule": 0, "testModuleWithLabels": 0, "cluster": 1}
+	mods := dc.Config.DeploymentGroups[0].Modules
+	mods[1].DependsOn = []string{"testModule"}
+	c.Assert(dc.validateModuleDependencies(), IsNil)
+
+	// Fail: the module is in a later group
+	mods[1].DependsOn = []string{"cluster"}
+	err := dc.validateModuleDependencies()
+	c.Assert(err, ErrorMatches, errorMessages["invalidDependsOn"]+
+		": .* which is not deployed before group group1, move cluster to group group1")
+
+	// Fail: the module is in an earlier group
+	mods[1].DependsOn = nil
+	dc.Config.DeploymentGroups[1].Modules[0].DependsOn = []string{"testModule"}
+	err = dc.validateModuleDependencies()
+	c.Assert(err, ErrorMatches, errorMessages["invalidDependsOn"]+
+		": .* which is always deployed before group group2, remove it from depends_on")
+	dc.Config.DeploymentGroups[1].Modules[0].DependsOn = nil
+
+	// Fail: the module does not exist
+	mods[1].DependsOn = []string{"bucket"}
+	err = dc.validateModuleDependencies()
+	c.Assert(err, ErrorMatches, errorMessages["invalidDependsOn"]+": .* bucket, which is not in the blueprint")
+
+	// Fail: the module depends on itself
+	mods[1].DependsOn = []string{"testModuleWithLabels"}
+	err = dc.validateModuleDependencies()
+	c.Assert(err, ErrorMatches, errorMessages["invalidDependsOn"]+": module testModuleWithLabels depends on itself")
+
+	// Fail: Packer modules
+	mods[1].DependsOn = []string{"testModule"}
+	mods[1].Kind = "packer"
+	err = dc.validateModuleDependencies()
+	c.Assert(err, ErrorMatches, errorMessages["invalidDependsOn"]+": only Terraform modules .*")
+}
+
+func (s *MySuite) TestValidateDeploymentOutputs(c *C) {
+	dc := getDeploymentConfigForTest()
+	dc.Config.Outputs = []DeploymentOutput{{Name: "login_ip", Value: "$(testModule.ip)"}}
+	dc.Config.DeploymentGroups[0].DeploymentOutputs = []GroupOutput{
+		{Name: "login_ip", ModuleID: "testModule", Output: "ip"},
+	}
+	c.Assert(dc.validateDeploymentOutputs(), IsNil)
+
+	// Fail: the name collides with the output of a module
+	dc.Config.DeploymentGroups[0].Modules[0].Outputs = []string{"login"}
+	dc.Config.DeploymentGroups[0].Modules[0].ID = "ip"
+	err := dc.validateDeploymentOutputs()
+	c.Assert(err, ErrorMatches, errorMessages["invalidDepOutput"]+": output login_ip has the same name .*")
+
+	// Fail: the name is used twice
+	dc.Config.Outputs = append(dc.Config.Outputs, DeploymentOutput{Name: "login_ip", Value: "$(ip.ip)"})
+	err = dc.validateDeploymentOutputs()
+	c.Assert(err, ErrorMatches, errorMessages["invalidDepOutput"]+": output login_ip is defined more than once")
+
+	// Fail: the name is not a Terraform identifier
+	dc.Config.Outputs = []DeploymentOutput{{Name: "login.ip", Value: "$(testModule.ip)"}}
+	err = dc.validateDeploymentOutputs()
+	c.Assert(err, ErrorMatches, errorMessages["invalidDepOutput"]+": the name of output .*")
+}
+
+func (s *MySuite) TestValidateModuleImports(c *C) {
+	dc := getDeploymentConfigForTest()
+	mod := dc.Config.DeploymentGroups[0].Modules[0]
+	dc.ModulesInfo["group1"][mod.Source] = modulereader.ModuleInfo{
+		Resources:   []string{"google_filestore_instance.filestore"},
+		ModuleCalls: []string{"vpc"},
+	}
+	mod.Imports = map[string]string{
+		"google_filestore_instance.filestore":    "projects/p/locations/z/instances/fs",
+		"module.vpc.google_compute_network.main": "projects/p/global/networks/net",
+	}
+	dc.Config.DeploymentGroups[0].Modules[0] = mod
+	c.Assert(dc.validateModuleImports(), IsNil)
+
+	// Success: instances of resources are addressed by index
+	mod.Imports = map[string]string{`google_filestore_instance.filestore["home"]`: "fs"}
+	dc.Config.DeploymentGroups[0].Modules[0] = mod
+	c.Assert(dc.validateModuleImports(), IsNil)
+
+	// Fail: the module has no such resource
+	mod.Imports = map[string]string{"google_compute_instance.vm": "vm"}
+	dc.Config.DeploymentGroups[0].Modules[0] = mod
+	err := dc.validateModuleImports()
+	c.Assert(err, ErrorMatches, errorMessages["invalidImport"]+": .*no resource google_compute_instance.vm")
+
+	// Fail: data sources cannot be imported
+	mod.Imports = map[string]string{"data.google_compute_network.main": "net"}
+	dc.Config.DeploymentGroups[0].Modules[0] = mod
+	err = dc.validateModuleImports()
+	c.Assert(err, ErrorMatches, errorMessages["invalidImport"]+": .*not the address of a managed resource")
+
+	// Fail: the module has no such child module
+	mod.Imports = map[string]string{"module.subnet.google_compute_subnetwork.main": "subnet"}
+	dc.Config.DeploymentGroups[0].Modules[0] = mod
+	err = dc.validateModuleImports()
+	c.Assert(err, ErrorMatches, errorMessages["invalidImport"]+": .*does not call a module named subnet")
+
+	// Fail: the ID is empty
+	mod.Imports = map[string]string{"google_filestore_instance.filestore": ""}
+	dc.Config.DeploymentGroups[0].Modules[0] = mod
+	err = dc.validateModuleImports()
+	c.Assert(err, ErrorMatches, errorMessages["invalidImport"]+": .*empty ID")
+
+	// Fail: only Terraform modules can import resources
+	mod.Imports = map[string]string{"google_filestore_instance.filestore": "fs"}
+	mod.Kind = "packer"
+	dc.Config.DeploymentGroups[0].Modules[0] = mod
+	err = dc.validateModuleImports()
+	c.Assert(err, ErrorMatches, errorMessages["invalidImport"]+": only resources of Terraform modules .*")
+}
+
 func (s *MySuite) TestValidateModuleSettings(c *C) {
 	testSource := filepath.Join(tmpTestDir, "module")
 	testSettings := map[string]interface{}{
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"hpc-toolkit/pkg/sourcereader"
 	"os"
+	"sort"
 
 	"github.com/hashicorp/terraform-config-inspect/tfconfig"
 )
@@ -60,6 +61,7 @@ func getHCLInfo(source string) (ModuleInfo, error) {
 			Description: v.Description,
 			Default:     v.Default,
 			Required:    v.Required,
+			Sensitive:   v.Sensitive,
 		}
 		vars = append(vars, vInfo)
 	}
@@ -68,9 +70,21 @@ func getHCLInfo(source string) (ModuleInfo, error) {
 		vInfo := VarInfo{
 			Name:        v.Name,
 			Description: v.Description,
+			Sensitive:   v.Sensitive,
 		}
 		outs = append(outs, vInfo)
 	}
+	// outputs are sorted so that the outputs of modules are reported in a
+	// stable order
+	sort.Slice(outs, func(i, j int) bool { return outs[i].Name < outs[j].Name })
 	ret.Outputs = outs
+	for addr := range module.ManagedResources {
+		ret.Resources = append(ret.Resources, addr)
+	}
+	for name := range module.ModuleCalls {
+		ret.ModuleCalls = append(ret.ModuleCalls, name)
+	}
+	sort.Strings(ret.Resources)
+	sort.Strings(ret.ModuleCalls)
 	return ret, nil
 }
@@ -20,7 +20,6 @@ import (
 	"fmt"
 	"hpc-toolkit/pkg/sourcereader"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
@@ -36,19 +35,20 @@ func (r PackerReader) SetInfo(source string, modInfo ModuleInfo) {
 	r.allModInfo[source] = modInfo
 }
 
-func addTfExtension(filename string) {
+func addTfExtension(filename string) error {
 	newFilename := fmt.Sprintf("%s.tf", filename)
 	if err := os.Rename(filename, newFilename); err != nil {
-		log.Fatalf(
+		return fmt.Errorf(
 			"failed to add .tf extension to %s needed to get info on packer module: %v",
 			filename, err)
 	}
+	return nil
 }
 
-func getHCLFiles(dir string) []string {
+func getHCLFiles(dir string) ([]string, error) {
 	allFiles, err := ioutil.ReadDir(dir)
 	if err != nil {
-		log.Fatalf("Failed to read packer source directory at %s: %v", dir, err)
+		return nil, fmt.Errorf("Failed to read packer source directory at %s: %v", dir, err)
 	}
 	var hclFiles []string
 	for _, f := range allFiles {
@@ -59,7 +59,7 @@ func getHCLFiles(dir string) []string {
 			hclFiles = append(hclFiles, filepath.Join(dir, f.Name()))
 		}
 	}
-	return hclFiles
+	return hclFiles, nil
 }
 
 // GetInfo reads the ModuleInfo for a packer module
@@ -82,10 +82,15 @@ func (r PackerReader) GetInfo(source string) (ModuleInfo, error) {
 	if err = sourceReader.GetModule(source, modPath); err != nil {
 		return ModuleInfo{}, err
 	}
-	packerFiles := getHCLFiles(modPath)
+	packerFiles, err := getHCLFiles(modPath)
+	if err != nil {
+		return ModuleInfo{}, err
+	}
 
 	for _, packerFile := range packerFiles {
-		addTfExtension(packerFile)
+		if err := addTfExtension(packerFile); err != nil {
+			return ModuleInfo{}, err
+		}
 	}
 	modInfo, err := getHCLInfo(modPath)
 	if err != nil {
@@ -23,6 +23,7 @@ import (
 	"hpc-toolkit/pkg/sourcereader"
 	"io/ioutil"
 	"log"
+	"os"
 	"path"
 	"strings"
 )
@@ -37,6 +38,8 @@ type VarInfo struct {
 	Description string
 	Default     interface{}
 	Required    bool
+	// Sensitive reports whether Terraform hides the value of the variable
+	Sensitive bool
 }
 
 // ModuleInfo stores information about a module
@@ -44,6 +47,12 @@ type ModuleInfo struct {
 	Inputs       []VarInfo
 	Outputs      []VarInfo
 	RequiredApis []string
+	// Resources are the addresses of the resources managed by a Terraform
+	// module, such as google_compute_network.network
+	Resources []string
+	// ModuleCalls are the names of the child modules called by a Terraform
+	// module
+	ModuleCalls []string
 }
 
 // GetOutputsAsMap returns the outputs list as a map for quicker access
@@ -67,6 +76,7 @@ func GetModuleInfo(source string, kind string) (ModuleInfo, error) {
 		if err != nil {
 			return ModuleInfo{}, err
 		}
+		defer os.RemoveAll(tmpDir)
 		modPath = path.Join(tmpDir, "module")
 		sourceReader := sourcereader.Factory(source)
 		if err = sourceReader.GetModule(source, modPath); err != nil {
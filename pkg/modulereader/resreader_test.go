@@ -37,6 +37,9 @@ module "test_module" {
 data "test_data" "test_data_name" {
 	name = "test_data_name"
 }
+resource "test_resource" "test_resource_name" {
+	name = "test_resource_name"
+}
 `
 	testVariablesTf = `
 variable "test_variable" {
@@ -49,6 +52,10 @@ output "test_output" {
 	description = "This is just a test"
 	value       = "test_value"
 }
+output "test_secret" {
+	value     = "test_secret_value"
+	sensitive = true
+}
 `
 )
 
@@ -198,7 +205,13 @@ func (s *MySuite) TestGetInfo_TFWriter(c *C) {
 	moduleInfo, err := reader.GetInfo(terraformDir)
 	c.Assert(err, IsNil)
 	c.Assert(moduleInfo.Inputs[0].Name, Equals, "test_variable")
-	c.Assert(moduleInfo.Outputs[0].Name, Equals, "test_output")
+	c.Assert(moduleInfo.Inputs[0].Sensitive, Equals, false)
+	outputs := moduleInfo.GetOutputsAsMap()
+	c.Assert(outputs, HasLen, 2)
+	c.Assert(outputs["test_output"].Sensitive, Equals, false)
+	c.Assert(outputs["test_secret"].Sensitive, Equals, true)
+	c.Assert(moduleInfo.Resources, DeepEquals, []string{"test_resource.test_resource_name"})
+	c.Assert(moduleInfo.ModuleCalls, DeepEquals, []string{"test_module"})
 }
 
 // packerreader.go
@@ -0,0 +1,189 @@
+/**
+* Copyright 2022 Google LLC
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package modulewriter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"hpc-toolkit/pkg/config"
+)
+
+const (
+	archivedGroupsDirName = "archived_groups"
+	archiveIDFormat       = "20060102T150405.000Z"
+)
+
+// removedGroups lists the deployment groups of an existing deployment
+// directory that are no longer in the blueprint
+func removedGroups(depDir string, blueprint *config.Blueprint) []string {
+	files, err := ioutil.ReadDir(depDir)
+	if err != nil {
+		return nil
+	}
+	current := make(map[string]bool)
+	for _, group := range blueprint.DeploymentGroups {
+		current[group.Name] = true
+	}
+
+	var removed []string
+	for _, f := range files {
+		if f.IsDir() && f.Name() != hiddenGhpcDirName && !current[f.Name()] {
+			removed = append(removed, f.Name())
+		}
+	}
+	return removed
+}
+
+// newArchiveID returns a unique, chronologically sortable ID for an archive
+func newArchiveID(depDir string) string {
+	for {
+		id := time.Now().UTC().Format(archiveIDFormat)
+		if _, err := os.Stat(filepath.Join(depDir, hiddenGhpcDirName, archivedGroupsDirName, id)); os.IsNotExist(err) {
+			return id
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// archiveGroups moves removed deployment groups, including any Terraform
+// state, from the previous deployment groups into a new timestamped archive.
+// The archive also records the groups as they appear in the manifest of the
+// deployment, so that they can be restored into it.
+func archiveGroups(depDir string, groups []string, undo *rollback) (string, error) {
+	archiveID := newArchiveID(depDir)
+	archiveDir := filepath.Join(depDir, hiddenGhpcDirName, archivedGroupsDirName, archiveID)
+	if err := os.MkdirAll(filepath.Dir(archiveDir), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory to archive deployment groups at %s: %w", archiveDir, err)
+	}
+	// an existing archive is never reused, as undoing would remove it
+	if err := os.Mkdir(archiveDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory to archive deployment groups at %s: %w", archiveDir, err)
+	}
+	undo.add(func() error { return os.RemoveAll(archiveDir) })
+
+	if manifest, err := ReadManifest(depDir); err == nil {
+		archived := manifest
+		archived.DeploymentGroups = []GroupManifest{}
+		for _, grp := range manifest.DeploymentGroups {
+			if slices.Contains(groups, grp.Name) {
+				archived.DeploymentGroups = append(archived.DeploymentGroups, grp)
+			}
+		}
+		if err := writeManifestFile(archived, filepath.Join(archiveDir, manifestFileName)); err != nil {
+			return "", fmt.Errorf("failed to record archived deployment groups: %w", err)
+		}
+	}
+
+	prevGroupDir := filepath.Join(depDir, hiddenGhpcDirName, prevDeploymentGroupDirName)
+	for _, group := range groups {
+		src := filepath.Join(prevGroupDir, group)
+		dest := filepath.Join(archiveDir, group)
+		if err := os.Rename(src, dest); err != nil {
+			return "", fmt.Errorf("failed to archive deployment group %s: %w", group, err)
+		}
+		undo.add(func() error { return os.Rename(dest, src) })
+	}
+	return archiveID, nil
+}
+
+func printGroupRemovalWarning(depDir string, archiveID string, groups []string) {
+	archiveDir := filepath.Join(depDir, hiddenGhpcDirName, archivedGroupsDirName, archiveID)
+	fmt.Println("**************** WARNING ****************")
+	for _, group := range groups {
+		fmt.Printf("Deployment group %s was removed from the blueprint.\n", group)
+	}
+	fmt.Printf("The removed groups and their Terraform state were archived in %s.\n", archiveDir)
+	fmt.Println("Cloud resources created by these groups may still exist. Destroy them, or")
+	fmt.Printf("restore a group with \"ghpc restore-group %s GROUP\".\n", depDir)
+	fmt.Printf("*****************************************\n\n")
+}
+
+// RestoreGroup moves an archived deployment group back into the deployment
+// directory and adds it to the deployment manifest. If archiveID is empty, the
+// most recent archive of the group is restored. It returns the ID of the
+// archive that was restored.
+func RestoreGroup(depDir string, group string, archiveID string) (string, error) {
+	archivesDir := filepath.Join(depDir, hiddenGhpcDirName, archivedGroupsDirName)
+	if archiveID == "" {
+		archives, err := ioutil.ReadDir(archivesDir)
+		if err != nil {
+			return "", fmt.Errorf("no archived deployment groups found in %s: %w", depDir, err)
+		}
+		var ids []string
+		for _, a := range archives {
+			if _, err := os.Stat(filepath.Join(archivesDir, a.Name(), group)); err == nil {
+				ids = append(ids, a.Name())
+			}
+		}
+		if len(ids) == 0 {
+			return "", fmt.Errorf("deployment group %s was not found in any archive of %s", group, depDir)
+		}
+		sort.Strings(ids)
+		archiveID = ids[len(ids)-1]
+	}
+
+	src := filepath.Join(archivesDir, archiveID, group)
+	if _, err := os.Stat(src); err != nil {
+		return "", fmt.Errorf("deployment group %s was not found in archive %s: %w", group, archiveID, err)
+	}
+	dest := filepath.Join(depDir, group)
+	if _, err := os.Stat(dest); err == nil {
+		return "", fmt.Errorf("cannot restore deployment group %s: %s already exists", group, dest)
+	}
+	manifest, err := ReadManifest(depDir)
+	if err != nil {
+		return "", err
+	}
+	grp := archivedGroup(filepath.Join(archivesDir, archiveID), group)
+	if grp.Files, err = digestGroupFiles(src, grp.Kind, nil); err != nil {
+		return "", fmt.Errorf("failed to compute file digests for deployment group %s: %w", group, err)
+	}
+	if err := os.Rename(src, dest); err != nil {
+		return "", fmt.Errorf("failed to restore deployment group %s: %w", group, err)
+	}
+	manifest.DeploymentGroups = append(manifest.DeploymentGroups, grp)
+	if err := writeManifest(manifest, depDir); err != nil {
+		os.Rename(dest, src)
+		return "", fmt.Errorf("failed to add deployment group %s to the manifest: %w", group, err)
+	}
+	return archiveID, nil
+}
+
+// archivedGroup returns the manifest record of an archived deployment group.
+// Groups archived before their record was kept are assumed to be Terraform
+// groups unless they hold Packer modules.
+func archivedGroup(archiveDir string, group string) GroupManifest {
+	if archived, err := readManifestFile(filepath.Join(archiveDir, manifestFileName)); err == nil {
+		for _, grp := range archived.DeploymentGroups {
+			if grp.Name == group {
+				return grp
+			}
+		}
+	}
+	grp := GroupManifest{Name: group, Kind: "terraform", Modules: []ModuleManifest{}}
+	if matches, _ := filepath.Glob(filepath.Join(archiveDir, group, "*", "*.pkr.hcl")); len(matches) > 0 {
+		grp.Kind = "packer"
+	}
+	return grp
+}
@@ -0,0 +1,146 @@
+/**
+* Copyright 2022 Google LLC
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package modulewriter
+
+import (
+	"encoding/json"
+	"fmt"
+	"hpc-toolkit/pkg/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BackendMigrationFileName is written to a Terraform deployment group whose
+// backend changed, until its state is migrated to the new backend
+const BackendMigrationFileName = "backend_migration.txt"
+
+// tfBackendStateFile records the backend a Terraform deployment group was
+// last initialized with, which Terraform needs to migrate its state
+var tfBackendStateFile = filepath.Join(".terraform", tfStateFileName)
+
+// BackendMigration is a change of the Terraform backend of a deployment group
+type BackendMigration struct {
+	Group string
+	From  *BackendManifest
+	To    *BackendManifest
+}
+
+// redactBackend returns a copy of a backend whose credentials are redacted, as
+// manifests written by earlier versions of ghpc still hold them
+func redactBackend(backend *BackendManifest) *BackendManifest {
+	if backend == nil {
+		return nil
+	}
+	redacted := config.TerraformBackend{Type: backend.Type, Configuration: backend.Configuration}.Redacted()
+	return &BackendManifest{Type: redacted.Type, Configuration: redacted.Configuration}
+}
+
+// describeBackend returns the type and configuration of a backend, with a
+// nil backend standing for the local state of the group
+func describeBackend(backend *BackendManifest) string {
+	if backend == nil {
+		return "local"
+	}
+	if len(backend.Configuration) == 0 {
+		return backend.Type
+	}
+	backend = redactBackend(backend)
+	var settings []string
+	for _, k := range orderedKeys(backend.Configuration) {
+		settings = append(settings, fmt.Sprintf("%s=%v", k, backend.Configuration[k]))
+	}
+	return fmt.Sprintf("%s (%s)", backend.Type, strings.Join(settings, ", "))
+}
+
+// sameBackend compares backends through their JSON encoding, as those read
+// from a manifest hold numbers as float64. Credentials are not compared.
+func sameBackend(a *BackendManifest, b *BackendManifest) bool {
+	aJSON, aErr := json.Marshal(redactBackend(a))
+	bJSON, bErr := json.Marshal(redactBackend(b))
+	return aErr == nil && bErr == nil && string(aJSON) == string(bJSON)
+}
+
+// backendMigrations lists the Terraform deployment groups of the next
+// generation of a deployment whose backend differs from the previous one
+func backendMigrations(prev Manifest, next Manifest) []BackendMigration {
+	previous := make(map[string]GroupManifest)
+	for _, grp := range prev.DeploymentGroups {
+		previous[grp.Name] = grp
+	}
+	migrations := []BackendMigration{}
+	for _, grp := range next.DeploymentGroups {
+		prevGrp, ok := previous[grp.Name]
+		if !ok || grp.Kind != "terraform" || prevGrp.Kind != "terraform" {
+			continue
+		}
+		if !sameBackend(prevGrp.TerraformBackend, grp.TerraformBackend) {
+			migrations = append(migrations, BackendMigration{
+				Group: grp.Name, From: prevGrp.TerraformBackend, To: grp.TerraformBackend})
+		}
+	}
+	return migrations
+}
+
+// stageBackendMigrations compares the staged generation of a deployment
+// against the one it replaces and writes a migration note into every staged
+// Terraform group whose backend changed
+func stageBackendMigrations(
+	deploymentDir string, stagingDir string, next Manifest) ([]BackendMigration, error) {
+	prev, err := ReadManifest(deploymentDir)
+	if err != nil {
+		// deployments written before manifests were introduced are not checked
+		return nil, nil
+	}
+	migrations := backendMigrations(prev, next)
+	for _, m := range migrations {
+		grpPath := filepath.Join(stagingDir, m.Group)
+		note := fmt.Sprintf(
+			"The Terraform backend of deployment group %s changed from\n\n  %s\n\nto\n\n  %s\n\n"+
+				"Its state must be migrated to the new backend before it is applied again:\n\n"+
+				"  terraform -chdir=%s init -migrate-state\n\n"+
+				"ghpc deploy runs this command and removes this file once the state was migrated.\n",
+			m.Group, describeBackend(m.From), describeBackend(m.To), filepath.Join(deploymentDir, m.Group))
+		notePath := filepath.Join(grpPath, BackendMigrationFileName)
+		if err := ioutil.WriteFile(notePath, []byte(note), 0644); err != nil {
+			return nil, fmt.Errorf("failed to write backend migration note %s: %w", notePath, err)
+		}
+	}
+	return migrations, nil
+}
+
+// HasPendingMigration reports whether the state of a Terraform deployment
+// group must be migrated to a new backend
+func HasPendingMigration(groupDir string) bool {
+	_, err := os.Stat(filepath.Join(groupDir, BackendMigrationFileName))
+	return err == nil
+}
+
+func printBackendMigrationWarning(migrations []BackendMigration) {
+	if len(migrations) == 0 {
+		return
+	}
+	fmt.Println("**************** WARNING ****************")
+	for _, m := range migrations {
+		fmt.Printf("The Terraform backend of group %s changed from %s to %s.\n",
+			m.Group, describeBackend(m.From), describeBackend(m.To))
+	}
+	fmt.Println("Migrate the state of these groups with \"terraform init -migrate-state\"")
+	fmt.Println("before applying them, or deploy them with \"ghpc deploy\", which does so.")
+	fmt.Printf("*****************************************\n\n")
+}
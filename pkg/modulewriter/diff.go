@@ -0,0 +1,402 @@
+/**
+* Copyright 2022 Google LLC
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package modulewriter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"hpc-toolkit/pkg/config"
+)
+
+const diffContextLines = 3
+
+// diffDeployment renders the blueprint into a scratch directory and reports
+// how it differs from the deployment directory: added and removed deployment
+// groups, changed module sources and a unified diff of every changed file.
+// Neither the deployment directory nor the blueprint are modified.
+func diffDeployment(blueprint *config.Blueprint, deploymentDir string, format string) (string, error) {
+	scratchDir, err := ioutil.TempDir("", "ghpc-dry-run-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(scratchDir)
+	renderDir := filepath.Join(scratchDir, filepath.Base(deploymentDir))
+
+	if err := prepDepDir(renderDir, false); err != nil {
+		return "", err
+	}
+	// writing a deployment records the names of modules in the blueprint
+	scratch := blueprint.Clone()
+	if err := writeDeploymentGroups(&scratch, renderDir, format); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	groupChanges, err := diffGroups(blueprint, deploymentDir)
+	if err != nil {
+		return "", err
+	}
+	if len(groupChanges) > 0 {
+		b.WriteString("Deployment group changes:\n")
+		b.WriteString(strings.Join(groupChanges, ""))
+	}
+	if sourceChanges := diffModuleSources(blueprint, deploymentDir); len(sourceChanges) > 0 {
+		b.WriteString("Module source changes:\n")
+		b.WriteString(strings.Join(sourceChanges, ""))
+	}
+
+	// preserved files are carried into the new deployment unchanged
+	preserved, err := loadPreserveList(deploymentDir, blueprint.PreserveFiles)
+	if err != nil {
+		return "", err
+	}
+	// groups removed from the blueprint have the kind they were created with
+	groupKinds := make(map[string]string)
+	if manifest, err := ReadManifest(deploymentDir); err == nil {
+		for _, grp := range manifest.DeploymentGroups {
+			groupKinds[grp.Name] = grp.Kind
+		}
+	}
+	for _, grp := range blueprint.DeploymentGroups {
+		groupKinds[grp.Name] = grp.Kind
+	}
+	current, err := readDeploymentFiles(deploymentDir, groupKinds, preserved)
+	if err != nil {
+		return "", err
+	}
+	rendered, err := readDeploymentFiles(renderDir, groupKinds, preserved)
+	if err != nil {
+		return "", err
+	}
+	paths := make(map[string]bool)
+	for p := range current {
+		paths[p] = true
+	}
+	for p := range rendered {
+		paths[p] = true
+	}
+	for _, p := range orderedKeys(paths) {
+		from, to := "a/"+p, "b/"+p
+		if _, ok := current[p]; !ok {
+			from = os.DevNull
+		}
+		if _, ok := rendered[p]; !ok {
+			to = os.DevNull
+		}
+		diff := unifiedDiff(from, to, current[p], rendered[p])
+		if diff == "" && (from == os.DevNull || to == os.DevNull) {
+			// empty files that are created or deleted have no hunk
+			diff = fmt.Sprintf("--- %s\n+++ %s\n", from, to)
+		}
+		b.WriteString(diff)
+	}
+
+	if b.Len() == 0 {
+		return fmt.Sprintf("No changes to deployment %s.\n", deploymentDir), nil
+	}
+	return b.String(), nil
+}
+
+// diffGroups lists the deployment groups that would be added to or removed
+// from the deployment directory
+func diffGroups(blueprint *config.Blueprint, deploymentDir string) ([]string, error) {
+	existing := make(map[string]bool)
+	entries, err := os.ReadDir(deploymentDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != hiddenGhpcDirName {
+			existing[e.Name()] = true
+		}
+	}
+
+	changes := []string{}
+	for _, grp := range blueprint.DeploymentGroups {
+		if !existing[grp.Name] {
+			changes = append(changes, fmt.Sprintf("  + %s\n", grp.Name))
+		}
+		delete(existing, grp.Name)
+	}
+	for _, name := range orderedKeys(existing) {
+		changes = append(changes, fmt.Sprintf("  - %s\n", name))
+	}
+	return changes, nil
+}
+
+// diffModuleSources compares the module sources of the blueprint against
+// those recorded in the deployment manifest, if there is one
+func diffModuleSources(blueprint *config.Blueprint, deploymentDir string) []string {
+	manifest, err := ReadManifest(deploymentDir)
+	if err != nil {
+		return nil
+	}
+	recorded := make(map[string]string)
+	for _, grp := range manifest.DeploymentGroups {
+		for _, mod := range grp.Modules {
+			recorded[grp.Name+"/"+mod.ID] = mod.Source
+		}
+	}
+
+	changes := []string{}
+	for _, grp := range blueprint.DeploymentGroups {
+		for _, mod := range grp.Modules {
+			key := grp.Name + "/" + mod.ID
+			prev, ok := recorded[key]
+			switch {
+			case !ok:
+				changes = append(changes, fmt.Sprintf("  + %s: %s\n", key, mod.Source))
+			case prev != mod.Source:
+				changes = append(changes, fmt.Sprintf("  ~ %s: %s -> %s\n", key, prev, mod.Source))
+			}
+			delete(recorded, key)
+		}
+	}
+	for _, key := range orderedKeys(recorded) {
+		changes = append(changes, fmt.Sprintf("  - %s: %s\n", key, recorded[key]))
+	}
+	return changes
+}
+
+// readDeploymentFiles reads every file of a deployment directory that is
+// written by ghpc, indexed by its slash separated path
+func readDeploymentFiles(
+	deploymentDir string,
+	groupKinds map[string]string,
+	preserved preserveList,
+) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.WalkDir(deploymentDir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == deploymentDir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(deploymentDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+		kind := groupKinds[parts[0]]
+		if d.IsDir() {
+			if rel == hiddenGhpcDirName || isUntracked(rel, true, kind) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isUntracked(rel, false, kind) {
+			return nil
+		}
+		// preserve patterns apply to paths relative to the group directory
+		if len(parts) == 2 && preserved.matches(parts[1]) {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(b)
+		return nil
+	})
+	return files, err
+}
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+	// indices of the line in the old and new text at which the op applies
+	from, to int
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines returns the edit script that turns a into b. It follows the
+// linear space variant of Myers' algorithm, so that long generated files are
+// compared without a table of every pair of their lines.
+func diffLines(a, b []string) []diffOp {
+	ops := []diffOp{}
+	equal := func(i, j, n int) {
+		for k := 0; k < n; k++ {
+			ops = append(ops, diffOp{' ', a[i+k], i + k, j + k})
+		}
+	}
+	var diff func(aLo, aHi, bLo, bHi int)
+	diff = func(aLo, aHi, bLo, bHi int) {
+		prefix := 0
+		for aLo+prefix < aHi && bLo+prefix < bHi && a[aLo+prefix] == b[bLo+prefix] {
+			prefix++
+		}
+		equal(aLo, bLo, prefix)
+		aLo, bLo = aLo+prefix, bLo+prefix
+		suffix := 0
+		for aLo < aHi-suffix && bLo < bHi-suffix && a[aHi-1-suffix] == b[bHi-1-suffix] {
+			suffix++
+		}
+		aHi, bHi = aHi-suffix, bHi-suffix
+
+		switch {
+		case aLo == aHi:
+			for j := bLo; j < bHi; j++ {
+				ops = append(ops, diffOp{'+', b[j], aLo, j})
+			}
+		case bLo == bHi:
+			for i := aLo; i < aHi; i++ {
+				ops = append(ops, diffOp{'-', a[i], i, bLo})
+			}
+		default:
+			x, y, u, v := middleSnake(a[aLo:aHi], b[bLo:bHi])
+			diff(aLo, aLo+x, bLo, bLo+y)
+			equal(aLo+x, bLo+y, u-x)
+			diff(aLo+u, aHi, bLo+v, bHi)
+		}
+		equal(aHi, bHi, suffix)
+	}
+	diff(0, len(a), 0, len(b))
+	return ops
+}
+
+// middleSnake returns the start (x, y) and end (u, v) of the diagonal run of
+// equal lines in the middle of a shortest edit script from a to b, found by
+// searching from both ends at once
+func middleSnake(a, b []string) (int, int, int, int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	// furthest x reached on each diagonal k = x - y, from the start in
+	// forward and from the end in backward
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	for d := 0; d <= maxD; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			forward[offset+k] = x
+			if odd && delta-k >= -(d-1) && delta-k <= d-1 && x+backward[offset+delta-k] >= n {
+				return x0, y0, x, y
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x, y = x+1, y+1
+			}
+			backward[offset+k] = x
+			if !odd && delta-k >= -d && delta-k <= d && x+forward[offset+delta-k] >= n {
+				return n - x, m - y, n - x0, m - y0
+			}
+		}
+	}
+	// unreachable, the searches always meet within maxD steps
+	return 0, 0, n, m
+}
+
+// unifiedDiff returns the differences between two texts in unified diff
+// format, or an empty string if they are identical
+func unifiedDiff(fromName, toName, a, b string) string {
+	if a == b {
+		return ""
+	}
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	for start := 0; start < len(ops); {
+		// find the next change and extend the hunk while the following
+		// change is close enough to share context
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		last := first
+		for k := first + 1; k < len(ops); k++ {
+			if ops[k].kind == ' ' {
+				continue
+			}
+			if k-last > 2*diffContextLines {
+				break
+			}
+			last = k
+		}
+		hunkStart := first - diffContextLines
+		if hunkStart < start {
+			hunkStart = start
+		}
+		hunkEnd := last + diffContextLines + 1
+		if hunkEnd > len(ops) {
+			hunkEnd = len(ops)
+		}
+
+		aLen, bLen := 0, 0
+		for _, op := range ops[hunkStart:hunkEnd] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		aStart, bStart := ops[hunkStart].from, ops[hunkStart].to
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, op := range ops[hunkStart:hunkEnd] {
+			fmt.Fprintf(&out, "%c%s\n", op.kind, op.line)
+		}
+		start = hunkEnd
+	}
+	return out.String()
+}
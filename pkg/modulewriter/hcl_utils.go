@@ -21,6 +21,8 @@ import (
 
 	"github.com/hashicorp/hcl/v2/hclwrite"
 	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
 func escapeBlueprintVariables(hclBytes []byte) []byte {
@@ -35,6 +37,14 @@ func escapeLiteralVariables(hclBytes []byte) []byte {
 	return re.ReplaceAll(hclBytes, []byte(`((`))
 }
 
+// orderedKeys returns the keys of a map in lexical order so that generated
+// files are reproducible
+func orderedKeys[V any](m map[string]V) []string {
+	keys := maps.Keys(m)
+	slices.Sort(keys)
+	return keys
+}
+
 func writeHclAttributes(vars map[string]cty.Value, dst string) error {
 	if err := createBaseFile(dst); err != nil {
 		return fmt.Errorf("error creating variables file %v: %v", filepath.Base(dst), err)
@@ -45,9 +55,9 @@ func writeHclAttributes(vars map[string]cty.Value, dst string) error {
 	hclBody := hclFile.Body()
 
 	// for each variable
-	for k, v := range vars {
+	for _, k := range orderedKeys(vars) {
 		// Write attribute
-		hclBody.SetAttributeValue(k, v)
+		hclBody.SetAttributeValue(k, vars[k])
 	}
 
 	// Write file
@@ -0,0 +1,250 @@
+/**
+* Copyright 2022 Google LLC
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package modulewriter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	historyDirName           = "history"
+	historyBlueprintFileName = "blueprint.yaml"
+	historyIDFormat          = "20060102T150405.000Z"
+	// DefaultHistoryLimit is the number of generations of a deployment kept in
+	// its history unless configured otherwise
+	DefaultHistoryLimit = 5
+)
+
+// HistoryEntry is a generation of a deployment recorded in its history
+type HistoryEntry struct {
+	ID       string
+	Manifest Manifest
+}
+
+func historyDir(deploymentDir string) string {
+	return filepath.Join(deploymentDir, hiddenGhpcDirName, historyDirName)
+}
+
+// newHistoryID returns a unique, chronologically sortable ID for a snapshot
+func newHistoryID(deploymentDir string) string {
+	for {
+		id := time.Now().UTC().Format(historyIDFormat)
+		if _, err := os.Stat(filepath.Join(historyDir(deploymentDir), id)); os.IsNotExist(err) {
+			return id
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// copyTrackedFiles copies the files of a deployment group written by ghpc,
+// leaving out Terraform state, other files created when deploying it and
+// preserved files
+func copyTrackedFiles(src string, dest string, kind string, preserved preserveList) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if rel != "." && isUntracked(rel, d.IsDir(), kind) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && preserved.matches(rel) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, b, info.Mode().Perm())
+	})
+}
+
+// recordHistory snapshots the deployment groups of the deployment directory,
+// the blueprint and the manifest in a new generation of the history
+func recordHistory(
+	deploymentDir string,
+	manifest Manifest,
+	bpYAML []byte,
+	preserved preserveList,
+	undo *rollback,
+) error {
+	snapshotDir := filepath.Join(historyDir(deploymentDir), newHistoryID(deploymentDir))
+	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
+		return err
+	}
+	undo.add(func() error { return os.RemoveAll(snapshotDir) })
+
+	for _, grp := range manifest.DeploymentGroups {
+		if err := copyTrackedFiles(
+			filepath.Join(deploymentDir, grp.Name), filepath.Join(snapshotDir, grp.Name), grp.Kind, preserved); err != nil {
+			return fmt.Errorf("failed to copy deployment group %s: %w", grp.Name, err)
+		}
+	}
+	if err := ioutil.WriteFile(
+		filepath.Join(snapshotDir, historyBlueprintFileName), bpYAML, 0644); err != nil {
+		return err
+	}
+	return writeManifestFile(manifest, filepath.Join(snapshotDir, manifestFileName))
+}
+
+func historyIDs(deploymentDir string) ([]string, error) {
+	entries, err := os.ReadDir(historyDir(deploymentDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() {
+			ids = append(ids, e.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// pruneHistory removes the oldest generations of the deployment history
+// beyond limit
+func pruneHistory(deploymentDir string, limit int) error {
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	ids, err := historyIDs(deploymentDir)
+	if err != nil {
+		return err
+	}
+	for len(ids) > limit {
+		if err := os.RemoveAll(filepath.Join(historyDir(deploymentDir), ids[0])); err != nil {
+			return err
+		}
+		ids = ids[1:]
+	}
+	return nil
+}
+
+// ListHistory returns the generations recorded in the deployment history,
+// oldest first
+func ListHistory(deploymentDir string) ([]HistoryEntry, error) {
+	ids, err := historyIDs(deploymentDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history of deployment %s: %w", deploymentDir, err)
+	}
+	entries := []HistoryEntry{}
+	for _, id := range ids {
+		manifest, err := readManifestFile(
+			filepath.Join(historyDir(deploymentDir), id, manifestFileName))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, HistoryEntry{ID: id, Manifest: manifest})
+	}
+	return entries, nil
+}
+
+// RollbackDeployment regenerates the deployment groups of a deployment
+// directory from a generation of its history. The current Terraform state of
+// each group is kept, and groups that do not exist in that generation are
+// archived if opts allows group removal. The rollback is recorded as a new
+// generation of the history, created now.
+func RollbackDeployment(deploymentDir string, id string, opts WriteOptions) error {
+	snapshotDir := filepath.Join(historyDir(deploymentDir), id)
+	manifest, err := readManifestFile(filepath.Join(snapshotDir, manifestFileName))
+	if err != nil {
+		return fmt.Errorf("deployment history %s not found: %w", id, err)
+	}
+	bpYAML, err := ioutil.ReadFile(filepath.Join(snapshotDir, historyBlueprintFileName))
+	if err != nil {
+		return fmt.Errorf("failed to read blueprint of deployment history %s: %w", id, err)
+	}
+	if !opts.Force {
+		if err := checkDrift(deploymentDir); err != nil {
+			return err
+		}
+	}
+
+	stagingDir, err := createStagingDir(deploymentDir)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	restored := make(map[string]bool)
+	for _, grp := range manifest.DeploymentGroups {
+		if err := copyTrackedFiles(
+			filepath.Join(snapshotDir, grp.Name), filepath.Join(stagingDir, grp.Name), grp.Kind, nil); err != nil {
+			return fmt.Errorf("failed to copy deployment group %s from history: %w", grp.Name, err)
+		}
+		restored[grp.Name] = true
+	}
+
+	files, err := ioutil.ReadDir(deploymentDir)
+	if err != nil {
+		return err
+	}
+	var removed []string
+	for _, f := range files {
+		if f.IsDir() && f.Name() != hiddenGhpcDirName && !restored[f.Name()] {
+			removed = append(removed, f.Name())
+		}
+	}
+	if len(removed) > 0 && !opts.AllowGroupRemoval {
+		return fmt.Errorf("rolling back to %s removes deployment groups %s, "+
+			"which requires the --allow-group-removal command line argument",
+			id, strings.Join(removed, ", "))
+	}
+	// state applied before the rollback predates the restored generation
+	manifest.CreatedAt = time.Now().UTC()
+
+	migrations, err := stageBackendMigrations(deploymentDir, stagingDir, manifest)
+	if err != nil {
+		return err
+	}
+	archiveID, err := commitStagedGroups(
+		deploymentDir, stagingDir, removed, manifest, bpYAML, opts.HistoryLimit)
+	if err != nil {
+		return err
+	}
+	if archiveID != "" {
+		printGroupRemovalWarning(deploymentDir, archiveID, removed)
+	}
+	printBackendMigrationWarning(migrations)
+	return nil
+}
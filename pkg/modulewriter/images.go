@@ -0,0 +1,134 @@
+/**
+* Copyright 2022 Google LLC
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package modulewriter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"hpc-toolkit/pkg/config"
+)
+
+const (
+	// packerImagesFileName is the base name of the files that declare and
+	// supply the images built by Packer modules of earlier deployment groups
+	packerImagesFileName = "packer_images"
+	// PackerManifestFileName is written by the manifest post-processor of a
+	// Packer module when it is built
+	PackerManifestFileName = "packer-manifest.json"
+)
+
+// PackerImageManifest records an image built by a Packer module of an earlier
+// deployment group that is used by a deployment group
+type PackerImageManifest struct {
+	Group    string `json:"group"`
+	Module   string `json:"module"`
+	Variable string `json:"variable"`
+}
+
+// packerManifest is the part of the file written by the Packer manifest
+// post-processor that identifies the artifacts of the last build
+type packerManifest struct {
+	Builds []struct {
+		ArtifactID    string `json:"artifact_id"`
+		PackerRunUUID string `json:"packer_run_uuid"`
+	} `json:"builds"`
+	LastRunUUID string `json:"last_run_uuid"`
+}
+
+func packerImageDescription(img config.PackerImage) string {
+	return fmt.Sprintf("Name of the image built by Packer module %s of deployment group %s",
+		img.ModuleID, img.Group)
+}
+
+// ReadPackerImage returns the name of the image built by the last run of a
+// Packer module
+func ReadPackerImage(deploymentDir string, group string, module string) (string, error) {
+	manifestPath := filepath.Join(deploymentDir, group, module, PackerManifestFileName)
+	b, err := os.ReadFile(manifestPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf(
+			"the image of Packer module %s in deployment group %s has not been built: "+
+				"%s does not exist, run \"packer build\" in %s first",
+			module, group, manifestPath, filepath.Dir(manifestPath))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var manifest packerManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return "", fmt.Errorf("failed to parse Packer manifest %s: %w", manifestPath, err)
+	}
+	for _, build := range manifest.Builds {
+		if build.PackerRunUUID == manifest.LastRunUUID && build.ArtifactID != "" {
+			return build.ArtifactID, nil
+		}
+	}
+	return "", fmt.Errorf(
+		"Packer manifest %s has no image for the last build of module %s", manifestPath, module)
+}
+
+// PackerImagesVarsPath is the path of the file that supplies the images built
+// by Packer modules of earlier deployment groups to a deployment group
+func PackerImagesVarsPath(deploymentDir string, group string) string {
+	return filepath.Join(deploymentDir, group, packerImagesFileName+".auto.tfvars.json")
+}
+
+// ImportPackerImages reads the names of the images built by Packer modules of
+// earlier deployment groups from their Packer manifests and supplies them to
+// the Terraform variables of a deployment group. It returns the image names
+// indexed by variable.
+func ImportPackerImages(deploymentDir string, group string) (map[string]string, error) {
+	manifest, err := ReadManifest(deploymentDir)
+	if err != nil {
+		return nil, err
+	}
+	var grp *GroupManifest
+	for i := range manifest.DeploymentGroups {
+		if manifest.DeploymentGroups[i].Name == group {
+			grp = &manifest.DeploymentGroups[i]
+		}
+	}
+	if grp == nil {
+		return nil, fmt.Errorf("deployment group %s was not found in %s", group, deploymentDir)
+	}
+
+	images := make(map[string]string)
+	for _, img := range grp.PackerImages {
+		if images[img.Variable], err = ReadPackerImage(deploymentDir, img.Group, img.Module); err != nil {
+			return nil, err
+		}
+	}
+	if len(images) == 0 {
+		return images, nil
+	}
+
+	b, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	tfvarsPath := PackerImagesVarsPath(deploymentDir, group)
+	if err := os.WriteFile(tfvarsPath, append(b, '\n'), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", tfvarsPath, err)
+	}
+	return images, nil
+}
@@ -0,0 +1,356 @@
+/**
+* Copyright 2022 Google LLC
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package modulewriter
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/deploymentio"
+	"hpc-toolkit/pkg/sourcereader"
+)
+
+const manifestFileName = "manifest.json"
+
+// Manifest records how a deployment directory was created: the version of
+// ghpc, the blueprint and the module sources that went into it and digests of
+// every file that was generated.
+type Manifest struct {
+	GhpcVersion      string                 `json:"ghpc_version"`
+	GhpcCommit       string                 `json:"ghpc_commit"`
+	CreatedAt        time.Time              `json:"created_at"`
+	BlueprintName    string                 `json:"blueprint_name"`
+	DeploymentName   string                 `json:"deployment_name"`
+	BlueprintDigest  string                 `json:"blueprint_digest"`
+	Format           string                 `json:"format"`
+	Vars             map[string]interface{} `json:"vars"`
+	PreserveFiles    []string               `json:"preserve_files,omitempty"`
+	DeploymentGroups []GroupManifest        `json:"deployment_groups"`
+}
+
+// GroupManifest records a deployment group in the manifest
+type GroupManifest struct {
+	Name             string                `json:"name"`
+	Kind             string                `json:"kind"`
+	TerraformBackend *BackendManifest      `json:"terraform_backend,omitempty"`
+	Modules          []ModuleManifest      `json:"modules"`
+	Files            map[string]string     `json:"files"`
+	PackerImages     []PackerImageManifest `json:"packer_images,omitempty"`
+	// Outputs are the names of the outputs of the deployment that are
+	// written to the group
+	Outputs []string `json:"outputs,omitempty"`
+	// DependsOn are the groups that must be deployed before this group. It is
+	// missing from manifests written before groups could depend on each other,
+	// whose groups are deployed in order.
+	DependsOn []string `json:"depends_on"`
+}
+
+// BackendManifest records the terraform backend of a deployment group
+type BackendManifest struct {
+	Type          string                 `json:"type"`
+	Configuration map[string]interface{} `json:"configuration,omitempty"`
+}
+
+// ModuleManifest records the provenance of a module in the manifest. Commit is
+// only set for git sources.
+type ModuleManifest struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Source string `json:"source"`
+	Commit string `json:"commit,omitempty"`
+	Digest string `json:"digest"`
+}
+
+// Files created by running terraform or packer in a deployment group of each
+// kind, rather than by ghpc, are never recorded in the manifest
+var (
+	untrackedDirs = map[string][]string{
+		"terraform": {".terraform"},
+		"packer":    {"packer_cache"},
+	}
+	untrackedFiles = map[string][]string{
+		// the backend migration note is removed by ghpc deploy once the
+		// state was migrated
+		"terraform": {"*.tfstate", "*.tfstate.*", ".terraform.lock.hcl", "crash.log", BackendMigrationFileName},
+	}
+)
+
+// isUntracked reports whether a path of a deployment group of the given kind
+// was created by running terraform or packer. Paths of groups of unknown
+// kind, "", are checked against the files of every kind.
+func isUntracked(relPath string, isDir bool, kind string) bool {
+	for _, k := range []string{"terraform", "packer"} {
+		if kind != "" && kind != k {
+			continue
+		}
+		patterns := untrackedFiles[k]
+		if isDir {
+			patterns = untrackedDirs[k]
+		}
+		for _, pattern := range patterns {
+			if match, _ := filepath.Match(pattern, filepath.Base(relPath)); match {
+				return true
+			}
+		}
+		if k == "packer" && !isDir && isPackerArtifact(filepath.Base(relPath)) {
+			return true
+		}
+	}
+	return false
+}
+
+func digestBytes(b []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
+
+// localFS reads directories and files from the local filesystem
+type localFS struct{}
+
+func (localFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(filepath.FromSlash(name))
+}
+
+func (localFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.FromSlash(name))
+}
+
+// digestTree returns a single digest over the relative paths and contents of
+// all files below root, visited in lexical order. Git metadata is ignored.
+func digestTree(fsys deploymentio.BaseFS, root string) (string, error) {
+	h := sha256.New()
+	var walk func(dir string, rel string) error
+	walk = func(dir string, rel string) error {
+		entries, err := fsys.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			entryPath := path.Join(dir, entry.Name())
+			entryRel := path.Join(rel, entry.Name())
+			if entry.IsDir() {
+				if entry.Name() == ".git" {
+					continue
+				}
+				if err := walk(entryPath, entryRel); err != nil {
+					return err
+				}
+				continue
+			}
+			b, err := fsys.ReadFile(entryPath)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00%s\n", entryRel, digestBytes(b))
+		}
+		return nil
+	}
+	if err := walk(root, ""); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// digestGroupFiles returns the digest of every file ghpc wrote to a
+// deployment group, indexed by its path relative to the group directory.
+// Preserved files belong to users and are left out.
+func digestGroupFiles(groupDir string, kind string, preserved preserveList) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.WalkDir(groupDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(groupDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if isUntracked(rel, d.IsDir(), kind) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || preserved.matches(rel) {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = digestBytes(b)
+		return nil
+	})
+	return files, err
+}
+
+// resolveModule records the commit and content digest of a module source.
+// Git sources are resolved from the clone made when the module was read.
+func resolveModule(mod config.Module) (ModuleManifest, error) {
+	mm := ModuleManifest{ID: mod.ID, Kind: mod.Kind, Source: mod.Source}
+	var err error
+	switch {
+	case sourcereader.IsGitPath(mod.Source):
+		var modPath string
+		mm.Commit, modPath, err = sourcereader.CheckoutGitModule(mod.Source)
+		if err != nil {
+			return mm, err
+		}
+		mm.Digest, err = digestTree(localFS{}, filepath.ToSlash(modPath))
+	case sourcereader.IsEmbeddedPath(mod.Source):
+		mm.Digest, err = digestTree(sourcereader.ModuleFS, mod.Source)
+	default:
+		mm.Digest, err = digestTree(localFS{}, filepath.ToSlash(mod.Source))
+	}
+	return mm, err
+}
+
+func digestBlueprint(blueprint *config.Blueprint) (string, error) {
+	b, err := yaml.Marshal(blueprint)
+	if err != nil {
+		return "", err
+	}
+	return digestBytes(b), nil
+}
+
+func newManifest(
+	blueprint *config.Blueprint,
+	deploymentDir string,
+	preserved preserveList,
+	opts WriteOptions,
+) (Manifest, error) {
+	deploymentName, err := blueprint.DeploymentName()
+	if err != nil {
+		return Manifest{}, err
+	}
+	bpDigest, err := digestBlueprint(blueprint)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to compute blueprint digest: %w", err)
+	}
+	format := opts.Format
+	if format == "" {
+		format = FormatHCL
+	}
+	redacted := blueprint.Redacted()
+	manifest := Manifest{
+		GhpcVersion:      opts.GhpcVersion,
+		GhpcCommit:       opts.GhpcCommit,
+		CreatedAt:        time.Now().UTC(),
+		BlueprintName:    blueprint.BlueprintName,
+		DeploymentName:   deploymentName,
+		BlueprintDigest:  bpDigest,
+		Format:           format,
+		Vars:             redacted.Vars,
+		PreserveFiles:    blueprint.PreserveFiles,
+		DeploymentGroups: []GroupManifest{},
+	}
+
+	resolved := make(map[string]ModuleManifest)
+	for iGrp, grp := range blueprint.DeploymentGroups {
+		gm := GroupManifest{
+			Name:      grp.Name,
+			Kind:      grp.Kind,
+			Modules:   []ModuleManifest{},
+			DependsOn: blueprint.GroupDependencies(iGrp),
+		}
+		if backend := redacted.DeploymentGroups[iGrp].TerraformBackend; backend.Type != "" {
+			gm.TerraformBackend = &BackendManifest{
+				Type:          backend.Type,
+				Configuration: backend.Configuration,
+			}
+		}
+		for _, img := range grp.PackerImages {
+			gm.PackerImages = append(gm.PackerImages, PackerImageManifest{
+				Group:    img.Group,
+				Module:   img.ModuleID,
+				Variable: img.Variable(),
+			})
+		}
+		for _, out := range grp.DeploymentOutputs {
+			gm.Outputs = append(gm.Outputs, out.Name)
+		}
+		for _, mod := range grp.Modules {
+			mm, ok := resolved[mod.Source]
+			if !ok {
+				if mm, err = resolveModule(mod); err != nil {
+					return manifest, fmt.Errorf(
+						"failed to resolve source %s of module %s: %w", mod.Source, mod.ID, err)
+				}
+				resolved[mod.Source] = mm
+			}
+			mm.ID = mod.ID
+			mm.Kind = mod.Kind
+			gm.Modules = append(gm.Modules, mm)
+		}
+		if gm.Files, err = digestGroupFiles(filepath.Join(deploymentDir, grp.Name), grp.Kind, preserved); err != nil {
+			return manifest, fmt.Errorf(
+				"failed to compute file digests for deployment group %s: %w", grp.Name, err)
+		}
+		manifest.DeploymentGroups = append(manifest.DeploymentGroups, gm)
+	}
+	return manifest, nil
+}
+
+func writeManifest(manifest Manifest, deploymentDir string) error {
+	return writeManifestFile(manifest, filepath.Join(deploymentDir, hiddenGhpcDirName, manifestFileName))
+}
+
+func writeManifestFile(manifest Manifest, manifestPath string) error {
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	// replace the manifest in a single step so it is never left half written
+	tmpPath := manifestPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, manifestPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest recorded when a deployment directory was
+// created
+func ReadManifest(deploymentDir string) (Manifest, error) {
+	return readManifestFile(filepath.Join(deploymentDir, hiddenGhpcDirName, manifestFileName))
+}
+
+func readManifestFile(manifestPath string) (Manifest, error) {
+	var manifest Manifest
+	b, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read deployment manifest: %w", err)
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return manifest, fmt.Errorf("failed to parse deployment manifest %s: %w", manifestPath, err)
+	}
+	return manifest, nil
+}
@@ -28,6 +28,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const (
@@ -36,6 +37,45 @@ const (
 	gitignoreTemplate          = "deployment.gitignore.tmpl"
 )
 
+const (
+	// FormatHCL writes terraform deployment groups in native HCL syntax
+	FormatHCL = "hcl"
+	// FormatTFJSON writes terraform deployment groups in Terraform JSON syntax
+	FormatTFJSON = "tf-json"
+)
+
+// HiddenGhpcDir returns the directory in which ghpc keeps the metadata of a
+// deployment directory
+func HiddenGhpcDir(deploymentDir string) string {
+	return filepath.Join(deploymentDir, hiddenGhpcDirName)
+}
+
+// WriteOptions controls how a deployment directory is written
+type WriteOptions struct {
+	// Overwrite allows an existing deployment directory to be overwritten
+	Overwrite bool
+	// Format is the syntax used for terraform deployment groups, either
+	// FormatHCL (default) or FormatTFJSON
+	Format string
+	// GhpcVersion and GhpcCommit identify the build of ghpc recorded in the
+	// deployment manifest
+	GhpcVersion string
+	GhpcCommit  string
+	// Force allows overwriting a deployment whose files were changed after
+	// it was created
+	Force bool
+	// AllowGroupRemoval allows overwriting a deployment with a blueprint that
+	// no longer contains some of its deployment groups. The removed groups are
+	// archived under the .ghpc directory.
+	AllowGroupRemoval bool
+	// HistoryLimit is the number of generations of the deployment kept in its
+	// history, DefaultHistoryLimit if not set
+	HistoryLimit int
+	// DryRun prints the changes that would be made to the deployment
+	// directory without writing it
+	DryRun bool
+}
+
 // ModuleWriter interface for writing modules to a deployment
 type ModuleWriter interface {
 	getNumModules() int
@@ -48,16 +88,24 @@ type ModuleWriter interface {
 	restoreState(deploymentDir string) error
 }
 
-var kinds = map[string]ModuleWriter{
-	"terraform": new(TFWriter),
-	"packer":    new(PackerWriter),
+// moduleWriters holds the writer of each module kind. Writers keep the state
+// of a single write of a deployment and are never shared between writes.
+type moduleWriters map[string]ModuleWriter
+
+// newModuleWriters returns the writers for a write of a deployment whose
+// terraform deployment groups use the given format
+func newModuleWriters(format string) moduleWriters {
+	return moduleWriters{
+		"terraform": &TFWriter{format: format},
+		"packer":    new(PackerWriter),
+	}
 }
 
 //go:embed *.tmpl
 var templatesFS embed.FS
 
-func factory(kind string) ModuleWriter {
-	writer, exists := kinds[kind]
+func (writers moduleWriters) factory(kind string) ModuleWriter {
+	writer, exists := writers[kind]
 	if !exists {
 		log.Fatalf(
 			"modulewriter: Module kind (%s) is not valid. "+
@@ -68,19 +116,77 @@ func factory(kind string) ModuleWriter {
 
 // WriteDeployment writes a deployment directory using modules defined the
 // environment blueprint.
-func WriteDeployment(blueprint *config.Blueprint, outputDir string, overwriteFlag bool) error {
+func WriteDeployment(blueprint *config.Blueprint, outputDir string, opts WriteOptions) error {
 	deploymentName, err := blueprint.DeploymentName()
 	if err != nil {
 		return err
 	}
 	deploymentDir := filepath.Join(outputDir, deploymentName)
 
-	overwrite := isOverwriteAllowed(deploymentDir, blueprint, overwriteFlag)
-	if err := prepDepDir(deploymentDir, overwrite); err != nil {
+	if opts.Format, err = terraformFormat(opts.Format); err != nil {
 		return err
 	}
 
-	if err := copySource(deploymentDir, &blueprint.DeploymentGroups); err != nil {
+	renames := suggestRenames(blueprint, deploymentDir)
+	overwrite := isOverwriteAllowed(deploymentDir, blueprint, opts.Overwrite)
+	removed := removedGroups(deploymentDir, blueprint)
+	if !overwrite && opts.Overwrite && opts.AllowGroupRemoval && len(removed) > 0 {
+		overwrite = true
+	}
+	refusal := checkOverwrite(deploymentDir, overwrite)
+	if refusal == nil && overwrite && !opts.Force {
+		refusal = checkDrift(deploymentDir)
+	}
+	if opts.DryRun {
+		report, err := diffDeployment(blueprint, deploymentDir, opts.Format)
+		if err != nil {
+			return err
+		}
+		fmt.Print(report)
+		printRenameWarning(renames)
+		// the changes are reported along with the reason the write would be
+		// refused, if any
+		if refusal != nil {
+			return refusal
+		}
+		if len(removed) > 0 {
+			fmt.Printf("Deployment groups %s would be archived in %s.\n", strings.Join(removed, ", "),
+				filepath.Join(deploymentDir, hiddenGhpcDirName, archivedGroupsDirName))
+		}
+		return nil
+	}
+
+	if refusal != nil {
+		return refusal
+	}
+	created, err := initDepDir(deploymentDir, overwrite)
+	if err == nil {
+		var archiveID string
+		var migrations []BackendMigration
+		archiveID, migrations, err = writeStagedDeployment(blueprint, deploymentDir, removed, opts)
+		if err == nil {
+			printInstructions(blueprint, deploymentDir)
+			if archiveID != "" {
+				printGroupRemovalWarning(deploymentDir, archiveID, removed)
+			}
+			printRenameWarning(renames)
+			printBackendMigrationWarning(migrations)
+			return nil
+		}
+	}
+	// an existing deployment directory was already restored, a new one is
+	// removed entirely
+	if created {
+		os.RemoveAll(deploymentDir)
+	}
+	return err
+}
+
+// writeDeploymentGroups copies module sources and writes every deployment
+// group into a prepared deployment directory
+func writeDeploymentGroups(blueprint *config.Blueprint, deploymentDir string, format string) error {
+	writers := newModuleWriters(format)
+	if err := copySource(deploymentDir, &blueprint.DeploymentGroups, writers); err != nil {
 		return err
 	}
 
@@ -89,34 +195,34 @@ func WriteDeployment(blueprint *config.Blueprint, outputDir string, overwriteFla
 	}
 
 	for _, grp := range blueprint.DeploymentGroups {
-
-		deploymentName, err := blueprint.DeploymentName()
-		if err != nil {
-			return err
-		}
-
-		deploymentPath := filepath.Join(outputDir, deploymentName)
-		writer, ok := kinds[grp.Kind]
+		writer, ok := writers[grp.Kind]
 		if !ok {
 			return fmt.Errorf(
 				"Invalid kind in deployment group %s, got '%s'", grp.Name, grp.Kind)
 		}
 
 		if err := writer.writeDeploymentGroup(
-			grp, blueprint.Vars, deploymentPath,
+			grp, blueprint.Vars, deploymentDir,
 		); err != nil {
 			return fmt.Errorf("error writing deployment group %s: %w", grp.Name, err)
 		}
 	}
+	return nil
+}
 
-	for _, writer := range kinds {
-		if writer.getNumModules() > 0 {
-			if err := writer.restoreState(deploymentDir); err != nil {
-				return fmt.Errorf("error trying to restore terraform state: %w", err)
-			}
-		}
+// terraformFormat checks the syntax requested for terraform deployment groups
+// and returns it, FormatHCL if none was requested
+func terraformFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return FormatHCL, nil
+	case FormatHCL, FormatTFJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf(
+			"invalid output format %s, must be one of (%s, %s)",
+			format, FormatHCL, FormatTFJSON)
 	}
-	return nil
 }
 
 func createGroupDirs(deploymentPath string, deploymentGroups *[]config.DeploymentGroup) error {
@@ -133,7 +239,7 @@ func createGroupDirs(deploymentPath string, deploymentGroups *[]config.Deploymen
 	return nil
 }
 
-func copySource(deploymentPath string, deploymentGroups *[]config.DeploymentGroup) error {
+func copySource(deploymentPath string, deploymentGroups *[]config.DeploymentGroup, writers moduleWriters) error {
 
 	for iGrp, grp := range *deploymentGroups {
 		basePath := filepath.Join(deploymentPath, grp.Name)
@@ -163,13 +269,33 @@ func copySource(deploymentPath string, deploymentGroups *[]config.DeploymentGrou
 			}
 
 			/* Create module level files */
-			writer := factory(module.Kind)
+			writer := writers.factory(module.Kind)
 			writer.addNumModules(1)
 		}
 	}
 	return nil
 }
 
+// printInstructions prints how to deploy each deployment group
+func printInstructions(blueprint *config.Blueprint, deploymentDir string) {
+	// groups are listed after the groups they depend on
+	for _, iGrp := range blueprint.DeploymentOrder() {
+		grp := blueprint.DeploymentGroups[iGrp]
+		groupPath := filepath.Join(deploymentDir, grp.Name)
+		switch grp.Kind {
+		case "terraform":
+			printTerraformInstructions(
+				groupPath, grp.Name, len(grp.PackerImages) > 0, HasPendingMigration(groupPath))
+		case "packer":
+			for _, mod := range grp.Modules {
+				printPackerInstructions(filepath.Join(groupPath, mod.ID), mod.ID)
+			}
+		}
+	}
+	fmt.Println("Alternatively, to deploy every group in order, run:")
+	fmt.Printf("  ghpc deploy %s\n\n", deploymentDir)
+}
+
 func printInstructionsPreamble(kind string, path string, name string) {
 	fmt.Printf("%s group '%s' was successfully created in directory %s\n", kind, name, path)
 	fmt.Println("To deploy, run the following commands:")
@@ -226,36 +352,62 @@ func (err *OverwriteDeniedError) Error() string {
 	return fmt.Sprintf("Failed to overwrite existing deployment.\n\n"+
 		"Use the -w command line argument to enable overwrite.\n"+
 		"If overwrite is already enabled then this may be because "+
-		"you are attempting to remove a deployment group, which is not supported.\n"+
+		"you are attempting to remove a deployment group, which requires "+
+		"the --allow-group-removal command line argument.\n"+
 		"original error: %v",
 		err.cause)
 }
 
-// Prepares a deployment directory to be written to.
-func prepDepDir(depDir string, overwrite bool) error {
+// checkOverwrite returns the error refusing to write the deployment directory,
+// if it exists and may not be overwritten
+func checkOverwrite(depDir string, overwrite bool) error {
+	if _, err := os.Stat(depDir); os.IsNotExist(err) {
+		return nil
+	}
+	if !overwrite {
+		return &OverwriteDeniedError{fmt.Errorf("The directory already exists: %s", depDir)}
+	}
+	// Confirm we have a previously written deployment dir before overwritting.
+	if _, err := os.Stat(filepath.Join(depDir, hiddenGhpcDirName)); os.IsNotExist(err) {
+		return fmt.Errorf(
+			"While trying to update the deployment directory at %s, the '.ghpc/' dir could not be found", depDir)
+	}
+	return nil
+}
+
+// initDepDir creates a deployment directory, or confirms that an existing one
+// may be overwritten. It reports whether the directory was created.
+func initDepDir(depDir string, overwrite bool) (bool, error) {
 	deploymentio := deploymentio.GetDeploymentioLocal()
 	ghpcDir := filepath.Join(depDir, hiddenGhpcDirName)
 	gitignoreFile := filepath.Join(depDir, ".gitignore")
 
+	if err := checkOverwrite(depDir, overwrite); err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(depDir); err == nil {
+		return false, nil
+	}
 	// create deployment directory
 	if err := deploymentio.CreateDirectory(depDir); err != nil {
-		if !overwrite {
-			return &OverwriteDeniedError{err}
-		}
+		return false, err
+	}
 
-		// Confirm we have a previously written deployment dir before overwritting.
-		if _, err := os.Stat(ghpcDir); os.IsNotExist(err) {
-			return fmt.Errorf(
-				"While trying to update the deployment directory at %s, the '.ghpc/' dir could not be found", depDir)
-		}
-	} else {
-		if err := deploymentio.CreateDirectory(ghpcDir); err != nil {
-			return fmt.Errorf("Failed to create directory at %s: err=%w", ghpcDir, err)
-		}
+	if err := deploymentio.CreateDirectory(ghpcDir); err != nil {
+		return true, fmt.Errorf("Failed to create directory at %s: err=%w", ghpcDir, err)
+	}
 
-		if err := deploymentio.CopyFromFS(templatesFS, gitignoreTemplate, gitignoreFile); err != nil {
-			return fmt.Errorf("Failed to copy template.gitignore file to %s: err=%w", gitignoreFile, err)
-		}
+	if err := deploymentio.CopyFromFS(templatesFS, gitignoreTemplate, gitignoreFile); err != nil {
+		return true, fmt.Errorf("Failed to copy template.gitignore file to %s: err=%w", gitignoreFile, err)
+	}
+	return true, nil
+}
+
+// Prepares a deployment directory to be written to.
+func prepDepDir(depDir string, overwrite bool) error {
+	ghpcDir := filepath.Join(depDir, hiddenGhpcDirName)
+	if _, err := initDepDir(depDir, overwrite); err != nil {
+		return err
 	}
 
 	// clean up old dirs
@@ -17,12 +17,15 @@ limitations under the License.
 package modulewriter
 
 import (
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"hpc-toolkit/pkg/config"
 	"hpc-toolkit/pkg/deploymentio"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
@@ -39,8 +42,53 @@ import (
 var (
 	testDir            string
 	terraformModuleDir string
+	updateGolden       = flag.Bool("update", false, "update golden files in testdata")
 )
 
+const goldenBlueprint = `
+blueprint_name: golden
+vars:
+  deployment_name: golden
+  project_id: test-project
+  region: us-central1
+  zone: us-central1-a
+  labels:
+    ghpc_blueprint: golden
+    ghpc_deployment: golden
+  machine_types: [n2-standard-2, c2-standard-60]
+  tags: {b: "2", a: "1"}
+deployment_groups:
+- group: primary
+  terraform_backend:
+    type: gcs
+    configuration:
+      prefix: golden/primary
+      bucket: a-bucket
+  modules:
+  - id: network
+    source: %[1]s
+    kind: terraform
+    settings:
+      zone: ((var.zone))
+      project_id: ((var.project_id))
+      network_name: golden-net
+      labels:
+        ghpc_role: network
+    outputs: [subnetwork_name, network_name]
+  - id: vm
+    source: %[1]s
+    kind: terraform
+    wrapsettingswith:
+      network_storage: ["flatten(", ")"]
+    settings:
+      subnetwork_name: ((module.network.subnetwork_name))
+      network_storage:
+      - ((module.network.network_name))
+      machine_type: n2-standard-2
+      count: 2
+      enable: true
+`
+
 // Setup GoCheck
 type MySuite struct{}
 
@@ -152,7 +200,7 @@ func (s *MySuite) TestPrepDepDir_OverwriteRealDep(c *C) {
 	realDepDir := filepath.Join(testDir, testBlueprint.Vars["deployment_name"].(string))
 
 	// writes a full deployment w/ actual resource groups
-	WriteDeployment(&testBlueprint, testDir, false /* overwrite */)
+	WriteDeployment(&testBlueprint, testDir, WriteOptions{})
 
 	// confirm existence of resource groups (beyond .ghpc dir)
 	files, _ := ioutil.ReadDir(realDepDir)
@@ -215,13 +263,13 @@ func (s *MySuite) TestIsOverwriteAllowed(c *C) {
 func (s *MySuite) TestWriteDeployment(c *C) {
 	testBlueprint := getBlueprintForTest()
 	testBlueprint.Vars = map[string]interface{}{"deployment_name": "test_write_deployment"}
-	err := WriteDeployment(&testBlueprint, testDir, false /* overwriteFlag */)
+	err := WriteDeployment(&testBlueprint, testDir, WriteOptions{})
 	c.Check(err, IsNil)
 	// Overwriting the deployment fails
-	err = WriteDeployment(&testBlueprint, testDir, false /* overwriteFlag */)
+	err = WriteDeployment(&testBlueprint, testDir, WriteOptions{})
 	c.Check(err, NotNil)
 	// Overwriting the deployment succeeds with flag
-	err = WriteDeployment(&testBlueprint, testDir, true /* overwriteFlag */)
+	err = WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true})
 	c.Check(err, IsNil)
 }
 
@@ -288,19 +336,19 @@ func (s *MySuite) TestWriteDeployment_BadDeploymentName(c *C) {
 	var e *config.InputValueError
 
 	testBlueprint.Vars = map[string]interface{}{"deployment_name": 100}
-	err := WriteDeployment(&testBlueprint, testDir, false /* overwriteFlag */)
+	err := WriteDeployment(&testBlueprint, testDir, WriteOptions{})
 	c.Check(errors.As(err, &e), Equals, true)
 
 	testBlueprint.Vars = map[string]interface{}{"deployment_name": false}
-	err = WriteDeployment(&testBlueprint, testDir, false /* overwriteFlag */)
+	err = WriteDeployment(&testBlueprint, testDir, WriteOptions{})
 	c.Check(errors.As(err, &e), Equals, true)
 
 	testBlueprint.Vars = map[string]interface{}{"deployment_name": ""}
-	err = WriteDeployment(&testBlueprint, testDir, false /* overwriteFlag */)
+	err = WriteDeployment(&testBlueprint, testDir, WriteOptions{})
 	c.Check(errors.As(err, &e), Equals, true)
 
 	testBlueprint.Vars = map[string]interface{}{}
-	err = WriteDeployment(&testBlueprint, testDir, false /* overwriteFlag */)
+	err = WriteDeployment(&testBlueprint, testDir, WriteOptions{})
 	c.Check(errors.As(err, &e), Equals, true)
 }
 
@@ -539,6 +587,59 @@ func (s *MySuite) TestWriteMain(c *C) {
 	exists, err = stringExistsInFile("list(flatten(", mainFilePath)
 	c.Assert(err, IsNil)
 	c.Assert(exists, Equals, true)
+
+	// Test with renamed module
+	testModules[0].RenamedFrom = "old_module"
+	err = writeMain(testModules, testBackend, testMainDir)
+	c.Assert(err, IsNil)
+	mainTf, err := ioutil.ReadFile(mainFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(string(mainTf), Matches,
+		"(?s).*moved {\n  from = module.old_module\n  to   = module.test_module\n}\n.*")
+
+	// Test with imported resources
+	testModules[0].Imports = map[string]string{
+		`google_filestore_instance.filestore["home"]`: "projects/test-project/locations/us-central1-a/instances/home",
+	}
+	err = writeMain(testModules, testBackend, testMainDir)
+	c.Assert(err, IsNil)
+	mainTf, err = ioutil.ReadFile(mainFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(string(mainTf), Matches,
+		`(?s).*import {\n  to = module.test_module.google_filestore_instance.filestore\["home"\]\n`+
+			`  id = "projects/test-project/locations/us-central1-a/instances/home"\n}\n.*`)
+
+	// Test with module dependencies
+	testModules[1].DependsOn = []string{"test_module", "other_module"}
+	err = writeMain(testModules, testBackend, testMainDir)
+	c.Assert(err, IsNil)
+	mainTf, err = ioutil.ReadFile(mainFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(string(mainTf), Matches,
+		`(?s).*\n  depends_on     = \[module.test_module, module.other_module\]\n}\n.*`)
+}
+
+func (s *MySuite) TestWriteVersions(c *C) {
+	modules := []config.Module{{ID: "network"}, {ID: "cluster"}}
+	c.Check(requiredTerraformVersion(modules), Equals, ">= 0.13")
+	// moved blocks
+	modules[1].RenamedFrom = "old_cluster"
+	c.Check(requiredTerraformVersion(modules), Equals, ">= 1.1")
+	// import blocks
+	modules[0].Imports = map[string]string{"google_compute_network.n": "net"}
+	c.Check(requiredTerraformVersion(modules), Equals, ">= 1.5")
+
+	versionsDir := filepath.Join(testDir, "TestWriteVersions")
+	c.Assert(os.MkdirAll(versionsDir, 0755), IsNil)
+	c.Assert(writeVersions(versionsDir, requiredTerraformVersion(modules)), IsNil)
+	exists, err := stringExistsInFile(`required_version = ">= 1.5"`, filepath.Join(versionsDir, "versions.tf"))
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, true)
+
+	c.Assert(writeVersionsJSON(versionsDir, ">= 1.1"), IsNil)
+	body, err := readJSONFile(filepath.Join(versionsDir, "versions.tf.json"))
+	c.Assert(err, IsNil)
+	c.Check(body["terraform"].(map[string]interface{})["required_version"], Equals, ">= 1.1")
 }
 
 func (s *MySuite) TestWriteOutputs(c *C) {
@@ -551,18 +652,18 @@ func (s *MySuite) TestWriteOutputs(c *C) {
 
 	// Simple success, no modules
 	testModules := []config.Module{}
-	err := writeOutputs(testModules, testOutputsDir)
+	err := writeOutputs(testModules, nil, nil, testOutputsDir)
 	c.Assert(err, IsNil)
 
 	// Failure: Bad path
-	err = writeOutputs(testModules, "not/a/real/path")
+	err = writeOutputs(testModules, nil, nil, "not/a/real/path")
 	c.Assert(err, ErrorMatches, "error creating outputs.tf file: .*")
 
 	// Success: Outputs added
 	outputList := []string{"output1", "output2"}
 	moduleWithOutputs := config.Module{Outputs: outputList, ID: "testMod"}
 	testModules = []config.Module{moduleWithOutputs}
-	err = writeOutputs(testModules, testOutputsDir)
+	err = writeOutputs(testModules, nil, nil, testOutputsDir)
 	c.Assert(err, IsNil)
 	exists, err := stringExistsInFile(outputList[0], outputsFilePath)
 	c.Assert(err, IsNil)
@@ -570,6 +671,28 @@ func (s *MySuite) TestWriteOutputs(c *C) {
 	exists, err = stringExistsInFile(outputList[1], outputsFilePath)
 	c.Assert(err, IsNil)
 	c.Assert(exists, Equals, true)
+
+	// Success: outputs of the deployment are written under their own name
+	depOutputs := []config.GroupOutput{{Name: "login_ip", ModuleID: "testMod", Output: "output1"}}
+	err = writeOutputs(testModules, depOutputs, nil, testOutputsDir)
+	c.Assert(err, IsNil)
+	outputsTf, err := ioutil.ReadFile(outputsFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(string(outputsTf), Matches,
+		`(?s).*output "login_ip" {\n  description = "Output 'output1' of module 'testMod'"\n`+
+			`  value       = module.testMod.output1\n}\n.*`)
+
+	// Success: sensitive outputs are marked
+	err = writeOutputs(testModules, depOutputs, []string{"output2_testMod", "login_ip"}, testOutputsDir)
+	c.Assert(err, IsNil)
+	outputsTf, err = ioutil.ReadFile(outputsFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(string(outputsTf), Matches,
+		`(?s).*value       = module.testMod.output2\n  sensitive   = true\n.*`)
+	c.Assert(string(outputsTf), Matches,
+		`(?s).*value       = module.testMod.output1\n  sensitive   = true\n.*`)
+	c.Assert(string(outputsTf), Matches,
+		`(?s).*value       = module.testMod.output1\n}\n.*`)
 }
 
 func (s *MySuite) TestWriteVariables(c *C) {
@@ -582,17 +705,17 @@ func (s *MySuite) TestWriteVariables(c *C) {
 
 	// Simple success, empty vars
 	testVars := make(map[string]cty.Value)
-	err := writeVariables(testVars, testVarDir)
+	err := writeVariables(testVars, nil, testVarDir)
 	c.Assert(err, IsNil)
 
 	// Failure: Bad path
-	err = writeVariables(testVars, "not/a/real/path")
+	err = writeVariables(testVars, nil, "not/a/real/path")
 	c.Assert(err, ErrorMatches, "error creating variables.tf file: .*")
 
 	// Success, common vars
 	testVars["deployment_name"] = cty.StringVal("test_deployment")
 	testVars["project_id"] = cty.StringVal("test_project")
-	err = writeVariables(testVars, testVarDir)
+	err = writeVariables(testVars, nil, testVarDir)
 	c.Assert(err, IsNil)
 	exists, err := stringExistsInFile("\"deployment_name\"", varsFilePath)
 	c.Assert(err, IsNil)
@@ -601,8 +724,17 @@ func (s *MySuite) TestWriteVariables(c *C) {
 	// Success, "dynamic type"
 	testVars = make(map[string]cty.Value)
 	testVars["project_id"] = cty.NullVal(cty.DynamicPseudoType)
-	err = writeVariables(testVars, testVarDir)
+	err = writeVariables(testVars, nil, testVarDir)
+	c.Assert(err, IsNil)
+
+	// Success, sensitive vars
+	testVars = map[string]cty.Value{"admin_password": cty.StringVal("hunter2")}
+	err = writeVariables(testVars, []string{"admin_password"}, testVarDir)
 	c.Assert(err, IsNil)
+	variablesTf, err := ioutil.ReadFile(varsFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(string(variablesTf), Matches,
+		`(?s).*variable "admin_password" {\n.*  type        = string\n  sensitive   = true\n}\n.*`)
 }
 
 func (s *MySuite) TestWriteProviders(c *C) {
@@ -655,6 +787,1079 @@ func (s *MySuite) TestHandleLiteralVariables(c *C) {
 	c.Assert(exists, Equals, true)
 }
 
+// tfjsonwriter.go
+func readJSONFile(path string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]interface{}
+	err = json.Unmarshal(b, &body)
+	return body, err
+}
+
+func (s *MySuite) TestJSONExpression(c *C) {
+	// literal variables become template interpolations
+	exp, err := jsonExpression(cty.StringVal("((var.project_id))"))
+	c.Assert(err, IsNil)
+	c.Assert(exp, Equals, "${var.project_id}")
+
+	// literal strings are escaped to prevent template interpretation
+	exp, err = jsonExpression(cty.StringVal("echo ${HOME} %{if}"))
+	c.Assert(err, IsNil)
+	c.Assert(exp, Equals, "echo $${HOME} %%{if}")
+
+	// blueprint escapes are resolved
+	exp, err = jsonExpression(cty.StringVal("\\((not.var)) \\$(not.var)"))
+	c.Assert(err, IsNil)
+	c.Assert(exp, Equals, "((not.var)) $(not.var)")
+
+	// embedded literal variables become interpolations in a template
+	exp, err = jsonExpression(cty.StringVal("prefix-((var.x))-${y}-\\((not.var)) $(( i + 1 ))"))
+	c.Assert(err, IsNil)
+	c.Assert(exp, Equals, "prefix-${var.x}-$${y}-((not.var)) $(( i + 1 ))")
+
+	// collections are converted recursively
+	val := cty.ObjectVal(map[string]cty.Value{
+		"list":   cty.TupleVal([]cty.Value{cty.StringVal("((module.a.b))"), cty.NumberIntVal(2)}),
+		"enable": cty.BoolVal(true),
+	})
+	exp, err = jsonExpression(val)
+	c.Assert(err, IsNil)
+	c.Assert(exp, DeepEquals, map[string]interface{}{
+		"list":   []interface{}{"${module.a.b}", json.Number("2")},
+		"enable": true,
+	})
+}
+
+func (s *MySuite) TestHCLExpression(c *C) {
+	val := cty.ObjectVal(map[string]cty.Value{
+		"ghpc_role": cty.StringVal("compute"),
+		"ref":       cty.StringVal("((var.deployment_name))"),
+		"list":      cty.TupleVal([]cty.Value{cty.NumberIntVal(1), cty.StringVal("a")}),
+		"name":      cty.StringVal("((var.deployment_name))-${x}"),
+	})
+	c.Assert(hclExpression(val), Equals,
+		`{"ghpc_role" = "compute", "list" = [1, "a"], "name" = "${var.deployment_name}-$${x}", `+
+			`"ref" = var.deployment_name}`)
+}
+
+func (s *MySuite) TestWriteMainJSON(c *C) {
+	// Setup
+	testMainDir := filepath.Join(testDir, "TestWriteMainJSON")
+	mainFilePath := filepath.Join(testMainDir, "main.tf.json")
+	if err := os.Mkdir(testMainDir, 0755); err != nil {
+		log.Fatal("Failed to create test dir for creating main.tf.json file")
+	}
+
+	// Simple success
+	err := writeMainJSON([]config.Module{}, config.TerraformBackend{}, testMainDir)
+	c.Assert(err, IsNil)
+	body, err := readJSONFile(mainFilePath)
+	c.Assert(err, IsNil)
+	_, ok := body["module"]
+	c.Assert(ok, Equals, false)
+
+	// Modules with labels, wrapped settings and a backend
+	testModules := []config.Module{
+		{
+			ID:         "test_module",
+			ModuleName: "vpc",
+			Settings: map[string]interface{}{
+				"testSetting": "((var.project_id))",
+				"labels":      map[string]interface{}{"ghpc_role": "network"},
+			},
+		},
+		{
+			ID:         "test_module_with_wrap",
+			ModuleName: "vm",
+			WrapSettingsWith: map[string][]string{
+				"wrappedSetting": {"flatten(", ")"},
+			},
+			Settings: map[string]interface{}{
+				"wrappedSetting": []interface{}{"((module.test_module.subnet))", "val2"},
+			},
+		},
+	}
+	testBackend := config.TerraformBackend{
+		Type:          "gcs",
+		Configuration: map[string]interface{}{"bucket": "a_bucket"},
+	}
+	err = writeMainJSON(testModules, testBackend, testMainDir)
+	c.Assert(err, IsNil)
+	body, err = readJSONFile(mainFilePath)
+	c.Assert(err, IsNil)
+
+	backend := body["terraform"].(map[string]interface{})["backend"].(map[string]interface{})
+	c.Assert(backend["gcs"], DeepEquals, map[string]interface{}{"bucket": "a_bucket"})
+
+	modules := body["module"].(map[string]interface{})
+	mod := modules["test_module"].(map[string]interface{})
+	c.Assert(mod["source"], Equals, "./modules/vpc")
+	c.Assert(mod["testSetting"], Equals, "${var.project_id}")
+	c.Assert(mod["labels"], Equals, `${merge(var.labels, {"ghpc_role" = "network"})}`)
+	wrapMod := modules["test_module_with_wrap"].(map[string]interface{})
+	c.Assert(wrapMod["wrappedSetting"], Equals,
+		`${flatten([module.test_module.subnet, "val2"])}`)
+
+	_, ok = body["moved"]
+	c.Assert(ok, Equals, false)
+
+	// Renamed module
+	testModules[1].RenamedFrom = "old_module"
+	err = writeMainJSON(testModules, testBackend, testMainDir)
+	c.Assert(err, IsNil)
+	body, err = readJSONFile(mainFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(body["moved"], DeepEquals, []interface{}{
+		map[string]interface{}{"from": "module.old_module", "to": "module.test_module_with_wrap"},
+	})
+	_, ok = body["import"]
+	c.Assert(ok, Equals, false)
+
+	// Imported resources
+	testModules[0].Imports = map[string]string{"google_compute_network.network": "projects/p/global/networks/net"}
+	err = writeMainJSON(testModules, testBackend, testMainDir)
+	c.Assert(err, IsNil)
+	body, err = readJSONFile(mainFilePath)
+	c.Assert(err, IsNil)
+	c.Assert(body["import"], DeepEquals, []interface{}{
+		map[string]interface{}{
+			"to": "module.test_module.google_compute_network.network",
+			"id": "projects/p/global/networks/net",
+		},
+	})
+
+	// Module dependencies
+	testModules[1].DependsOn = []string{"test_module"}
+	err = writeMainJSON(testModules, testBackend, testMainDir)
+	c.Assert(err, IsNil)
+	body, err = readJSONFile(mainFilePath)
+	c.Assert(err, IsNil)
+	wrapMod = body["module"].(map[string]interface{})["test_module_with_wrap"].(map[string]interface{})
+	c.Assert(wrapMod["depends_on"], DeepEquals, []interface{}{"module.test_module"})
+
+	// Failure: invalid wrap
+	testModules[1].WrapSettingsWith["wrappedSetting"] = []string{"flatten("}
+	err = writeMainJSON(testModules, testBackend, testMainDir)
+	c.Assert(err, ErrorMatches, "invalid length of WrapSettingsWith.*")
+}
+
+func (s *MySuite) TestWriteDeployment_TFJSON(c *C) {
+	testBlueprint := getBlueprintForTest()
+	testBlueprint.Vars = map[string]interface{}{
+		"deployment_name": "test_write_deployment_json",
+		"project_id":      "test_project",
+	}
+	err := WriteDeployment(&testBlueprint, testDir, WriteOptions{Format: FormatTFJSON})
+	c.Assert(err, IsNil)
+
+	groupDir := filepath.Join(testDir, "test_write_deployment_json", "test_resource_group")
+	for _, f := range []string{
+		"main.tf.json", "variables.tf.json", "outputs.tf.json",
+		"providers.tf.json", "versions.tf.json", "terraform.tfvars.json",
+	} {
+		_, err := readJSONFile(filepath.Join(groupDir, f))
+		c.Check(err, IsNil)
+	}
+	_, err = os.Stat(filepath.Join(groupDir, "main.tf"))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	providers, _ := readJSONFile(filepath.Join(groupDir, "providers.tf.json"))
+	google := providers["provider"].(map[string]interface{})["google"].(map[string]interface{})
+	c.Check(google["project"], Equals, "${var.project_id}")
+
+	tfvars, _ := readJSONFile(filepath.Join(groupDir, "terraform.tfvars.json"))
+	c.Check(tfvars["project_id"], Equals, "test_project")
+
+	// the format of one write does not leak into the next
+	testBlueprint.Vars["deployment_name"] = "test_write_deployment_json_then_hcl"
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{}), IsNil)
+	_, err = os.Stat(filepath.Join(testDir, "test_write_deployment_json_then_hcl", "test_resource_group", "main.tf"))
+	c.Check(err, IsNil)
+
+	// Failure: unknown format
+	testBlueprint.Vars["deployment_name"] = "test_write_deployment_bad_format"
+	err = WriteDeployment(&testBlueprint, testDir, WriteOptions{Format: "yaml"})
+	c.Assert(err, ErrorMatches, "invalid output format yaml.*")
+}
+
+func (s *MySuite) TestWriteDeployment_Manifest(c *C) {
+	testBlueprint := getBlueprintForTest()
+	testBlueprint.Vars = map[string]interface{}{
+		"deployment_name": "test_write_manifest",
+		"project_id":      "test_project",
+	}
+	opts := WriteOptions{GhpcVersion: "v0.0.0", GhpcCommit: "abcdef"}
+	err := WriteDeployment(&testBlueprint, testDir, opts)
+	c.Assert(err, IsNil)
+
+	depDir := filepath.Join(testDir, "test_write_manifest")
+	manifest, err := ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	c.Check(manifest.GhpcVersion, Equals, "v0.0.0")
+	c.Check(manifest.GhpcCommit, Equals, "abcdef")
+	c.Check(manifest.BlueprintName, Equals, "simple")
+	c.Check(manifest.DeploymentName, Equals, "test_write_manifest")
+	c.Check(manifest.Format, Equals, FormatHCL)
+	c.Check(manifest.BlueprintDigest, Matches, "sha256:[0-9a-f]{64}")
+	c.Assert(manifest.DeploymentGroups, HasLen, 1)
+
+	grp := manifest.DeploymentGroups[0]
+	c.Check(grp.Name, Equals, "test_resource_group")
+	c.Check(grp.TerraformBackend, IsNil)
+	c.Check(grp.DependsOn, HasLen, 0)
+	c.Assert(grp.Modules, HasLen, 2)
+	c.Check(grp.Modules[0].ID, Equals, "testModule")
+	c.Check(grp.Modules[0].Commit, Equals, "")
+	c.Check(grp.Modules[0].Digest, Equals, grp.Modules[1].Digest)
+
+	mainTf, err := ioutil.ReadFile(filepath.Join(depDir, grp.Name, "main.tf"))
+	c.Assert(err, IsNil)
+	c.Check(grp.Files["main.tf"], Equals, digestBytes(mainTf))
+
+	// the manifest of an identical deployment only differs in time of creation
+	opts.Overwrite = true
+	c.Assert(WriteDeployment(&testBlueprint, testDir, opts), IsNil)
+	rewritten, err := ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	rewritten.CreatedAt = manifest.CreatedAt
+	c.Check(rewritten, DeepEquals, manifest)
+
+	// Failure: no manifest
+	_, err = ReadManifest(testDir)
+	c.Check(err, ErrorMatches, "failed to read deployment manifest.*")
+}
+
+func (s *MySuite) TestDigestTree(c *C) {
+	modDir := filepath.Join(testDir, "TestDigestTree")
+	c.Assert(os.MkdirAll(filepath.Join(modDir, "sub"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(modDir, "main.tf"), []byte("a"), 0644), IsNil)
+	digest, err := digestTree(localFS{}, modDir)
+	c.Assert(err, IsNil)
+
+	// git metadata is ignored
+	c.Assert(os.MkdirAll(filepath.Join(modDir, ".git"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(modDir, ".git", "HEAD"), []byte("x"), 0644), IsNil)
+	got, err := digestTree(localFS{}, modDir)
+	c.Assert(err, IsNil)
+	c.Check(got, Equals, digest)
+
+	// contents of subdirectories are not
+	c.Assert(ioutil.WriteFile(filepath.Join(modDir, "sub", "x.tf"), []byte("b"), 0644), IsNil)
+	got, err = digestTree(localFS{}, modDir)
+	c.Assert(err, IsNil)
+	c.Check(got, Not(Equals), digest)
+
+	// Failure: missing directory
+	_, err = digestTree(localFS{}, filepath.Join(modDir, "missing"))
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestDigestGroupFiles(c *C) {
+	grpDir := filepath.Join(testDir, "TestDigestGroupFiles")
+	c.Assert(os.MkdirAll(filepath.Join(grpDir, ".terraform", "modules"), 0755), IsNil)
+	for _, f := range []string{
+		"main.tf", "terraform.tfstate", "terraform.tfstate.backup",
+		".terraform.lock.hcl", filepath.Join(".terraform", "modules", "modules.json"),
+	} {
+		c.Assert(ioutil.WriteFile(filepath.Join(grpDir, f), []byte(f), 0644), IsNil)
+	}
+	files, err := digestGroupFiles(grpDir, "terraform", nil)
+	c.Assert(err, IsNil)
+	c.Check(files, DeepEquals, map[string]string{"main.tf": digestBytes([]byte("main.tf"))})
+}
+
+func (s *MySuite) TestVerifyDeployment(c *C) {
+	testBlueprint := getBlueprintForTest()
+	testBlueprint.Vars = map[string]interface{}{
+		"deployment_name": "test_verify_deployment",
+		"project_id":      "test_project",
+	}
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{}), IsNil)
+	depDir := filepath.Join(testDir, "test_verify_deployment")
+	grpDir := filepath.Join(depDir, "test_resource_group")
+
+	drift, err := VerifyDeployment(depDir)
+	c.Assert(err, IsNil)
+	c.Check(drift, HasLen, 0)
+
+	// files created by terraform are not reported
+	c.Assert(ioutil.WriteFile(filepath.Join(grpDir, "terraform.tfstate"), []byte("{}"), 0644), IsNil)
+	drift, err = VerifyDeployment(depDir)
+	c.Assert(err, IsNil)
+	c.Check(drift, HasLen, 0)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(grpDir, "main.tf"), []byte("edited"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(grpDir, "extra.tf"), []byte(""), 0644), IsNil)
+	c.Assert(os.Remove(filepath.Join(grpDir, "outputs.tf")), IsNil)
+	drift, err = VerifyDeployment(depDir)
+	c.Assert(err, IsNil)
+	c.Check(drift, DeepEquals, []GroupDrift{{
+		Name:     "test_resource_group",
+		Modified: []string{"main.tf"},
+		Added:    []string{"extra.tf"},
+		Deleted:  []string{"outputs.tf"},
+	}})
+
+	// overwriting refuses to discard the changes
+	err = WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true})
+	var e *DriftError
+	c.Assert(errors.As(err, &e), Equals, true)
+	c.Check(e.Drift, DeepEquals, drift)
+	c.Check(err, ErrorMatches, "(?s).*modified: main.tf.*added:    extra.tf.*deleted:  outputs.tf.*")
+	// and so does a dry run
+	err = WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true, DryRun: true})
+	c.Assert(errors.As(err, &e), Equals, true)
+
+	// accepted changes are no longer reported
+	c.Assert(AcceptDrift(depDir), IsNil)
+	drift, err = VerifyDeployment(depDir)
+	c.Assert(err, IsNil)
+	c.Check(drift, HasLen, 0)
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true}), IsNil)
+
+	// unless forced
+	c.Assert(ioutil.WriteFile(filepath.Join(grpDir, "main.tf"), []byte("edited"), 0644), IsNil)
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true, Force: true}), IsNil)
+	drift, err = VerifyDeployment(depDir)
+	c.Assert(err, IsNil)
+	c.Check(drift, HasLen, 0)
+
+	// a deleted group reports all of its files
+	c.Assert(os.RemoveAll(grpDir), IsNil)
+	drift, err = VerifyDeployment(depDir)
+	c.Assert(err, IsNil)
+	c.Assert(drift, HasLen, 1)
+	c.Check(drift[0].Deleted, Not(HasLen), 0)
+}
+
+func (s *MySuite) TestDiffLines(c *C) {
+	// lcsLength is the length of the longest common subsequence of a and b
+	lcsLength := func(a, b []string) int {
+		prev := make([]int, len(b)+1)
+		for i := range a {
+			cur := make([]int, len(b)+1)
+			for j := range b {
+				switch {
+				case a[i] == b[j]:
+					cur[j+1] = prev[j] + 1
+				case prev[j+1] >= cur[j]:
+					cur[j+1] = prev[j+1]
+				default:
+					cur[j+1] = cur[j]
+				}
+			}
+			prev = cur
+		}
+		return prev[len(b)]
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rnd.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a' + rnd.Intn(4)))
+		}
+		return lines
+	}
+	for n := 0; n < 500; n++ {
+		a, b := randomLines(), randomLines()
+		ops := diffLines(a, b)
+		var gotA, gotB []string
+		changes := 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				c.Assert(op.from, Equals, len(gotA))
+				gotA = append(gotA, op.line)
+			}
+			if op.kind != '-' {
+				c.Assert(op.to, Equals, len(gotB))
+				gotB = append(gotB, op.line)
+			}
+			if op.kind != ' ' {
+				changes++
+			}
+		}
+		c.Assert(strings.Join(gotA, ""), Equals, strings.Join(a, ""))
+		c.Assert(strings.Join(gotB, ""), Equals, strings.Join(b, ""))
+		// the edit script is as short as possible
+		c.Assert(changes, Equals, len(a)+len(b)-2*lcsLength(a, b), Commentf("%v -> %v", a, b))
+	}
+}
+
+func (s *MySuite) TestUnifiedDiff(c *C) {
+	c.Check(unifiedDiff("a/f", "b/f", "x\n", "x\n"), Equals, "")
+
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	b := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n"
+	c.Check(unifiedDiff("a/f", "b/f", a, b), Equals, `--- a/f
++++ b/f
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -10,3 +10,4 @@
+ 10
+ 11
+ 12
++13
+`)
+
+	// new and deleted files
+	c.Check(unifiedDiff(os.DevNull, "b/f", "", "x\n"), Equals,
+		"--- /dev/null\n+++ b/f\n@@ -0,0 +1,1 @@\n+x\n")
+	c.Check(unifiedDiff("a/f", os.DevNull, "x\ny\n", ""), Equals,
+		"--- a/f\n+++ /dev/null\n@@ -1,2 +0,0 @@\n-x\n-y\n")
+}
+
+func (s *MySuite) TestWriteDeployment_DryRun(c *C) {
+	testBlueprint := getBlueprintForTest()
+	testBlueprint.Vars = map[string]interface{}{
+		"deployment_name": "test_dry_run",
+		"project_id":      "test_project",
+	}
+	depDir := filepath.Join(testDir, "test_dry_run")
+
+	// a dry run of a new deployment adds every file without writing any, or
+	// changing the blueprint
+	before := testBlueprint.Clone()
+	report, err := diffDeployment(&testBlueprint, depDir, FormatHCL)
+	c.Assert(err, IsNil)
+	c.Check(testBlueprint, DeepEquals, before)
+	c.Check(report, Matches, "(?s)Deployment group changes:\n  \\+ test_resource_group\n.*\\+\\+\\+ b/test_resource_group/main.tf.*")
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{DryRun: true}), IsNil)
+	_, err = os.Stat(depDir)
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{}), IsNil)
+	report, err = diffDeployment(&testBlueprint, depDir, FormatHCL)
+	c.Assert(err, IsNil)
+	c.Check(report, Equals, fmt.Sprintf("No changes to deployment %s.\n", depDir))
+
+	manifestPath := filepath.Join(depDir, hiddenGhpcDirName, manifestFileName)
+	manifest, err := ioutil.ReadFile(manifestPath)
+	c.Assert(err, IsNil)
+
+	testBlueprint.DeploymentGroups[0].Modules[0].Settings["zone"] = "us-central1-a"
+	testBlueprint.DeploymentGroups[0].Modules[1].ID = "renamedModule"
+	testBlueprint.DeploymentGroups = append(testBlueprint.DeploymentGroups, config.DeploymentGroup{
+		Name: "second_group", Kind: "terraform", Modules: []config.Module{},
+	})
+	report, err = diffDeployment(&testBlueprint, depDir, FormatHCL)
+	c.Assert(err, IsNil)
+	c.Check(report, Matches, "(?s)Deployment group changes:\n  \\+ second_group\n"+
+		"Module source changes:\n  \\+ test_resource_group/renamedModule: .*\n"+
+		"  - test_resource_group/testModuleWithLabels: .*"+
+		"--- a/test_resource_group/main.tf\n\\+\\+\\+ b/test_resource_group/main.tf\n.*"+
+		"\\+  zone *= \"us-central1-a\".*")
+
+	// the deployment is not touched
+	after, err := ioutil.ReadFile(manifestPath)
+	c.Assert(err, IsNil)
+	c.Check(after, DeepEquals, manifest)
+	_, err = os.Stat(filepath.Join(depDir, "second_group"))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// empty files are reported when they are deleted
+	c.Assert(ioutil.WriteFile(filepath.Join(depDir, "test_resource_group", "empty.tf"), nil, 0644), IsNil)
+	report, err = diffDeployment(&testBlueprint, depDir, FormatHCL)
+	c.Assert(err, IsNil)
+	c.Check(report, Matches, "(?s).*--- a/test_resource_group/empty.tf\n\\+\\+\\+ /dev/null\n.*")
+}
+
+func (s *MySuite) TestWriteDeployment_GroupRemoval(c *C) {
+	testBlueprint := getBlueprintForTest()
+	testBlueprint.Vars = map[string]interface{}{
+		"deployment_name": "test_group_removal",
+		"project_id":      "test_project",
+	}
+	testBlueprint.DeploymentGroups = append(testBlueprint.DeploymentGroups, config.DeploymentGroup{
+		Name:    "retired_group",
+		Kind:    "terraform",
+		Modules: testBlueprint.DeploymentGroups[0].Modules,
+	})
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{}), IsNil)
+	depDir := filepath.Join(testDir, "test_group_removal")
+	stateFile := filepath.Join(depDir, "retired_group", "terraform.tfstate")
+	c.Assert(ioutil.WriteFile(stateFile, []byte("{}"), 0644), IsNil)
+
+	// Failure: removing a group requires explicit permission
+	testBlueprint.DeploymentGroups = testBlueprint.DeploymentGroups[:1]
+	err := WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true})
+	var e *OverwriteDeniedError
+	c.Assert(errors.As(err, &e), Equals, true)
+	err = WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true, DryRun: true})
+	c.Assert(errors.As(err, &e), Equals, true)
+
+	// a dry run archives nothing
+	c.Assert(WriteDeployment(&testBlueprint, testDir,
+		WriteOptions{Overwrite: true, AllowGroupRemoval: true, DryRun: true}), IsNil)
+	_, err = os.Stat(stateFile)
+	c.Check(err, IsNil)
+
+	err = WriteDeployment(&testBlueprint, testDir,
+		WriteOptions{Overwrite: true, AllowGroupRemoval: true})
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(depDir, "retired_group"))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	archives, err := ioutil.ReadDir(filepath.Join(depDir, hiddenGhpcDirName, archivedGroupsDirName))
+	c.Assert(err, IsNil)
+	c.Assert(archives, HasLen, 1)
+	archived := filepath.Join(depDir, hiddenGhpcDirName, archivedGroupsDirName,
+		archives[0].Name(), "retired_group", "terraform.tfstate")
+	_, err = os.Stat(archived)
+	c.Check(err, IsNil)
+
+	// restore the most recent archive of the group
+	id, err := RestoreGroup(depDir, "retired_group", "")
+	c.Assert(err, IsNil)
+	c.Check(id, Equals, archives[0].Name())
+	_, err = os.Stat(stateFile)
+	c.Check(err, IsNil)
+
+	// the restored group is added back to the manifest, unchanged
+	manifest, err := ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	c.Assert(manifest.DeploymentGroups, HasLen, 2)
+	c.Check(manifest.DeploymentGroups[1].Name, Equals, "retired_group")
+	c.Check(manifest.DeploymentGroups[1].Kind, Equals, "terraform")
+	drift, err := VerifyDeployment(depDir)
+	c.Assert(err, IsNil)
+	c.Check(drift, HasLen, 0)
+
+	// archives made within the same second are kept apart
+	var undo rollback
+	first, err := archiveGroups(depDir, nil, &undo)
+	c.Assert(err, IsNil)
+	undo = nil
+	second, err := archiveGroups(depDir, nil, &undo)
+	c.Assert(err, IsNil)
+	c.Check(second, Not(Equals), first)
+	c.Assert(undo.run(), IsNil)
+	_, err = os.Stat(filepath.Join(depDir, hiddenGhpcDirName, archivedGroupsDirName, first))
+	c.Check(err, IsNil)
+
+	// Failure: the group is no longer archived, or already exists
+	_, err = RestoreGroup(depDir, "retired_group", "")
+	c.Check(err, ErrorMatches, "deployment group retired_group was not found in any archive.*")
+	_, err = RestoreGroup(depDir, "retired_group", id)
+	c.Check(err, ErrorMatches, "deployment group retired_group was not found in archive.*")
+}
+
+func (s *MySuite) TestWriteDeployment_Rollback(c *C) {
+	testBlueprint := getBlueprintForTest()
+	testBlueprint.Vars = map[string]interface{}{
+		"deployment_name": "test_rollback",
+		"project_id":      "test_project",
+	}
+	depDir := filepath.Join(testDir, "test_rollback")
+	grpDir := filepath.Join(depDir, "test_resource_group")
+
+	// Failure: a new deployment directory is removed
+	badBlueprint := getBlueprintForTest()
+	badBlueprint.Vars = testBlueprint.Vars
+	badBlueprint.DeploymentGroups[0].Kind = "invalid"
+	err := WriteDeployment(&badBlueprint, testDir, WriteOptions{})
+	c.Assert(err, ErrorMatches, "Invalid kind in deployment group.*")
+	_, err = os.Stat(depDir)
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{}), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(grpDir, "terraform.tfstate"), []byte("{}"), 0644), IsNil)
+	before, err := readDeploymentFiles(depDir, nil, nil)
+	c.Assert(err, IsNil)
+
+	// Failure: an existing deployment is untouched if rendering fails
+	err = WriteDeployment(&badBlueprint, testDir, WriteOptions{Overwrite: true})
+	c.Assert(err, ErrorMatches, "Invalid kind in deployment group.*")
+	after, err := readDeploymentFiles(depDir, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(after, DeepEquals, before)
+	_, err = os.Stat(filepath.Join(grpDir, "terraform.tfstate"))
+	c.Check(err, IsNil)
+	_, err = os.Stat(filepath.Join(depDir, hiddenGhpcDirName, stagingDirName))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// Failure: an existing deployment is restored if writing the manifest
+	// fails after the new groups were swapped in
+	manifestPath := filepath.Join(depDir, hiddenGhpcDirName, manifestFileName)
+	c.Assert(os.Remove(manifestPath), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(manifestPath, "blocker"), 0755), IsNil)
+	testBlueprint.DeploymentGroups[0].Modules[0].Settings["zone"] = "us-central1-a"
+	err = WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true, Force: true})
+	c.Assert(err, ErrorMatches, "error writing deployment manifest.*")
+	after, err = readDeploymentFiles(depDir, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(after, DeepEquals, before)
+	_, err = os.Stat(filepath.Join(grpDir, "terraform.tfstate"))
+	c.Check(err, IsNil)
+	_, err = os.Stat(filepath.Join(depDir, hiddenGhpcDirName, prevDeploymentGroupDirName))
+	c.Check(err, IsNil)
+}
+
+func (s *MySuite) TestWriteDeployment_Sensitive(c *C) {
+	testBlueprint := getBlueprintForTest()
+	testBlueprint.Vars = map[string]interface{}{
+		"deployment_name": "test_sensitive",
+		"project_id":      "test_project",
+		"admin_password":  "hunter2",
+	}
+	grp := &testBlueprint.DeploymentGroups[0]
+	grp.SensitiveVars = []string{"admin_password"}
+	grp.Modules[1].Settings["password"] = "s3cr3t"
+	grp.Modules[1].SensitiveSettings = []string{"password"}
+	grp.TerraformBackend = config.TerraformBackend{
+		Type: "gcs", Configuration: map[string]interface{}{"bucket": "b", "encryption_key": "k3y"}}
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{}), IsNil)
+	depDir := filepath.Join(testDir, "test_sensitive")
+
+	// the deployment needs the values, its records do not
+	exists, err := stringExistsInFile("hunter2", filepath.Join(depDir, grp.Name, "terraform.tfvars"))
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, true)
+	manifest, err := ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	c.Check(manifest.Vars["admin_password"], Equals, "(sensitive)")
+	c.Check(manifest.DeploymentGroups[0].TerraformBackend.Configuration, DeepEquals,
+		map[string]interface{}{"bucket": "b", "encryption_key": "(sensitive)"})
+	exists, err = stringExistsInFile("k3y", filepath.Join(depDir, hiddenGhpcDirName, manifestFileName))
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, false)
+	entries, err := ListHistory(depDir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	bpYAML, err := ioutil.ReadFile(filepath.Join(
+		depDir, hiddenGhpcDirName, historyDirName, entries[0].ID, historyBlueprintFileName))
+	c.Assert(err, IsNil)
+	c.Check(string(bpYAML), Not(Matches), "(?s).*(hunter2|s3cr3t|k3y).*")
+	c.Check(testBlueprint.Vars["admin_password"], Equals, "hunter2")
+	c.Check(grp.TerraformBackend.Configuration["encryption_key"], Equals, "k3y")
+}
+
+func (s *MySuite) TestDeploymentHistory(c *C) {
+	testBlueprint := getBlueprintForTest()
+	testBlueprint.Vars = map[string]interface{}{
+		"deployment_name": "test_history",
+		"project_id":      "test_project",
+	}
+	depDir := filepath.Join(testDir, "test_history")
+	grpDir := filepath.Join(depDir, "test_resource_group")
+	opts := WriteOptions{Overwrite: true, HistoryLimit: 2}
+
+	c.Assert(WriteDeployment(&testBlueprint, testDir, opts), IsNil)
+	first, err := ioutil.ReadFile(filepath.Join(grpDir, "main.tf"))
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(grpDir, "terraform.tfstate"), []byte("first"), 0644), IsNil)
+
+	entries, err := ListHistory(depDir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	snapshotDir := filepath.Join(depDir, hiddenGhpcDirName, historyDirName, entries[0].ID)
+	_, err = os.Stat(filepath.Join(snapshotDir, historyBlueprintFileName))
+	c.Check(err, IsNil)
+	_, err = os.Stat(filepath.Join(snapshotDir, "test_resource_group", "main.tf"))
+	c.Check(err, IsNil)
+	// state is not part of the history
+	_, err = os.Stat(filepath.Join(snapshotDir, "test_resource_group", "terraform.tfstate"))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	testBlueprint.DeploymentGroups[0].Modules[0].Settings["zone"] = "us-central1-a"
+	c.Assert(WriteDeployment(&testBlueprint, testDir, opts), IsNil)
+	testBlueprint.DeploymentGroups[0].Modules[0].Settings["zone"] = "us-central1-b"
+	c.Assert(WriteDeployment(&testBlueprint, testDir, opts), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(grpDir, "terraform.tfstate"), []byte("third"), 0644), IsNil)
+
+	// only the last generations are kept
+	entries, err = ListHistory(depDir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+
+	// Failure: the first generation was removed
+	snapshotID := filepath.Base(snapshotDir)
+	err = RollbackDeployment(depDir, snapshotID, opts)
+	c.Check(err, ErrorMatches, "deployment history .* not found.*")
+
+	c.Assert(RollbackDeployment(depDir, entries[0].ID, opts), IsNil)
+	main, err := ioutil.ReadFile(filepath.Join(grpDir, "main.tf"))
+	c.Assert(err, IsNil)
+	c.Check(string(main), Not(Equals), string(first))
+	c.Check(string(main), Matches, `(?s).*zone *= "us-central1-a".*`)
+	state, err := ioutil.ReadFile(filepath.Join(grpDir, "terraform.tfstate"))
+	c.Assert(err, IsNil)
+	c.Check(string(state), Equals, "third")
+
+	// the rollback is recorded as a new generation and the deployment
+	// matches its manifest
+	rolledBack, err := ListHistory(depDir)
+	c.Assert(err, IsNil)
+	c.Assert(rolledBack, HasLen, 2)
+	c.Check(rolledBack[0].ID, Equals, entries[1].ID)
+	drift, err := VerifyDeployment(depDir)
+	c.Assert(err, IsNil)
+	c.Check(drift, HasLen, 0)
+	// the restored generation is newer than the state applied before
+	manifest, err := ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	c.Check(manifest.CreatedAt.After(entries[1].Manifest.CreatedAt), Equals, true)
+
+	// Failure: removing groups requires explicit permission
+	testBlueprint.DeploymentGroups = append(testBlueprint.DeploymentGroups, config.DeploymentGroup{
+		Name: "second_group", Kind: "terraform", Modules: []config.Module{},
+	})
+	c.Assert(WriteDeployment(&testBlueprint, testDir, opts), IsNil)
+	err = RollbackDeployment(depDir, rolledBack[1].ID, opts)
+	c.Check(err, ErrorMatches, ".*removes deployment groups second_group.*--allow-group-removal.*")
+	opts.AllowGroupRemoval = true
+	c.Assert(RollbackDeployment(depDir, rolledBack[1].ID, opts), IsNil)
+	_, err = os.Stat(filepath.Join(depDir, "second_group"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *MySuite) TestPreserveList(c *C) {
+	preserved := preserveList(defaultPreservePatterns)
+	c.Check(preserved.matches(".terraform.lock.hcl"), Equals, true)
+	c.Check(preserved.matches("override.tf"), Equals, true)
+	c.Check(preserved.matches("network_override.tf"), Equals, true)
+	c.Check(preserved.matches("extra.auto.tfvars"), Equals, true)
+	c.Check(preserved.matches(filepath.Join("modules", "vpc", "override.tf")), Equals, true)
+	c.Check(preserved.matches("main.tf"), Equals, false)
+	c.Check(preserved.matches("terraform.tfvars"), Equals, false)
+
+	// patterns with a slash match the path relative to the group
+	preserved = preserveList{"scripts/*.sh"}
+	c.Check(preserved.matches(filepath.Join("scripts", "a.sh")), Equals, true)
+	c.Check(preserved.matches("a.sh"), Equals, false)
+
+	depDir := filepath.Join(testDir, "TestPreserveList")
+	c.Assert(os.MkdirAll(depDir, 0755), IsNil)
+	preserved, err := loadPreserveList(depDir, []string{"*.yaml"})
+	c.Assert(err, IsNil)
+	c.Check(preserved.matches("data.yaml"), Equals, true)
+	c.Check(preserved.matches("extra.txt"), Equals, false)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(depDir, preserveFileName),
+		[]byte("# user files\n\nextra.txt\n"), 0644), IsNil)
+	preserved, err = loadPreserveList(depDir, nil)
+	c.Assert(err, IsNil)
+	c.Check(preserved.matches("extra.txt"), Equals, true)
+
+	// Failure: malformed pattern
+	c.Assert(ioutil.WriteFile(filepath.Join(depDir, preserveFileName), []byte("[a-\n"), 0644), IsNil)
+	_, err = loadPreserveList(depDir, nil)
+	c.Check(err, ErrorMatches, "invalid pattern .* of files to preserve.*")
+
+	// Failure: patterns matching files generated by ghpc
+	for _, pattern := range []string{"", "*.tf", "main.tf", "*.json", "modules/*/main.tf", "*/vpc/*"} {
+		_, err = loadPreserveList(filepath.Join(depDir, "missing"), []string{pattern})
+		c.Check(err, ErrorMatches, "invalid pattern .* of files to preserve.*", Commentf("pattern %q", pattern))
+	}
+}
+
+func (s *MySuite) TestWriteDeployment_PreserveFiles(c *C) {
+	testBlueprint := getBlueprintForTest()
+	testBlueprint.Vars = map[string]interface{}{
+		"deployment_name": "test_preserve_files",
+		"project_id":      "test_project",
+	}
+	testBlueprint.PreserveFiles = []string{"*.txt"}
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{}), IsNil)
+	depDir := filepath.Join(testDir, "test_preserve_files")
+	grpDir := filepath.Join(depDir, "test_resource_group")
+
+	userFiles := []string{
+		".terraform.lock.hcl", "override.tf", "extra.auto.tfvars", "notes.txt", "image.pkrvars.hcl",
+	}
+	for _, f := range userFiles {
+		c.Assert(ioutil.WriteFile(filepath.Join(grpDir, f), []byte(f), 0644), IsNil)
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(depDir, preserveFileName), []byte("*.pkrvars.hcl\n"), 0644), IsNil)
+
+	// preserved files are not reported as changes
+	drift, err := VerifyDeployment(depDir)
+	c.Assert(err, IsNil)
+	c.Check(drift, HasLen, 0)
+
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true}), IsNil)
+	for _, f := range userFiles {
+		b, err := ioutil.ReadFile(filepath.Join(grpDir, f))
+		c.Check(err, IsNil)
+		c.Check(string(b), Equals, f)
+	}
+	manifest, err := ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	c.Check(manifest.PreserveFiles, DeepEquals, []string{"*.txt"})
+	_, ok := manifest.DeploymentGroups[0].Files["override.tf"]
+	c.Check(ok, Equals, false)
+
+	// regenerated files are not replaced by preserved ones
+	modDir := filepath.Join(testDir, "preserveModule")
+	c.Assert(os.MkdirAll(modDir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(modDir, "README.md"), []byte("source"), 0644), IsNil)
+	testBlueprint.DeploymentGroups[0].Modules[0].Source = modDir
+	testBlueprint.PreserveFiles = []string{"README.md"}
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true}), IsNil)
+	readme := filepath.Join(grpDir, "modules", "preserveModule", "README.md")
+	c.Assert(ioutil.WriteFile(readme, []byte("edited"), 0644), IsNil)
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true}), IsNil)
+	b, err := ioutil.ReadFile(readme)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, "source")
+}
+
+func (s *MySuite) TestImportPackerImages(c *C) {
+	testBlueprint := getBlueprintForTest()
+	testBlueprint.Vars = map[string]interface{}{
+		"deployment_name": "test_import_packer_images",
+		"project_id":      "test_project",
+	}
+	testBlueprint.DeploymentGroups[0].PackerImages = []config.PackerImage{
+		{Group: "packer", ModuleID: "image"},
+	}
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{}), IsNil)
+	depDir := filepath.Join(testDir, "test_import_packer_images")
+	grpName := testBlueprint.DeploymentGroups[0].Name
+
+	variables, err := ioutil.ReadFile(filepath.Join(depDir, grpName, packerImagesFileName+".tf"))
+	c.Assert(err, IsNil)
+	c.Check(string(variables), Matches, `(?s).*variable "image_name_image" \{.*type\s+= string.*`)
+
+	// Failure: image not built yet
+	_, err = ImportPackerImages(depDir, grpName)
+	c.Check(err, ErrorMatches, "the image of Packer module image in deployment group packer has not been built.*")
+
+	// Failure: unknown group
+	_, err = ImportPackerImages(depDir, "not_a_group")
+	c.Check(err, ErrorMatches, "deployment group not_a_group was not found.*")
+
+	imageDir := filepath.Join(depDir, "packer", "image")
+	c.Assert(os.MkdirAll(imageDir, 0755), IsNil)
+	packerManifest := `{
+  "builds": [
+    {"artifact_id": "old-image", "packer_run_uuid": "run-1"},
+    {"artifact_id": "new-image", "packer_run_uuid": "run-2"}
+  ],
+  "last_run_uuid": "run-2"
+}`
+	c.Assert(ioutil.WriteFile(
+		filepath.Join(imageDir, PackerManifestFileName), []byte(packerManifest), 0644), IsNil)
+
+	images, err := ImportPackerImages(depDir, grpName)
+	c.Assert(err, IsNil)
+	c.Check(images, DeepEquals, map[string]string{"image_name_image": "new-image"})
+	tfvars, err := ioutil.ReadFile(
+		filepath.Join(depDir, grpName, packerImagesFileName+".auto.tfvars.json"))
+	c.Assert(err, IsNil)
+	c.Check(string(tfvars), Equals, "{\n  \"image_name_image\": \"new-image\"\n}\n")
+
+	// imported images are not reported as changes
+	drift, err := VerifyDeployment(depDir)
+	c.Assert(err, IsNil)
+	c.Check(drift, HasLen, 0)
+}
+
+func (s *MySuite) TestWriteRemoteStates(c *C) {
+	sharedBlueprint := getBlueprintForTest()
+	sharedBlueprint.Vars = map[string]interface{}{
+		"deployment_name": "test_shared_deployment",
+		"project_id":      "test_project",
+	}
+	sharedBlueprint.DeploymentGroups = append(sharedBlueprint.DeploymentGroups, config.DeploymentGroup{
+		Name: "remote", Kind: "terraform", Modules: sharedBlueprint.DeploymentGroups[0].Modules,
+		TerraformBackend: config.TerraformBackend{
+			Type: "gcs", Configuration: map[string]interface{}{"bucket": "b", "prefix": "p", "credentials": "k3y"}},
+	})
+	c.Assert(WriteDeployment(&sharedBlueprint, testDir, WriteOptions{}), IsNil)
+	sharedDir := filepath.Join(testDir, "test_shared_deployment")
+	localGrp := sharedBlueprint.DeploymentGroups[0].Name
+
+	externals := []config.ExternalOutputs{
+		{Deployment: "shared", Group: localGrp, DeploymentDir: sharedDir},
+		{Deployment: "shared", Group: "remote", DeploymentDir: sharedDir},
+	}
+	dst := filepath.Join(testDir, "test_write_remote_states")
+	c.Assert(os.MkdirAll(dst, 0755), IsNil)
+	c.Assert(writeRemoteStates(externals, dst), IsNil)
+	remoteState, err := ioutil.ReadFile(filepath.Join(dst, remoteStateFileName+".tf"))
+	c.Assert(err, IsNil)
+	// local state is read from the group directory
+	c.Check(string(remoteState), Matches, fmt.Sprintf(
+		`(?s).*data "terraform_remote_state" "shared_%s" {\n  backend = "local"\n  config = {\n    path = "%s"\n.*`,
+		localGrp, filepath.Join(sharedDir, localGrp, tfStateFileName)))
+	c.Check(string(remoteState), Matches,
+		`(?s).*data "terraform_remote_state" "shared_remote" {\n  backend = "gcs"\n  config = {\n    bucket = "b"\n    prefix = "p"\n.*`)
+	// credentials are not recorded in the manifest and are read from the environment
+	c.Check(string(remoteState), Not(Matches), `(?s).*credentials.*`)
+
+	c.Assert(writeRemoteStatesJSON(externals[1:], dst), IsNil)
+	body, err := readJSONFile(filepath.Join(dst, remoteStateFileName+".tf.json"))
+	c.Assert(err, IsNil)
+	c.Check(body["data"], DeepEquals, map[string]interface{}{
+		"terraform_remote_state": map[string]interface{}{
+			"shared_remote": map[string]interface{}{
+				"backend": "gcs",
+				"config":  map[string]interface{}{"bucket": "b", "prefix": "p"},
+			},
+		},
+	})
+
+	// Failure: unknown group
+	err = writeRemoteStates([]config.ExternalOutputs{
+		{Deployment: "shared", Group: "storage", DeploymentDir: sharedDir}}, dst)
+	c.Check(err, ErrorMatches, "deployment group storage was not found in deployment shared.*")
+}
+
+func (s *MySuite) TestSuggestRenames(c *C) {
+	testBlueprint := getBlueprintForTest()
+	testBlueprint.Vars = map[string]interface{}{
+		"deployment_name": "test_suggest_renames",
+		"project_id":      "test_project",
+	}
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{}), IsNil)
+	depDir := filepath.Join(testDir, "test_suggest_renames")
+	c.Check(suggestRenames(&testBlueprint, depDir), HasLen, 0)
+
+	grp := &testBlueprint.DeploymentGroups[0]
+	oldID := grp.Modules[0].ID
+	grp.Modules[0].ID = "renamedModule"
+	c.Check(suggestRenames(&testBlueprint, depDir), DeepEquals, []string{
+		fmt.Sprintf("module renamedModule of group %s may have been renamed from %s", grp.Name, oldID),
+	})
+
+	// no suggestion once the rename is declared
+	grp.Modules[0].RenamedFrom = oldID
+	c.Check(suggestRenames(&testBlueprint, depDir), HasLen, 0)
+}
+
+func (s *MySuite) TestBackendMigrations(c *C) {
+	testBlueprint := getBlueprintForTest()
+	testBlueprint.Vars = map[string]interface{}{
+		"deployment_name": "test_backend_migrations",
+		"project_id":      "test_project",
+	}
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{}), IsNil)
+	depDir := filepath.Join(testDir, "test_backend_migrations")
+	grpName := testBlueprint.DeploymentGroups[0].Name
+	grpDir := filepath.Join(depDir, grpName)
+	c.Check(HasPendingMigration(grpDir), Equals, false)
+
+	// Terraform records the backend the group was initialized with
+	c.Assert(os.MkdirAll(filepath.Join(grpDir, ".terraform"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(grpDir, tfBackendStateFile), []byte("local"), 0644), IsNil)
+
+	// switching from local state to gcs
+	testBlueprint.DeploymentGroups[0].TerraformBackend = config.TerraformBackend{
+		Type:          "gcs",
+		Configuration: map[string]interface{}{"bucket": "test-bucket", "prefix": "a"},
+	}
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true}), IsNil)
+	c.Check(HasPendingMigration(grpDir), Equals, true)
+	note, err := ioutil.ReadFile(filepath.Join(grpDir, BackendMigrationFileName))
+	c.Assert(err, IsNil)
+	c.Check(string(note), Matches, "(?s).*changed from\n\n  local\n\nto\n\n  gcs \\(bucket=test-bucket, prefix=a\\).*")
+	b, err := ioutil.ReadFile(filepath.Join(grpDir, tfBackendStateFile))
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, "local")
+
+	// the note is not reported as a change and is kept while pending
+	drift, err := VerifyDeployment(depDir)
+	c.Assert(err, IsNil)
+	c.Check(drift, HasLen, 0)
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true}), IsNil)
+	c.Check(HasPendingMigration(grpDir), Equals, true)
+
+	// the same backend read back from the manifest is unchanged
+	manifest, err := ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	c.Check(backendMigrations(manifest, manifest), HasLen, 0)
+
+	// changing the prefix
+	os.Remove(filepath.Join(grpDir, BackendMigrationFileName))
+	testBlueprint.DeploymentGroups[0].TerraformBackend.Configuration["prefix"] = "b"
+	c.Assert(WriteDeployment(&testBlueprint, testDir, WriteOptions{Overwrite: true}), IsNil)
+	next, err := ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	c.Check(backendMigrations(manifest, next), DeepEquals, []BackendMigration{{
+		Group: grpName, From: manifest.DeploymentGroups[0].TerraformBackend,
+		To: next.DeploymentGroups[0].TerraformBackend,
+	}})
+	c.Check(HasPendingMigration(grpDir), Equals, true)
+
+	// credentials recorded by earlier versions are neither compared nor shown
+	withCredentials := func(credentials string) Manifest {
+		m := next
+		m.DeploymentGroups = []GroupManifest{next.DeploymentGroups[0]}
+		m.DeploymentGroups[0].TerraformBackend = &BackendManifest{Type: "gcs", Configuration: map[string]interface{}{
+			"bucket": "test-bucket", "prefix": "b", "credentials": credentials}}
+		return m
+	}
+	c.Check(backendMigrations(withCredentials("k3y"), withCredentials("(sensitive)")), HasLen, 0)
+	c.Check(describeBackend(withCredentials("k3y").DeploymentGroups[0].TerraformBackend), Equals,
+		"gcs (bucket=test-bucket, credentials=(sensitive), prefix=b)")
+}
+
+// golden files
+func writeGoldenDeployment(format string, outputDir string) (string, error) {
+	bpFile := filepath.Join(testDir, "golden.yaml")
+	source := filepath.Join(testDir, terraformModuleDir)
+	bp := fmt.Sprintf(goldenBlueprint, source)
+	if err := ioutil.WriteFile(bpFile, []byte(bp), 0644); err != nil {
+		return "", err
+	}
+	dc, err := config.NewDeploymentConfig(bpFile)
+	if err != nil {
+		return "", err
+	}
+	dc.Config.DeploymentGroups[0].Kind = "terraform"
+	if err := WriteDeployment(&dc.Config, outputDir, WriteOptions{Format: format}); err != nil {
+		return "", err
+	}
+	return filepath.Join(outputDir, "golden", "primary"), nil
+}
+
+func (s *MySuite) TestWriteDeployment_Golden(c *C) {
+	for _, format := range []string{FormatHCL, FormatTFJSON} {
+		firstDir := filepath.Join(testDir, "TestWriteDeployment_Golden", format, "first")
+		secondDir := filepath.Join(testDir, "TestWriteDeployment_Golden", format, "second")
+		c.Assert(os.MkdirAll(firstDir, 0755), IsNil)
+		c.Assert(os.MkdirAll(secondDir, 0755), IsNil)
+
+		firstGroup, err := writeGoldenDeployment(format, firstDir)
+		c.Assert(err, IsNil)
+		secondGroup, err := writeGoldenDeployment(format, secondDir)
+		c.Assert(err, IsNil)
+
+		files, err := ioutil.ReadDir(firstGroup)
+		c.Assert(err, IsNil)
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			got, err := ioutil.ReadFile(filepath.Join(firstGroup, f.Name()))
+			c.Assert(err, IsNil)
+
+			// writing the same blueprint again is byte-for-byte identical
+			again, err := ioutil.ReadFile(filepath.Join(secondGroup, f.Name()))
+			c.Assert(err, IsNil)
+			c.Check(string(again), Equals, string(got), Commentf("%s/%s", format, f.Name()))
+
+			goldenFile := filepath.Join("testdata", "golden", format, f.Name())
+			if *updateGolden {
+				c.Assert(os.MkdirAll(filepath.Dir(goldenFile), 0755), IsNil)
+				c.Assert(ioutil.WriteFile(goldenFile, got, 0644), IsNil)
+			}
+			want, err := ioutil.ReadFile(goldenFile)
+			c.Assert(err, IsNil)
+			c.Check(string(got), Equals, string(want), Commentf("%s/%s", format, f.Name()))
+		}
+	}
+}
+
 // packerwriter.go
 func (s *MySuite) TestNumModules_PackerWriter(c *C) {
 	testWriter := PackerWriter{}
@@ -720,6 +1925,43 @@ func (s *MySuite) TestWritePackerAutoVars(c *C) {
 
 }
 
+func (s *MySuite) TestRestorePackerState(c *C) {
+	depDir := filepath.Join(testDir, "test_restore_packer_state")
+	prevModDir := filepath.Join(
+		depDir, hiddenGhpcDirName, prevDeploymentGroupDirName, "packer", "image")
+	curModDir := filepath.Join(depDir, "packer", "image")
+	os.MkdirAll(prevModDir, 0755)
+	os.MkdirAll(curModDir, 0755)
+	for _, f := range []string{
+		"packer-manifest.json", "user.pkrvars.hcl", "build.log",
+		packerAutoVarFilename, "image.pkr.hcl"} {
+		ioutil.WriteFile(filepath.Join(prevModDir, f), []byte("previous"), 0644)
+	}
+	ioutil.WriteFile(filepath.Join(curModDir, packerAutoVarFilename), []byte("current"), 0644)
+	ioutil.WriteFile(filepath.Join(curModDir, "image.pkr.hcl"), []byte("current"), 0644)
+
+	testWriter := PackerWriter{}
+	c.Assert(testWriter.restoreState(depDir), IsNil)
+
+	for _, f := range []string{"packer-manifest.json", "user.pkrvars.hcl", "build.log"} {
+		b, err := ioutil.ReadFile(filepath.Join(curModDir, f))
+		c.Assert(err, IsNil)
+		c.Check(string(b), Equals, "previous")
+	}
+	// files written by ghpc are not overwritten
+	for _, f := range []string{packerAutoVarFilename, "image.pkr.hcl"} {
+		b, err := ioutil.ReadFile(filepath.Join(curModDir, f))
+		c.Assert(err, IsNil)
+		c.Check(string(b), Equals, "current")
+	}
+	c.Check(isUntracked("image/user.pkrvars.hcl", false, "packer"), Equals, true)
+	c.Check(isUntracked("image/"+packerAutoVarFilename, false, "packer"), Equals, false)
+	// Packer artifacts are only untracked in Packer groups
+	c.Check(isUntracked("modules/script/setup.log", false, "terraform"), Equals, false)
+	c.Check(isUntracked(PackerManifestFileName, false, "terraform"), Equals, false)
+	c.Check(isUntracked("terraform.tfstate", false, "packer"), Equals, false)
+}
+
 // hcl_utils.go
 func (s *MySuite) TestescapeLiteralVariables(c *C) {
 	// Setup
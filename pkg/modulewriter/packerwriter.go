@@ -18,6 +18,8 @@ package modulewriter
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 
 	"hpc-toolkit/pkg/config"
@@ -27,6 +29,22 @@ import (
 
 const packerAutoVarFilename = "defaults.auto.pkrvars.hcl"
 
+// Files created by building a Packer module, or added to it by users, that are
+// carried into the regenerated module when a deployment is overwritten
+var packerArtifactPatterns = []string{PackerManifestFileName, "*.pkrvars.hcl", "*.log"}
+
+func isPackerArtifact(name string) bool {
+	if name == packerAutoVarFilename {
+		return false
+	}
+	for _, pattern := range packerArtifactPatterns {
+		if match, _ := filepath.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
 // PackerWriter writes packer to the blueprint folder
 type PackerWriter struct {
 	numModules int
@@ -85,12 +103,53 @@ func (w PackerWriter) writeDeploymentGroup(
 		if err != nil {
 			return err
 		}
-		printPackerInstructions(modPath, mod.ID)
 	}
 	return nil
 }
 
+// restoreState copies the Packer manifest, user provided variable files and
+// build logs of each Packer module of the previous deployment groups into the
+// regenerated module of the same name
 func (w PackerWriter) restoreState(deploymentDir string) error {
-	// TODO: implement state restoration for Packer
+	prevDeploymentGroupPath := filepath.Join(
+		deploymentDir, hiddenGhpcDirName, prevDeploymentGroupDirName)
+	groups, err := ioutil.ReadDir(prevDeploymentGroupPath)
+	if err != nil {
+		return fmt.Errorf(
+			"Error trying to read previous modules in %s, %w",
+			prevDeploymentGroupPath, err)
+	}
+
+	for _, grp := range groups {
+		if !grp.IsDir() {
+			continue
+		}
+		mods, err := ioutil.ReadDir(filepath.Join(prevDeploymentGroupPath, grp.Name()))
+		if err != nil {
+			return fmt.Errorf(
+				"Error trying to read previous deployment group %s, %w", grp.Name(), err)
+		}
+		for _, mod := range mods {
+			srcDir := filepath.Join(prevDeploymentGroupPath, grp.Name(), mod.Name())
+			destDir := filepath.Join(deploymentDir, grp.Name(), mod.Name())
+			// only modules that are still written as Packer modules are restored
+			if _, err := os.Stat(filepath.Join(destDir, packerAutoVarFilename)); !mod.IsDir() || err != nil {
+				continue
+			}
+			files, err := ioutil.ReadDir(srcDir)
+			if err != nil {
+				return fmt.Errorf("Error trying to read previous module %s, %w", srcDir, err)
+			}
+			for _, f := range files {
+				if f.IsDir() || !isPackerArtifact(f.Name()) {
+					continue
+				}
+				dest := filepath.Join(destDir, f.Name())
+				if err := restoreFile(filepath.Join(srcDir, f.Name()), dest, f.Mode().Perm()); err != nil {
+					return fmt.Errorf("Failed to write previous Packer file %s, %w", dest, err)
+				}
+			}
+		}
+	}
 	return nil
 }
@@ -0,0 +1,185 @@
+/**
+* Copyright 2022 Google LLC
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package modulewriter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// preserveFileName lists additional patterns of files to preserve, one per
+// line, at the top of the deployment directory
+const preserveFileName = ".ghpcpreserve"
+
+// Files that users commonly add to deployment groups and that are carried
+// into regenerated groups when a deployment is overwritten
+var defaultPreservePatterns = []string{
+	".terraform.lock.hcl",
+	"override.tf", "*_override.tf",
+	"override.tf.json", "*_override.tf.json",
+	"*.auto.tfvars", "*.auto.tfvars.json",
+}
+
+// Files that ghpc writes into Terraform deployment groups. Patterns that
+// match them are rejected, other regenerated files, such as the sources of
+// Packer modules, are never replaced by preserved files.
+var generatedFiles = []string{
+	"main.tf", "variables.tf", "outputs.tf", "providers.tf", "versions.tf",
+	"terraform.tfvars", remoteStateFileName + ".tf", packerImagesFileName + ".tf",
+	"main.tf.json", "variables.tf.json", "outputs.tf.json", "providers.tf.json",
+	"versions.tf.json", "terraform.tfvars.json", remoteStateFileName + ".tf.json",
+	packerImagesFileName + ".tf.json",
+}
+
+// preserveList matches files added to deployment groups by users. Patterns
+// without a slash match the base name of a file anywhere in the group,
+// others match its slash separated path relative to the group directory.
+type preserveList []string
+
+func (p preserveList) matches(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	for _, pattern := range p {
+		name := relPath
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(relPath)
+		}
+		if match, _ := path.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
+// loadPreserveList combines the default patterns with those of the blueprint
+// and of the .ghpcpreserve file of the deployment directory, if it exists
+func loadPreserveList(deploymentDir string, blueprintPatterns []string) (preserveList, error) {
+	patterns := append([]string{}, defaultPreservePatterns...)
+	patterns = append(patterns, blueprintPatterns...)
+
+	f, err := os.Open(filepath.Join(deploymentDir, preserveFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return patterns, validatePatterns(patterns)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", preserveFileName, err)
+	}
+	return patterns, validatePatterns(patterns)
+}
+
+// validatePatterns checks the syntax of the patterns of files to preserve and
+// that they do not match files generated by ghpc, including the module
+// sources copied into the modules directory of Terraform groups
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return fmt.Errorf("invalid pattern %q of files to preserve: empty pattern", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q of files to preserve: %w", pattern, err)
+		}
+		for _, name := range generatedFiles {
+			if (preserveList{pattern}).matches(name) {
+				return fmt.Errorf("invalid pattern %q of files to preserve: it matches %s, which is generated by ghpc", pattern, name)
+			}
+		}
+		if dir, _, found := strings.Cut(pattern, "/"); found {
+			if match, _ := path.Match(dir, "modules"); match {
+				return fmt.Errorf("invalid pattern %q of files to preserve: it matches module sources copied by ghpc", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// restorePreservedFiles copies the preserved files of the previous deployment
+// groups into the regenerated groups of the same name
+func restorePreservedFiles(deploymentDir string, preserved preserveList) error {
+	prevGroupDir := filepath.Join(deploymentDir, hiddenGhpcDirName, prevDeploymentGroupDirName)
+	groups, err := ioutil.ReadDir(prevGroupDir)
+	if err != nil {
+		return fmt.Errorf("Error trying to read previous modules in %s, %w", prevGroupDir, err)
+	}
+
+	for _, grp := range groups {
+		dest := filepath.Join(deploymentDir, grp.Name())
+		if _, err := os.Stat(dest); !grp.IsDir() || err != nil {
+			continue
+		}
+		src := filepath.Join(prevGroupDir, grp.Name())
+		err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, p)
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if rel != "." && isUntracked(rel, true, "") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !preserved.matches(rel) {
+				return nil
+			}
+			target := filepath.Join(dest, rel)
+			if _, err := os.Stat(target); err == nil {
+				// e.g. the source files of Packer modules are regenerated
+				log.Printf("not restoring %s in deployment group %s, ghpc generated a new version of it",
+					filepath.ToSlash(rel), grp.Name())
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			b, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(target, b, info.Mode().Perm())
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to restore preserved files of deployment group %s: %w", grp.Name(), err)
+		}
+	}
+	return nil
+}
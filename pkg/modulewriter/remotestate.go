@@ -0,0 +1,54 @@
+/**
+* Copyright 2022 Google LLC
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package modulewriter
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"hpc-toolkit/pkg/config"
+)
+
+// remoteStateFileName is the base name of the files that declare the
+// terraform_remote_state data sources reading the outputs of other deployments
+const remoteStateFileName = "remote_state"
+
+// remoteStateBackend returns the Terraform backend of a deployment group of
+// another deployment, as recorded in its manifest. Manifests do not record
+// credentials, which Terraform reads from the environment instead.
+func remoteStateBackend(ext config.ExternalOutputs) (string, map[string]interface{}, error) {
+	manifest, err := ReadManifest(ext.DeploymentDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read the manifest of deployment %s: %w", ext.Deployment, err)
+	}
+	for _, grp := range manifest.DeploymentGroups {
+		if grp.Name != ext.Group {
+			continue
+		}
+		if grp.TerraformBackend == nil {
+			return "local", map[string]interface{}{
+				"path": filepath.Join(ext.DeploymentDir, ext.Group, tfStateFileName),
+			}, nil
+		}
+		backend := config.TerraformBackend{
+			Type: grp.TerraformBackend.Type, Configuration: grp.TerraformBackend.Configuration,
+		}.WithoutCredentials()
+		return backend.Type, backend.Configuration, nil
+	}
+	return "", nil, fmt.Errorf("deployment group %s was not found in deployment %s at %s",
+		ext.Group, ext.Deployment, ext.DeploymentDir)
+}
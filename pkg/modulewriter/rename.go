@@ -0,0 +1,90 @@
+/**
+* Copyright 2022 Google LLC
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package modulewriter
+
+import (
+	"fmt"
+
+	"hpc-toolkit/pkg/config"
+)
+
+// suggestRenames compares the blueprint against the manifest of an existing
+// deployment and lists the modules that were probably renamed without
+// renamed_from: a module removed from a Terraform group while a module with
+// the same source was added to it
+func suggestRenames(blueprint *config.Blueprint, deploymentDir string) []string {
+	manifest, err := ReadManifest(deploymentDir)
+	if err != nil {
+		return nil
+	}
+	previous := make(map[string]GroupManifest)
+	for _, grp := range manifest.DeploymentGroups {
+		previous[grp.Name] = grp
+	}
+
+	suggestions := []string{}
+	for _, grp := range blueprint.DeploymentGroups {
+		prev, ok := previous[grp.Name]
+		if !ok || grp.Kind != "terraform" {
+			continue
+		}
+		current := make(map[string]bool)
+		for _, mod := range grp.Modules {
+			current[mod.ID] = true
+			current[mod.RenamedFrom] = true
+		}
+		removed := make(map[string]string)
+		for _, mod := range prev.Modules {
+			if !current[mod.ID] {
+				removed[mod.Source] = mod.ID
+			}
+		}
+		for _, mod := range grp.Modules {
+			if mod.RenamedFrom != "" || hasModule(prev, mod.ID) {
+				continue
+			}
+			if oldID, ok := removed[mod.Source]; ok {
+				suggestions = append(suggestions, fmt.Sprintf(
+					"module %s of group %s may have been renamed from %s", mod.ID, grp.Name, oldID))
+				delete(removed, mod.Source)
+			}
+		}
+	}
+	return suggestions
+}
+
+func hasModule(grp GroupManifest, id string) bool {
+	for _, mod := range grp.Modules {
+		if mod.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func printRenameWarning(suggestions []string) {
+	if len(suggestions) == 0 {
+		return
+	}
+	fmt.Println("**************** WARNING ****************")
+	for _, s := range suggestions {
+		fmt.Printf("The %s.\n", s)
+	}
+	fmt.Println("Terraform will destroy the resources of the previous module and create new ones.")
+	fmt.Println("To keep them, set renamed_from to the previous ID of the module in the blueprint.")
+	fmt.Printf("*****************************************\n\n")
+}
@@ -0,0 +1,246 @@
+/**
+* Copyright 2022 Google LLC
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package modulewriter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"hpc-toolkit/pkg/config"
+)
+
+const (
+	stagingDirName         = "staging"
+	prevGroupsBackupSuffix = ".bak"
+)
+
+// rollback collects the steps that undo a partially completed deployment
+// write
+type rollback []func() error
+
+func (r *rollback) add(undo func() error) {
+	*r = append(*r, undo)
+}
+
+// run undoes the recorded steps in reverse order
+func (r rollback) run() error {
+	var errs []string
+	for i := len(r) - 1; i >= 0; i-- {
+		if err := r[i](); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to restore the deployment directory: %s",
+			strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// writeStagedDeployment renders all deployment groups into a staging
+// directory and only swaps them into the deployment directory once they were
+// written successfully. If any later step fails, the deployment directory is
+// restored to its original layout. It returns the ID of the archive holding
+// removed groups, if any.
+func writeStagedDeployment(
+	blueprint *config.Blueprint,
+	deploymentDir string,
+	removed []string,
+	opts WriteOptions,
+) (string, []BackendMigration, error) {
+	stagingDir, err := createStagingDir(deploymentDir)
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	if err := writeDeploymentGroups(blueprint, stagingDir, opts.Format); err != nil {
+		return "", nil, err
+	}
+	preserved, err := loadPreserveList(deploymentDir, blueprint.PreserveFiles)
+	if err != nil {
+		return "", nil, err
+	}
+	manifest, err := newManifest(blueprint, stagingDir, preserved, opts)
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating deployment manifest: %w", err)
+	}
+	migrations, err := stageBackendMigrations(deploymentDir, stagingDir, manifest)
+	if err != nil {
+		return "", nil, err
+	}
+	// the history keeps no values of sensitive settings and variables
+	redacted := blueprint.Redacted()
+	bpYAML, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return "", nil, fmt.Errorf("error serializing blueprint: %w", err)
+	}
+	archiveID, err := commitStagedGroups(deploymentDir, stagingDir, removed, manifest, bpYAML, opts.HistoryLimit)
+	return archiveID, migrations, err
+}
+
+func createStagingDir(deploymentDir string) (string, error) {
+	stagingDir := filepath.Join(deploymentDir, hiddenGhpcDirName, stagingDirName)
+	os.RemoveAll(stagingDir)
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create staging directory at %s: %w", stagingDir, err)
+	}
+	return stagingDir, nil
+}
+
+// commitStagedGroups swaps staged deployment groups into the deployment
+// directory and records them in the deployment history, rolling back all
+// changes if any step fails
+func commitStagedGroups(
+	deploymentDir string,
+	stagingDir string,
+	removed []string,
+	manifest Manifest,
+	bpYAML []byte,
+	historyLimit int,
+) (string, error) {
+	var undo rollback
+	archiveID, err := swapStagedGroups(deploymentDir, stagingDir, removed, manifest, bpYAML, &undo)
+	if err != nil {
+		if rbErr := undo.run(); rbErr != nil {
+			return "", fmt.Errorf("%w\n%v", err, rbErr)
+		}
+		return "", err
+	}
+
+	backupDir := filepath.Join(deploymentDir, hiddenGhpcDirName, prevDeploymentGroupDirName+prevGroupsBackupSuffix)
+	os.RemoveAll(backupDir)
+	if err := pruneHistory(deploymentDir, historyLimit); err != nil {
+		return archiveID, fmt.Errorf("error removing old deployment history: %w", err)
+	}
+	return archiveID, nil
+}
+
+// swapStagedGroups replaces the deployment groups of the deployment directory
+// with the staged ones, keeping the replaced groups as previous deployment
+// groups, then archives removed groups, restores state and preserved files,
+// records a snapshot in the deployment history and writes the manifest. Every
+// step is recorded in undo.
+func swapStagedGroups(
+	deploymentDir string,
+	stagingDir string,
+	removed []string,
+	manifest Manifest,
+	bpYAML []byte,
+	undo *rollback,
+) (string, error) {
+	ghpcDir := filepath.Join(deploymentDir, hiddenGhpcDirName)
+	prevGroupDir := filepath.Join(ghpcDir, prevDeploymentGroupDirName)
+	backupDir := prevGroupDir + prevGroupsBackupSuffix
+
+	// keep the previous generation until the new one is in place
+	os.RemoveAll(backupDir)
+	if _, err := os.Stat(prevGroupDir); err == nil {
+		if err := os.Rename(prevGroupDir, backupDir); err != nil {
+			return "", fmt.Errorf("Failed to back up previous deployment groups: %w", err)
+		}
+		undo.add(func() error { return os.Rename(backupDir, prevGroupDir) })
+	}
+	if err := os.MkdirAll(prevGroupDir, 0755); err != nil {
+		return "", fmt.Errorf("Failed to create directory to save previous deployment groups at %s: %w", prevGroupDir, err)
+	}
+	undo.add(func() error { return os.RemoveAll(prevGroupDir) })
+
+	// move deployment groups
+	if err := moveGroups(deploymentDir, prevGroupDir, undo); err != nil {
+		return "", fmt.Errorf("Error while moving previous deployment groups: %w", err)
+	}
+	if err := moveGroups(stagingDir, deploymentDir, undo); err != nil {
+		return "", fmt.Errorf("Error while moving new deployment groups into place: %w", err)
+	}
+
+	var archiveID string
+	if len(removed) > 0 {
+		var err error
+		if archiveID, err = archiveGroups(deploymentDir, removed, undo); err != nil {
+			return "", err
+		}
+	}
+
+	// restoring state does not depend on the format of the groups
+	writers := newModuleWriters(FormatHCL)
+	for _, kind := range orderedKeys(writers) {
+		if err := writers[kind].restoreState(deploymentDir); err != nil {
+			return "", fmt.Errorf("error trying to restore terraform state: %w", err)
+		}
+	}
+
+	preserved, err := loadPreserveList(deploymentDir, manifest.PreserveFiles)
+	if err != nil {
+		return "", err
+	}
+	if err := restorePreservedFiles(deploymentDir, preserved); err != nil {
+		return "", err
+	}
+
+	if err := recordHistory(deploymentDir, manifest, bpYAML, preserved, undo); err != nil {
+		return "", fmt.Errorf("error recording deployment history: %w", err)
+	}
+
+	if err := writeManifest(manifest, deploymentDir); err != nil {
+		return "", fmt.Errorf("error writing deployment manifest: %w", err)
+	}
+	return archiveID, nil
+}
+
+// moveGroups moves every deployment group directory from src to dest
+func moveGroups(src string, dest string, undo *rollback) error {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.IsDir() || f.Name() == hiddenGhpcDirName {
+			continue
+		}
+		from := filepath.Join(src, f.Name())
+		to := filepath.Join(dest, f.Name())
+		if err := os.Rename(from, to); err != nil {
+			return fmt.Errorf("failed on %s: %w", f.Name(), err)
+		}
+		undo.add(func() error { return os.Rename(to, from) })
+	}
+	return nil
+}
+
+// restoreFile copies a file of the previous deployment into the regenerated
+// one. It keeps the modification time of the file, which tells when state
+// files and Packer manifests were last applied.
+func restoreFile(src string, dest string, perm os.FileMode) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dest, b, perm); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
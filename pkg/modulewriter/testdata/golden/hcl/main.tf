@@ -0,0 +1,40 @@
+/**
+  * Copyright 2022 Google LLC
+  *
+  * Licensed under the Apache License, Version 2.0 (the "License");
+  * you may not use this file except in compliance with the License.
+  * You may obtain a copy of the License at
+  *
+  *      http://www.apache.org/licenses/LICENSE-2.0
+  *
+  * Unless required by applicable law or agreed to in writing, software
+  * distributed under the License is distributed on an "AS IS" BASIS,
+  * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  * See the License for the specific language governing permissions and
+  * limitations under the License.
+  */
+
+terraform {
+  backend "gcs" {
+    bucket = "a-bucket"
+    prefix = "golden/primary"
+  }
+}
+
+module "network" {
+  source       = "./modules/tfModule"
+  zone         = var.zone
+  project_id   = var.project_id
+  network_name = "golden-net"
+  labels       = merge(var.labels, { ghpc_role = "network",})
+}
+
+module "vm" {
+  source          = "./modules/tfModule"
+  subnetwork_name = module.network.subnetwork_name
+  network_storage = flatten([module.network.network_name])
+  machine_type    = "n2-standard-2"
+  count           = 2
+  enable          = true
+}
+
@@ -0,0 +1,582 @@
+/**
+* Copyright 2022 Google LLC
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package modulewriter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	ctyJson "github.com/zclconf/go-cty/cty/json"
+	"golang.org/x/exp/slices"
+
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/sourcereader"
+)
+
+// Terraform ignores properties named "//" in JSON configuration, which makes
+// it the only place a license header can be kept in a .tf.json file
+const jsonLicense string = "Copyright 2022 Google LLC. " +
+	"Licensed under the Apache License, Version 2.0 (the \"License\"); " +
+	"you may not use this file except in compliance with the License. " +
+	"You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0"
+
+// jsonBody is the top-level object of a Terraform JSON configuration file
+type jsonBody map[string]interface{}
+
+func newJSONBody() jsonBody {
+	return jsonBody{"//": jsonLicense}
+}
+
+// orderedObject is a JSON object whose properties are encoded in the order
+// they were set, rather than the lexical order used for Go maps
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newOrderedObject() *orderedObject {
+	return &orderedObject{values: map[string]interface{}{}}
+}
+
+func (o *orderedObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := encoder.Encode(key); err != nil {
+			return nil, err
+		}
+		buf.WriteByte(':')
+		if err := encoder.Encode(o.values[key]); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func writeJSONFile(body interface{}, path string) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(body); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// escapeTemplateSequences escapes a literal string so that Terraform does not
+// interpret it as a template when it is read from a JSON configuration file.
+// Blueprint escapes of the form \$(...) and \((...)) are also resolved.
+func escapeTemplateSequences(str string) string {
+	str = strings.ReplaceAll(str, `\$(`, `$(`)
+	str = strings.ReplaceAll(str, `\((`, `((`)
+	str = strings.ReplaceAll(str, "${", "$${")
+	return strings.ReplaceAll(str, "%{", "%%{")
+}
+
+// embeddedLiteralExp matches the literal variables ((ctx.name)) embedded in a
+// longer string. The first group holds the backslash of an escaped one.
+var embeddedLiteralExp = regexp.MustCompile(`(\\?)\(\(\s*([A-Za-z_][\w-]*\..*?)\s*\)\)`)
+
+// splitTemplate calls literal on the parts of a string outside of embedded
+// literal variables, escaped ones included, and interpolation on the
+// expression of each embedded literal variable
+func splitTemplate(str string, literal func(string), interpolation func(string)) {
+	last := 0
+	for _, m := range embeddedLiteralExp.FindAllStringSubmatchIndex(str, -1) {
+		if m[3] > m[2] {
+			continue
+		}
+		literal(str[last:m[0]])
+		interpolation(str[m[4]:m[5]])
+		last = m[1]
+	}
+	literal(str[last:])
+}
+
+// jsonTemplate converts a string into a Terraform JSON string template, in
+// which embedded literal variables become interpolations
+func jsonTemplate(str string) string {
+	var b strings.Builder
+	splitTemplate(str,
+		func(lit string) { b.WriteString(escapeTemplateSequences(lit)) },
+		func(expr string) { fmt.Fprintf(&b, "${%s}", expr) })
+	return b.String()
+}
+
+// jsonExpression converts a cty.Value into a value that encodes to the
+// equivalent Terraform JSON expression. Literal variables ((expr)), including
+// those embedded in a longer string, become template interpolations and all
+// other strings are kept literal.
+func jsonExpression(val cty.Value) (interface{}, error) {
+	if val.IsNull() {
+		return nil, nil
+	}
+	ty := val.Type()
+	switch {
+	case ty == cty.String:
+		str := val.AsString()
+		if config.IsLiteralVariable(str) {
+			return fmt.Sprintf("${%s}", config.HandleLiteralVariable(str)), nil
+		}
+		return jsonTemplate(str), nil
+	case ty == cty.Number:
+		return json.Number(val.AsBigFloat().Text('f', -1)), nil
+	case ty == cty.Bool:
+		return val.True(), nil
+	case ty.IsListType() || ty.IsTupleType() || ty.IsSetType():
+		list := []interface{}{}
+		for it := val.ElementIterator(); it.Next(); {
+			_, v := it.Element()
+			elem, err := jsonExpression(v)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elem)
+		}
+		return list, nil
+	case ty.IsMapType() || ty.IsObjectType():
+		obj := map[string]interface{}{}
+		for it := val.ElementIterator(); it.Next(); {
+			k, v := it.Element()
+			elem, err := jsonExpression(v)
+			if err != nil {
+				return nil, err
+			}
+			obj[k.AsString()] = elem
+		}
+		return obj, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %s", ty.FriendlyName())
+	}
+}
+
+// hclExpression renders a cty.Value as a single-line native HCL expression,
+// which is needed when a value is embedded in a larger expression such as a
+// function call inside a JSON template interpolation.
+func hclExpression(val cty.Value) string {
+	if val.IsNull() {
+		return "null"
+	}
+	ty := val.Type()
+	switch {
+	case ty == cty.String:
+		str := val.AsString()
+		if config.IsLiteralVariable(str) {
+			return config.HandleLiteralVariable(str)
+		}
+		var b strings.Builder
+		splitTemplate(str,
+			func(lit string) {
+				quoted := hclwrite.TokensForValue(cty.StringVal(lit)).Bytes()
+				quoted = escapeBlueprintVariables(escapeLiteralVariables(quoted))
+				b.Write(quoted[1 : len(quoted)-1])
+			},
+			func(expr string) { fmt.Fprintf(&b, "${%s}", expr) })
+		return `"` + b.String() + `"`
+	case ty.IsListType() || ty.IsTupleType() || ty.IsSetType():
+		elems := []string{}
+		for it := val.ElementIterator(); it.Next(); {
+			_, v := it.Element()
+			elems = append(elems, hclExpression(v))
+		}
+		return fmt.Sprintf("[%s]", strings.Join(elems, ", "))
+	case ty.IsMapType() || ty.IsObjectType():
+		items := []string{}
+		for it := val.ElementIterator(); it.Next(); {
+			k, v := it.Element()
+			key := string(hclwrite.TokensForValue(k).Bytes())
+			items = append(items, fmt.Sprintf("%s = %s", key, hclExpression(v)))
+		}
+		return fmt.Sprintf("{%s}", strings.Join(items, ", "))
+	default:
+		return string(hclwrite.TokensForValue(val).Bytes())
+	}
+}
+
+func writeMainJSON(
+	modules []config.Module,
+	tfBackend config.TerraformBackend,
+	dst string,
+) error {
+	mainPath := filepath.Join(dst, "main.tf.json")
+	body := newJSONBody()
+
+	// Write Terraform backend if needed
+	if tfBackend.Type != "" {
+		tfConfig, err := config.ConvertMapToCty(tfBackend.Configuration)
+		if err != nil {
+			errString := "error converting terraform backend configuration to cty when writing main.tf.json: %v"
+			return fmt.Errorf(errString, err)
+		}
+		backendConfig := map[string]interface{}{}
+		for setting, value := range tfConfig {
+			if backendConfig[setting], err = jsonExpression(value); err != nil {
+				return fmt.Errorf("error converting terraform backend setting %s: %v", setting, err)
+			}
+		}
+		body["terraform"] = map[string]interface{}{
+			"backend": map[string]interface{}{tfBackend.Type: backendConfig},
+		}
+	}
+
+	moduleBlocks := newOrderedObject()
+	for _, mod := range modules {
+		// Convert settings to cty.Value
+		ctySettings, err := config.ConvertMapToCty(mod.Settings)
+		if err != nil {
+			return fmt.Errorf(
+				"error converting setting in module %s to cty when writing main.tf.json: %v",
+				mod.ID, err)
+		}
+
+		moduleBody := newOrderedObject()
+		if sourcereader.IsGitPath(mod.Source) {
+			moduleBody.set("source", mod.Source)
+		} else {
+			moduleBody.set("source", fmt.Sprintf("./modules/%s", mod.ModuleName))
+		}
+
+		// Settings are kept in blueprint order
+		for _, setting := range mod.OrderedSettingNames() {
+			value := ctySettings[setting]
+			if setting == "labels" {
+				moduleBody.set(setting, fmt.Sprintf(
+					"${merge(var.labels, %s)}", hclExpression(value)))
+				continue
+			}
+
+			if wrap, ok := mod.WrapSettingsWith[setting]; ok {
+				if len(wrap) != 2 {
+					return fmt.Errorf(
+						"invalid length of WrapSettingsWith for %s.%s, expected 2 got %d",
+						mod.ID, setting, len(wrap))
+				}
+				moduleBody.set(setting, fmt.Sprintf(
+					"${%s%s%s}", wrap[0], hclExpression(value), wrap[1]))
+				continue
+			}
+
+			exp, err := jsonExpression(value)
+			if err != nil {
+				return fmt.Errorf(
+					"error converting setting %s in module %s when writing main.tf.json: %v",
+					setting, mod.ID, err)
+			}
+			moduleBody.set(setting, exp)
+		}
+
+		if len(mod.DependsOn) > 0 {
+			deps := make([]string, len(mod.DependsOn))
+			for i, dep := range mod.DependsOn {
+				deps[i] = "module." + dep
+			}
+			moduleBody.set("depends_on", deps)
+		}
+		moduleBlocks.set(mod.ID, moduleBody)
+	}
+	if len(moduleBlocks.keys) > 0 {
+		body["module"] = moduleBlocks
+	}
+
+	// Move the resources of renamed modules rather than recreating them
+	movedBlocks := []interface{}{}
+	for _, mod := range modules {
+		if mod.RenamedFrom != "" {
+			movedBlocks = append(movedBlocks, map[string]interface{}{
+				"from": "module." + mod.RenamedFrom,
+				"to":   "module." + mod.ID,
+			})
+		}
+	}
+	if len(movedBlocks) > 0 {
+		body["moved"] = movedBlocks
+	}
+
+	// Adopt existing cloud resources into the modules
+	importBlocks := []interface{}{}
+	for _, mod := range modules {
+		for _, address := range orderedKeys(mod.Imports) {
+			importBlocks = append(importBlocks, map[string]interface{}{
+				"to": fmt.Sprintf("module.%s.%s", mod.ID, address),
+				"id": mod.Imports[address],
+			})
+		}
+	}
+	if len(importBlocks) > 0 {
+		body["import"] = importBlocks
+	}
+
+	if err := writeJSONFile(body, mainPath); err != nil {
+		return fmt.Errorf("error writing main.tf.json file: %v", err)
+	}
+	return nil
+}
+
+func writeVariablesJSON(vars map[string]cty.Value, sensitive []string, dst string) error {
+	variablesPath := filepath.Join(dst, "variables.tf.json")
+	body := newJSONBody()
+
+	variableBlocks := map[string]interface{}{}
+	for k, v := range vars {
+		typeTok := getTypeTokens(v)
+		if len(typeTok) == 0 {
+			return fmt.Errorf("error determining type of variable %s", k)
+		}
+		variable := map[string]interface{}{
+			"description": "",
+			"type":        string(typeTok.Bytes()),
+		}
+		if slices.Contains(sensitive, k) {
+			variable["sensitive"] = true
+		}
+		variableBlocks[k] = variable
+	}
+	if len(variableBlocks) > 0 {
+		body["variable"] = variableBlocks
+	}
+
+	if err := writeJSONFile(body, variablesPath); err != nil {
+		return fmt.Errorf("error writing variables.tf.json file: %v", err)
+	}
+	return nil
+}
+
+func writeRemoteStatesJSON(externals []config.ExternalOutputs, dst string) error {
+	remoteStatePath := filepath.Join(dst, remoteStateFileName+".tf.json")
+	body := newJSONBody()
+
+	dataSources := newOrderedObject()
+	for _, ext := range externals {
+		backendType, backendConfig, err := remoteStateBackend(ext)
+		if err != nil {
+			return err
+		}
+		dataSources.set(ext.DataSource(), map[string]interface{}{
+			"backend": backendType,
+			"config":  backendConfig,
+		})
+	}
+	body["data"] = map[string]interface{}{"terraform_remote_state": dataSources}
+
+	if err := writeJSONFile(body, remoteStatePath); err != nil {
+		return fmt.Errorf("error writing %s.tf.json file: %v", remoteStateFileName, err)
+	}
+	return nil
+}
+
+func writePackerImageVariablesJSON(images []config.PackerImage, dst string) error {
+	imagesPath := filepath.Join(dst, packerImagesFileName+".tf.json")
+	body := newJSONBody()
+
+	variableBlocks := newOrderedObject()
+	for _, img := range images {
+		variableBlocks.set(img.Variable(), map[string]interface{}{
+			"description": packerImageDescription(img),
+			"type":        "string",
+		})
+	}
+	body["variable"] = variableBlocks
+
+	if err := writeJSONFile(body, imagesPath); err != nil {
+		return fmt.Errorf("error writing %s.tf.json file: %v", packerImagesFileName, err)
+	}
+	return nil
+}
+
+func writeOutputsJSON(
+	modules []config.Module,
+	depOutputs []config.GroupOutput,
+	sensitive []string,
+	dst string,
+) error {
+	outputsPath := filepath.Join(dst, "outputs.tf.json")
+	body := newJSONBody()
+
+	outputBlocks := newOrderedObject()
+	for _, mod := range modules {
+		for _, output := range mod.Outputs {
+			outputName := fmt.Sprintf("%s_%s", output, mod.ID)
+			block := map[string]interface{}{
+				"description": fmt.Sprintf("Generated output from module '%s'", mod.ID),
+				"value":       fmt.Sprintf("${module.%s.%s}", mod.ID, output),
+			}
+			if slices.Contains(sensitive, outputName) {
+				block["sensitive"] = true
+			}
+			outputBlocks.set(outputName, block)
+		}
+	}
+	for _, out := range depOutputs {
+		block := map[string]interface{}{
+			"description": deploymentOutputDescription(out),
+			"value":       fmt.Sprintf("${module.%s.%s}", out.ModuleID, out.Output),
+		}
+		if slices.Contains(sensitive, out.Name) {
+			block["sensitive"] = true
+		}
+		outputBlocks.set(out.Name, block)
+	}
+	if len(outputBlocks.keys) > 0 {
+		body["output"] = outputBlocks
+	}
+
+	if err := writeJSONFile(body, outputsPath); err != nil {
+		return fmt.Errorf("error writing outputs.tf.json file: %v", err)
+	}
+	return nil
+}
+
+// tfvars files hold literal values rather than expressions so they are
+// encoded directly from their cty representation
+func writeTfvarsJSON(vars map[string]cty.Value, dst string) error {
+	tfvarsPath := filepath.Join(dst, "terraform.tfvars.json")
+	body := map[string]interface{}{}
+	for k, v := range vars {
+		jsonBytes, err := ctyJson.SimpleJSONValue{Value: v}.MarshalJSON()
+		if err != nil {
+			return fmt.Errorf("error converting variable %s to JSON: %v", k, err)
+		}
+		body[k] = json.RawMessage(jsonBytes)
+	}
+
+	if err := writeJSONFile(body, tfvarsPath); err != nil {
+		return fmt.Errorf("error writing terraform.tfvars.json file: %v", err)
+	}
+	return nil
+}
+
+func writeProvidersJSON(vars map[string]cty.Value, dst string) error {
+	providersPath := filepath.Join(dst, "providers.tf.json")
+	body := newJSONBody()
+
+	providerBlocks := map[string]interface{}{}
+	for _, prov := range []string{"google", "google-beta"} {
+		provBody := map[string]interface{}{}
+		if _, ok := vars["project_id"]; ok {
+			provBody["project"] = "${var.project_id}"
+		}
+		if _, ok := vars["zone"]; ok {
+			provBody["zone"] = "${var.zone}"
+		}
+		if _, ok := vars["region"]; ok {
+			provBody["region"] = "${var.region}"
+		}
+		providerBlocks[prov] = provBody
+	}
+	body["provider"] = providerBlocks
+
+	if err := writeJSONFile(body, providersPath); err != nil {
+		return fmt.Errorf("error writing providers.tf.json file: %v", err)
+	}
+	return nil
+}
+
+func writeVersionsJSON(dst string, requiredVersion string) error {
+	versionsPath := filepath.Join(dst, "versions.tf.json")
+	body := newJSONBody()
+	body["terraform"] = tfversionsJSON(requiredVersion)
+
+	if err := writeJSONFile(body, versionsPath); err != nil {
+		return fmt.Errorf("error writing versions.tf.json file: %v", err)
+	}
+	return nil
+}
+
+// writeJSONFiles writes the terraform files of a deployment group in
+// Terraform JSON syntax
+func writeJSONFiles(
+	depGroup config.DeploymentGroup,
+	ctyVars map[string]cty.Value,
+	writePath string,
+) error {
+	if err := writeMainJSON(
+		depGroup.Modules, depGroup.TerraformBackend, writePath,
+	); err != nil {
+		return fmt.Errorf("error writing main.tf.json file for deployment group %s: %v",
+			depGroup.Name, err)
+	}
+
+	if err := writeVariablesJSON(ctyVars, depGroup.SensitiveVars, writePath); err != nil {
+		return fmt.Errorf(
+			"error writing variables.tf.json file for deployment group %s: %v",
+			depGroup.Name, err)
+	}
+
+	if len(depGroup.PackerImages) > 0 {
+		if err := writePackerImageVariablesJSON(depGroup.PackerImages, writePath); err != nil {
+			return fmt.Errorf(
+				"error writing %s.tf.json file for deployment group %s: %v",
+				packerImagesFileName, depGroup.Name, err)
+		}
+	}
+
+	if len(depGroup.ExternalOutputs) > 0 {
+		if err := writeRemoteStatesJSON(depGroup.ExternalOutputs, writePath); err != nil {
+			return fmt.Errorf(
+				"error writing %s.tf.json file for deployment group %s: %v",
+				remoteStateFileName, depGroup.Name, err)
+		}
+	}
+
+	if err := writeOutputsJSON(depGroup.Modules, depGroup.DeploymentOutputs, depGroup.SensitiveOutputs, writePath); err != nil {
+		return fmt.Errorf(
+			"error writing outputs.tf.json file for deployment group %s: %v",
+			depGroup.Name, err)
+	}
+
+	if err := writeTfvarsJSON(ctyVars, writePath); err != nil {
+		return fmt.Errorf(
+			"error writing terraform.tfvars.json file for deployment group %s: %v",
+			depGroup.Name, err)
+	}
+
+	if err := writeProvidersJSON(ctyVars, writePath); err != nil {
+		return fmt.Errorf(
+			"error writing providers.tf.json file for deployment group %s: %v",
+			depGroup.Name, err)
+	}
+
+	if err := writeVersionsJSON(writePath, requiredTerraformVersion(depGroup.Modules)); err != nil {
+		return fmt.Errorf(
+			"error writing versions.tf.json file for deployment group %s: %v",
+			depGroup.Name, err)
+	}
+
+	return nil
+}
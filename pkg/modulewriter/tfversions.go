@@ -14,9 +14,12 @@
 
 package modulewriter
 
+import "hpc-toolkit/pkg/config"
+
+// tfversions is formatted with the required Terraform version
 const tfversions string = `
 terraform {
-  required_version = ">= 0.13"
+  required_version = "%s"
 
   required_providers {
     google = {
@@ -30,3 +33,36 @@ terraform {
   }
 }
 `
+
+// tfversionsJSON is the Terraform JSON equivalent of tfversions
+func tfversionsJSON(requiredVersion string) map[string]interface{} {
+	return map[string]interface{}{
+		"required_version": requiredVersion,
+		"required_providers": map[string]interface{}{
+			"google": map[string]interface{}{
+				"source":  "hashicorp/google",
+				"version": "~> 4.49.0",
+			},
+			"google-beta": map[string]interface{}{
+				"source":  "hashicorp/google-beta",
+				"version": "~> 4.49.0",
+			},
+		},
+	}
+}
+
+// requiredTerraformVersion is the oldest Terraform version that supports the
+// blocks written for the modules of a deployment group: moved blocks of
+// renamed modules need Terraform 1.1 and import blocks need Terraform 1.5
+func requiredTerraformVersion(modules []config.Module) string {
+	version := ">= 0.13"
+	for _, mod := range modules {
+		if len(mod.Imports) > 0 {
+			return ">= 1.5"
+		}
+		if mod.RenamedFrom != "" {
+			version = ">= 1.1"
+		}
+	}
+	return version
+}
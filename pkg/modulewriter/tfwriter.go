@@ -17,6 +17,7 @@
 package modulewriter
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -27,6 +28,7 @@ import (
 	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/hashicorp/hcl/v2/hclwrite"
 	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/exp/slices"
 
 	"hpc-toolkit/pkg/config"
 	"hpc-toolkit/pkg/sourcereader"
@@ -40,6 +42,7 @@ const (
 // TFWriter writes terraform to the blueprint folder
 type TFWriter struct {
 	numModules int
+	format     string
 }
 
 // GetNumModules getter for module count of kind terraform
@@ -81,8 +84,17 @@ func appendHCLToFile(path string, hclBytes []byte) error {
 	return nil
 }
 
+func deploymentOutputDescription(out config.GroupOutput) string {
+	if out.Description != "" {
+		return out.Description
+	}
+	return fmt.Sprintf("Output '%s' of module '%s'", out.Output, out.ModuleID)
+}
+
 func writeOutputs(
 	modules []config.Module,
+	depOutputs []config.GroupOutput,
+	sensitive []string,
 	dst string,
 ) error {
 	// Create file
@@ -108,10 +120,25 @@ func writeOutputs(
 			blockBody.SetAttributeValue("description", cty.StringVal(desc))
 			value := fmt.Sprintf("((module.%s.%s))", mod.ID, output)
 			blockBody.SetAttributeValue("value", cty.StringVal(value))
+			if slices.Contains(sensitive, outputName) {
+				blockBody.SetAttributeValue("sensitive", cty.True)
+			}
 			hclBody.AppendNewline()
 		}
 	}
 
+	// Add the outputs of the deployment under their chosen names
+	for _, out := range depOutputs {
+		blockBody := hclBody.AppendNewBlock("output", []string{out.Name}).Body()
+		blockBody.SetAttributeValue("description", cty.StringVal(deploymentOutputDescription(out)))
+		value := fmt.Sprintf("((module.%s.%s))", out.ModuleID, out.Output)
+		blockBody.SetAttributeValue("value", cty.StringVal(value))
+		if slices.Contains(sensitive, out.Name) {
+			blockBody.SetAttributeValue("sensitive", cty.True)
+		}
+		hclBody.AppendNewline()
+	}
+
 	// Write file
 	hclBytes := handleLiteralVariables(hclFile.Bytes())
 	hclBytes = escapeLiteralVariables(hclBytes)
@@ -159,7 +186,7 @@ func getTypeTokens(ctyVal cty.Value) hclwrite.Tokens {
 	return []*hclwrite.Token{&typeToken}
 }
 
-func writeVariables(vars map[string]cty.Value, dst string) error {
+func writeVariables(vars map[string]cty.Value, sensitive []string, dst string) error {
 	// Create file
 	variablesPath := filepath.Join(dst, "variables.tf")
 	if err := createBaseFile(variablesPath); err != nil {
@@ -171,7 +198,8 @@ func writeVariables(vars map[string]cty.Value, dst string) error {
 	hclBody := hclFile.Body()
 
 	// for each variable
-	for k, v := range vars {
+	for _, k := range orderedKeys(vars) {
+		v := vars[k]
 		// Create variable block
 		hclBlock := hclBody.AppendNewBlock("variable", []string{k})
 		blockBody := hclBlock.Body()
@@ -183,6 +211,9 @@ func writeVariables(vars map[string]cty.Value, dst string) error {
 			return fmt.Errorf("error determining type of variable %s", k)
 		}
 		blockBody.SetAttributeRaw("type", typeTok)
+		if slices.Contains(sensitive, k) {
+			blockBody.SetAttributeValue("sensitive", cty.True)
+		}
 		hclBody.AppendNewline()
 	}
 	// Write file
@@ -192,6 +223,59 @@ func writeVariables(vars map[string]cty.Value, dst string) error {
 	return nil
 }
 
+// writeRemoteStates declares the terraform_remote_state data sources that
+// read the outputs of deployment groups of other deployments
+func writeRemoteStates(externals []config.ExternalOutputs, dst string) error {
+	remoteStatePath := filepath.Join(dst, remoteStateFileName+".tf")
+	if err := createBaseFile(remoteStatePath); err != nil {
+		return fmt.Errorf("error creating %s.tf file: %v", remoteStateFileName, err)
+	}
+
+	hclFile := hclwrite.NewEmptyFile()
+	hclBody := hclFile.Body()
+	for _, ext := range externals {
+		backendType, backendConfig, err := remoteStateBackend(ext)
+		if err != nil {
+			return err
+		}
+		ctyConfig, err := config.ConvertMapToCty(backendConfig)
+		if err != nil {
+			return fmt.Errorf("error converting the backend of %s to cty: %v", ext.DataSource(), err)
+		}
+		blockBody := hclBody.AppendNewBlock(
+			"data", []string{"terraform_remote_state", ext.DataSource()}).Body()
+		blockBody.SetAttributeValue("backend", cty.StringVal(backendType))
+		blockBody.SetAttributeValue("config", cty.ObjectVal(ctyConfig))
+		hclBody.AppendNewline()
+	}
+	if err := appendHCLToFile(remoteStatePath, hclFile.Bytes()); err != nil {
+		return fmt.Errorf("error writing HCL to %s.tf file: %v", remoteStateFileName, err)
+	}
+	return nil
+}
+
+// writePackerImageVariables declares the variables that supply the images
+// built by Packer modules of earlier deployment groups
+func writePackerImageVariables(images []config.PackerImage, dst string) error {
+	imagesPath := filepath.Join(dst, packerImagesFileName+".tf")
+	if err := createBaseFile(imagesPath); err != nil {
+		return fmt.Errorf("error creating %s.tf file: %v", packerImagesFileName, err)
+	}
+
+	hclFile := hclwrite.NewEmptyFile()
+	hclBody := hclFile.Body()
+	for _, img := range images {
+		blockBody := hclBody.AppendNewBlock("variable", []string{img.Variable()}).Body()
+		blockBody.SetAttributeValue("description", cty.StringVal(packerImageDescription(img)))
+		blockBody.SetAttributeRaw("type", getTypeTokens(cty.StringVal("")))
+		hclBody.AppendNewline()
+	}
+	if err := appendHCLToFile(imagesPath, hclFile.Bytes()); err != nil {
+		return fmt.Errorf("error writing HCL to %s.tf file: %v", packerImagesFileName, err)
+	}
+	return nil
+}
+
 func writeMain(
 	modules []config.Module,
 	tfBackend config.TerraformBackend,
@@ -217,8 +301,8 @@ func writeMain(
 		tfBody := hclBody.AppendNewBlock("terraform", []string{}).Body()
 		backendBlock := tfBody.AppendNewBlock("backend", []string{tfBackend.Type})
 		backendBody := backendBlock.Body()
-		for setting, value := range tfConfig {
-			backendBody.SetAttributeValue(setting, value)
+		for _, setting := range orderedKeys(tfConfig) {
+			backendBody.SetAttributeValue(setting, tfConfig[setting])
 		}
 		hclBody.AppendNewline()
 	}
@@ -246,8 +330,9 @@ func writeMain(
 
 		moduleBody.SetAttributeValue("source", moduleSource)
 
-		// For each Setting
-		for setting, value := range ctySettings {
+		// For each Setting, in blueprint order
+		for _, setting := range mod.OrderedSettingNames() {
+			value := ctySettings[setting]
 			if setting == "labels" {
 				// Manually compose merge(var.labels, {mod.labels}) using tokens
 				mergeBytes := []byte("merge(var.labels, ")
@@ -285,8 +370,41 @@ func writeMain(
 				moduleBody.SetAttributeValue(setting, value)
 			}
 		}
+
+		// Apply the modules it depends on first
+		if len(mod.DependsOn) > 0 {
+			deps := make([]string, len(mod.DependsOn))
+			for i, dep := range mod.DependsOn {
+				deps[i] = "module." + dep
+			}
+			depsTok := simpleTokenFromString("[" + strings.Join(deps, ", ") + "]")
+			moduleBody.SetAttributeRaw("depends_on", hclwrite.Tokens{&depsTok})
+		}
 		hclBody.AppendNewline()
 	}
+
+	// Move the resources of renamed modules rather than recreating them
+	for _, mod := range modules {
+		if mod.RenamedFrom == "" {
+			continue
+		}
+		movedBody := hclBody.AppendNewBlock("moved", []string{}).Body()
+		fromTok := simpleTokenFromString("module." + mod.RenamedFrom)
+		toTok := simpleTokenFromString("module." + mod.ID)
+		movedBody.SetAttributeRaw("from", hclwrite.Tokens{&fromTok})
+		movedBody.SetAttributeRaw("to", hclwrite.Tokens{&toTok})
+		hclBody.AppendNewline()
+	}
+	// Adopt existing cloud resources into the modules
+	for _, mod := range modules {
+		for _, address := range orderedKeys(mod.Imports) {
+			importBody := hclBody.AppendNewBlock("import", []string{}).Body()
+			toTok := simpleTokenFromString(fmt.Sprintf("module.%s.%s", mod.ID, address))
+			importBody.SetAttributeRaw("to", hclwrite.Tokens{&toTok})
+			importBody.SetAttributeValue("id", cty.StringVal(mod.Imports[address]))
+			hclBody.AppendNewline()
+		}
+	}
 	// Write file
 	hclBytes := handleLiteralVariables(hclFile.Bytes())
 	hclBytes = escapeLiteralVariables(hclBytes)
@@ -353,22 +471,29 @@ func writeProviders(vars map[string]cty.Value, dst string) error {
 	return nil
 }
 
-func writeVersions(dst string) error {
+func writeVersions(dst string, requiredVersion string) error {
 	// Create file
 	versionsPath := filepath.Join(dst, "versions.tf")
 	if err := createBaseFile(versionsPath); err != nil {
 		return fmt.Errorf("error creating versions.tf file: %v", err)
 	}
 	// Write hard-coded version information
-	if err := appendHCLToFile(versionsPath, []byte(tfversions)); err != nil {
+	if err := appendHCLToFile(versionsPath, []byte(fmt.Sprintf(tfversions, requiredVersion))); err != nil {
 		return fmt.Errorf("error writing HCL to versions.tf file: %v", err)
 	}
 	return nil
 }
 
-func printTerraformInstructions(grpPath string, moduleName string) {
+func printTerraformInstructions(grpPath string, moduleName string, importImages bool, migrateState bool) {
 	printInstructionsPreamble("Terraform", grpPath, moduleName)
-	fmt.Printf("  terraform -chdir=%s init\n", grpPath)
+	if importImages {
+		fmt.Printf("  ghpc import-images %s\n", grpPath)
+	}
+	if migrateState {
+		fmt.Printf("  terraform -chdir=%s init -migrate-state\n", grpPath)
+	} else {
+		fmt.Printf("  terraform -chdir=%s init\n", grpPath)
+	}
 	fmt.Printf("  terraform -chdir=%s validate\n", grpPath)
 	fmt.Printf("  terraform -chdir=%s apply\n\n", grpPath)
 }
@@ -393,6 +518,24 @@ func (w TFWriter) writeDeploymentGroup(
 
 	writePath := filepath.Join(deploymentDir, depGroup.Name)
 
+	writeFiles := writeHCLFiles
+	if w.format == FormatTFJSON {
+		writeFiles = writeJSONFiles
+	}
+	if err := writeFiles(depGroup, ctyVars, writePath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// writeHCLFiles writes the terraform files of a deployment group in native
+// HCL syntax
+func writeHCLFiles(
+	depGroup config.DeploymentGroup,
+	ctyVars map[string]cty.Value,
+	writePath string,
+) error {
 	// Write main.tf file
 	if err := writeMain(
 		depGroup.Modules, depGroup.TerraformBackend, writePath,
@@ -402,14 +545,32 @@ func (w TFWriter) writeDeploymentGroup(
 	}
 
 	// Write variables.tf file
-	if err := writeVariables(ctyVars, writePath); err != nil {
+	if err := writeVariables(ctyVars, depGroup.SensitiveVars, writePath); err != nil {
 		return fmt.Errorf(
 			"error writing variables.tf file for deployment group %s: %v",
 			depGroup.Name, err)
 	}
 
+	// Write packer_images.tf file
+	if len(depGroup.PackerImages) > 0 {
+		if err := writePackerImageVariables(depGroup.PackerImages, writePath); err != nil {
+			return fmt.Errorf(
+				"error writing %s.tf file for deployment group %s: %v",
+				packerImagesFileName, depGroup.Name, err)
+		}
+	}
+
+	// Write remote_state.tf file
+	if len(depGroup.ExternalOutputs) > 0 {
+		if err := writeRemoteStates(depGroup.ExternalOutputs, writePath); err != nil {
+			return fmt.Errorf(
+				"error writing %s.tf file for deployment group %s: %v",
+				remoteStateFileName, depGroup.Name, err)
+		}
+	}
+
 	// Write outputs.tf file
-	if err := writeOutputs(depGroup.Modules, writePath); err != nil {
+	if err := writeOutputs(depGroup.Modules, depGroup.DeploymentOutputs, depGroup.SensitiveOutputs, writePath); err != nil {
 		return fmt.Errorf(
 			"error writing outputs.tf file for deployment group %s: %v",
 			depGroup.Name, err)
@@ -430,14 +591,12 @@ func (w TFWriter) writeDeploymentGroup(
 	}
 
 	// Write versions.tf file
-	if err := writeVersions(writePath); err != nil {
+	if err := writeVersions(writePath, requiredTerraformVersion(depGroup.Modules)); err != nil {
 		return fmt.Errorf(
 			"error writing versions.tf file for deployment group %s: %v",
 			depGroup.Name, err)
 	}
 
-	printTerraformInstructions(writePath, depGroup.Name)
-
 	return nil
 }
 
@@ -453,19 +612,32 @@ func (w TFWriter) restoreState(deploymentDir string) error {
 	}
 
 	for _, f := range files {
-		var tfStateFiles = []string{tfStateFileName, tfStateBackupFileName}
+		var tfStateFiles = []string{tfStateFileName, tfStateBackupFileName, tfBackendStateFile}
 		for _, stateFile := range tfStateFiles {
 			src := filepath.Join(prevDeploymentGroupPath, f.Name(), stateFile)
 			dest := filepath.Join(deploymentDir, f.Name(), stateFile)
 
-			if bytesRead, err := ioutil.ReadFile(src); err == nil {
-				err = ioutil.WriteFile(dest, bytesRead, 0644)
-				if err != nil {
+			if _, err := os.Stat(src); err == nil {
+				if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+					return fmt.Errorf("Failed to create directory for previous state file %s, %w", dest, err)
+				}
+				if err := restoreFile(src, dest, 0644); err != nil {
 					return fmt.Errorf("Failed to write previous state file %s, %w", dest, err)
 				}
 			}
 		}
 
+		// keep a migration that is still pending, unless the backend changed again
+		src := filepath.Join(prevDeploymentGroupPath, f.Name(), BackendMigrationFileName)
+		dest := filepath.Join(deploymentDir, f.Name(), BackendMigrationFileName)
+		if _, err := os.Stat(dest); errors.Is(err, os.ErrNotExist) {
+			if bytesRead, err := ioutil.ReadFile(src); err == nil {
+				if err := ioutil.WriteFile(dest, bytesRead, 0644); err != nil {
+					return fmt.Errorf("Failed to write pending backend migration note %s, %w", dest, err)
+				}
+			}
+		}
+
 	}
 	return nil
 }
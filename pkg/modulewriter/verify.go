@@ -0,0 +1,158 @@
+/**
+* Copyright 2022 Google LLC
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package modulewriter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GroupDrift lists the files of a deployment group that have changed since
+// the deployment was created
+type GroupDrift struct {
+	Name     string
+	Modified []string
+	Added    []string
+	Deleted  []string
+}
+
+// HasChanges reports whether any file of the group has changed
+func (d GroupDrift) HasChanges() bool {
+	return len(d.Modified)+len(d.Added)+len(d.Deleted) > 0
+}
+
+func (d GroupDrift) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "deployment group %s:\n", d.Name)
+	for _, f := range d.Modified {
+		fmt.Fprintf(&b, "  modified: %s\n", f)
+	}
+	for _, f := range d.Added {
+		fmt.Fprintf(&b, "  added:    %s\n", f)
+	}
+	for _, f := range d.Deleted {
+		fmt.Fprintf(&b, "  deleted:  %s\n", f)
+	}
+	return b.String()
+}
+
+// DriftError signifies that a deployment overwrite was denied because files
+// in the deployment directory were changed after it was created.
+type DriftError struct {
+	Drift []GroupDrift
+}
+
+func (err *DriftError) Error() string {
+	var b strings.Builder
+	b.WriteString("Failed to overwrite existing deployment.\n\n" +
+		"The following files were changed since the deployment was created:\n")
+	for _, d := range err.Drift {
+		b.WriteString(d.String())
+	}
+	b.WriteString("\nUse --force to overwrite them, or accept the changes " +
+		"with \"ghpc verify --accept\" before overwriting.")
+	return b.String()
+}
+
+// VerifyDeployment compares the files of each deployment group against the
+// digests recorded in the deployment manifest. Only groups with changes are
+// returned.
+func VerifyDeployment(deploymentDir string) ([]GroupDrift, error) {
+	manifest, err := ReadManifest(deploymentDir)
+	if err != nil {
+		return nil, err
+	}
+	preserved, err := loadPreserveList(deploymentDir, manifest.PreserveFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	drift := []GroupDrift{}
+	for _, grp := range manifest.DeploymentGroups {
+		current, err := digestGroupFiles(filepath.Join(deploymentDir, grp.Name), grp.Kind, preserved)
+		if errors.Is(err, fs.ErrNotExist) {
+			current = map[string]string{}
+		} else if err != nil {
+			return nil, fmt.Errorf(
+				"failed to compute file digests for deployment group %s: %w", grp.Name, err)
+		}
+
+		d := GroupDrift{Name: grp.Name}
+		for _, f := range orderedKeys(grp.Files) {
+			digest, ok := current[f]
+			if !ok {
+				d.Deleted = append(d.Deleted, f)
+			} else if digest != grp.Files[f] {
+				d.Modified = append(d.Modified, f)
+			}
+		}
+		for _, f := range orderedKeys(current) {
+			if _, ok := grp.Files[f]; !ok {
+				d.Added = append(d.Added, f)
+			}
+		}
+		if d.HasChanges() {
+			drift = append(drift, d)
+		}
+	}
+	return drift, nil
+}
+
+// AcceptDrift records the current files of each deployment group in the
+// deployment manifest, so that they are no longer reported as changed
+func AcceptDrift(deploymentDir string) error {
+	manifest, err := ReadManifest(deploymentDir)
+	if err != nil {
+		return err
+	}
+	preserved, err := loadPreserveList(deploymentDir, manifest.PreserveFiles)
+	if err != nil {
+		return err
+	}
+	for i, grp := range manifest.DeploymentGroups {
+		files, err := digestGroupFiles(filepath.Join(deploymentDir, grp.Name), grp.Kind, preserved)
+		if errors.Is(err, fs.ErrNotExist) {
+			files = map[string]string{}
+		} else if err != nil {
+			return fmt.Errorf(
+				"failed to compute file digests for deployment group %s: %w", grp.Name, err)
+		}
+		manifest.DeploymentGroups[i].Files = files
+	}
+	return writeManifest(manifest, deploymentDir)
+}
+
+// checkDrift refuses to overwrite a deployment whose files were changed after
+// it was created. Deployments created without a manifest are not checked.
+func checkDrift(deploymentDir string) error {
+	manifestPath := filepath.Join(deploymentDir, hiddenGhpcDirName, manifestFileName)
+	if _, err := os.Stat(manifestPath); os.IsNotExist(err) {
+		return nil
+	}
+	drift, err := VerifyDeployment(deploymentDir)
+	if err != nil {
+		return err
+	}
+	if len(drift) > 0 {
+		return &DriftError{drift}
+	}
+	return nil
+}
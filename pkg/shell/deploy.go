@@ -0,0 +1,248 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shell
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"hpc-toolkit/pkg/modulewriter"
+)
+
+const progressFileName = "deploy_progress.json"
+
+// DeployOptions controls how the deployment groups of a deployment directory
+// are deployed
+type DeployOptions struct {
+	Binaries
+	// Groups limits the deployment to these deployment groups, which are
+	// still deployed after the selected groups they depend on. All groups are
+	// deployed if it is empty.
+	Groups []string
+	// AutoApprove applies Terraform changes without asking for approval
+	AutoApprove bool
+	// Parallel deploys the groups that do not depend on each other at the same
+	// time. It requires AutoApprove, as the groups cannot share the console.
+	Parallel bool
+	// Resume skips the groups deployed by the previous run, which failed
+	Resume bool
+	// Stdin, Stdout and Stderr default to those of ghpc
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// progress records the deployment groups deployed by a run of Deploy, so that
+// it can be resumed after a failure. It is only valid for the generation of
+// the deployment identified by the time its manifest was created.
+type progress struct {
+	Generation time.Time `json:"generation"`
+	Deployed   []string  `json:"deployed"`
+}
+
+func progressPath(deploymentDir string) string {
+	return filepath.Join(modulewriter.HiddenGhpcDir(deploymentDir), progressFileName)
+}
+
+func readProgress(deploymentDir string) (progress, error) {
+	var p progress
+	b, err := os.ReadFile(progressPath(deploymentDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return p, fmt.Errorf("failed to parse %s: %w", progressPath(deploymentDir), err)
+	}
+	return p, nil
+}
+
+func writeProgress(deploymentDir string, p progress) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(progressPath(deploymentDir), append(b, '\n'), 0644)
+}
+
+// selectGroups returns the deployment groups of the manifest that are named,
+// in the order of the deployment, or all groups if none are named
+func selectGroups(manifest modulewriter.Manifest, names []string) ([]modulewriter.GroupManifest, error) {
+	if len(names) == 0 {
+		return manifest.DeploymentGroups, nil
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(manifest.DeploymentGroups, func(g modulewriter.GroupManifest) bool {
+			return g.Name == name
+		}) {
+			return nil, fmt.Errorf("deployment group %s was not found in deployment %s",
+				name, manifest.DeploymentName)
+		}
+	}
+	var groups []modulewriter.GroupManifest
+	for _, grp := range manifest.DeploymentGroups {
+		if slices.Contains(names, grp.Name) {
+			groups = append(groups, grp)
+		}
+	}
+	return groups, nil
+}
+
+// Deploy runs Terraform or Packer in each deployment group of a deployment
+// directory, after the groups it depends on, and stops at the first group that
+// fails. The output of each group is streamed to the console and logged in the
+// .ghpc directory.
+func Deploy(deploymentDir string, opts DeployOptions) error {
+	if opts.Parallel && !opts.AutoApprove {
+		return errors.New("deployment groups can only be deployed in parallel with auto-approve")
+	}
+	manifest, err := modulewriter.ReadManifest(deploymentDir)
+	if err != nil {
+		return err
+	}
+	groups, err := selectGroups(manifest, opts.Groups)
+	if err != nil {
+		return err
+	}
+
+	prog := progress{Generation: manifest.CreatedAt, Deployed: []string{}}
+	if opts.Resume {
+		if prog, err = readProgress(deploymentDir); err != nil {
+			return err
+		}
+		if len(prog.Deployed) > 0 && !prog.Generation.Equal(manifest.CreatedAt) {
+			return fmt.Errorf("deployment %s was overwritten after the previous run, "+
+				"it must be deployed again without --resume", deploymentDir)
+		}
+		prog.Generation = manifest.CreatedAt
+	}
+
+	r := newRunner(opts.Binaries, opts.Stdin, opts.Stdout, opts.Stderr)
+	var toDeploy []modulewriter.GroupManifest
+	for _, grp := range groups {
+		if slices.Contains(prog.Deployed, grp.Name) {
+			r.printf("Skipping deployment group %s, which was deployed by the previous run\n\n", grp.Name)
+			continue
+		}
+		toDeploy = append(toDeploy, grp)
+	}
+
+	// groups deployed in parallel record their progress one at a time
+	var mu sync.Mutex
+	err = r.runGroups(toDeploy, groupDependencies(manifest), opts.Parallel,
+		func(r *runner, grp modulewriter.GroupManifest) error {
+			if err := r.deployGroup(deploymentDir, grp, opts.AutoApprove); err != nil {
+				return fmt.Errorf("failed to deploy group %s: %w", grp.Name, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			prog.Deployed = append(prog.Deployed, grp.Name)
+			return writeProgress(deploymentDir, prog)
+		})
+	if err != nil {
+		return fmt.Errorf("%w\n"+
+			"Once the problem is fixed, run \"ghpc deploy %s --resume\" to continue", err, deploymentDir)
+	}
+	if err := os.Remove(progressPath(deploymentDir)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (r *runner) deployGroup(deploymentDir string, grp modulewriter.GroupManifest, autoApprove bool) error {
+	logPath, closeLog, err := r.openLog(deploymentDir, grp.Name)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	r.printf("Deploying %s group %s (log: %s)\n", grp.Kind, grp.Name, logPath)
+
+	groupDir := filepath.Join(deploymentDir, grp.Name)
+	switch grp.Kind {
+	case "terraform":
+		if err := r.importImages(deploymentDir, grp); err != nil {
+			return err
+		}
+		if err := r.initTerraform(groupDir, autoApprove); err != nil {
+			return err
+		}
+		if err := r.terraform(groupDir, "validate"); err != nil {
+			return err
+		}
+		args := []string{"apply"}
+		if autoApprove {
+			args = append(args, "-auto-approve")
+		}
+		if err := r.terraform(groupDir, args...); err != nil {
+			return err
+		}
+	case "packer":
+		for _, mod := range grp.Modules {
+			modDir := filepath.Join(groupDir, mod.ID)
+			for _, subcommand := range []string{"init", "validate", "build"} {
+				if err := r.packer(modDir, subcommand, "."); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("deployment groups of kind %q are not supported", grp.Kind)
+	}
+	r.printf("Deployment group %s was deployed successfully\n\n", grp.Name)
+	return nil
+}
+
+// initTerraform initializes a Terraform group, first migrating its state if
+// its backend changed when the deployment was last written
+func (r *runner) initTerraform(groupDir string, autoApprove bool) error {
+	if !modulewriter.HasPendingMigration(groupDir) {
+		return r.terraform(groupDir, "init")
+	}
+	r.printf("Migrating the state of %s to its new backend\n", groupDir)
+	args := []string{"init", "-migrate-state"}
+	if autoApprove {
+		args = append(args, "-force-copy")
+	}
+	if err := r.terraform(groupDir, args...); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(groupDir, modulewriter.BackendMigrationFileName))
+}
+
+// importImages supplies the images built by Packer groups to a Terraform group
+func (r *runner) importImages(deploymentDir string, grp modulewriter.GroupManifest) error {
+	if len(grp.PackerImages) == 0 {
+		return nil
+	}
+	images, err := modulewriter.ImportPackerImages(deploymentDir, grp.Name)
+	if err != nil {
+		return err
+	}
+	for _, img := range grp.PackerImages {
+		r.printf("Using image %s built by %s/%s\n", images[img.Variable], img.Group, img.Module)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shell
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"hpc-toolkit/pkg/modulewriter"
+)
+
+const tfStateFileName = "terraform.tfstate"
+
+// DestroyOptions controls how the deployment groups of a deployment directory
+// are destroyed
+type DestroyOptions struct {
+	Binaries
+	// AutoApprove destroys Terraform resources without asking for approval
+	AutoApprove bool
+	// Stdin, Stdout and Stderr default to those of ghpc
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// tfState is the part of a Terraform state file that lists its resources
+// and outputs
+type tfState struct {
+	Resources []struct {
+		Mode      string            `json:"mode"`
+		Instances []json.RawMessage `json:"instances"`
+	} `json:"resources"`
+	Outputs tfOutputs `json:"outputs"`
+}
+
+func (state tfState) managedResources() int {
+	count := 0
+	for _, r := range state.Resources {
+		if r.Mode == "managed" {
+			count += len(r.Instances)
+		}
+	}
+	return count
+}
+
+// localResources counts the managed resources recorded in the local state of
+// a Terraform deployment group
+func localResources(groupDir string) (int, error) {
+	state, _, err := readTfState(groupDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return state.managedResources(), nil
+}
+
+// remainingResources describes the Terraform deployment groups that still
+// hold resources according to their local state
+func remainingResources(deploymentDir string, groups []modulewriter.GroupManifest) string {
+	var b strings.Builder
+	for _, grp := range groups {
+		if grp.Kind != "terraform" {
+			continue
+		}
+		if grp.TerraformBackend != nil {
+			fmt.Fprintf(&b, "  %s: unknown, its state is kept in a %s backend\n",
+				grp.Name, grp.TerraformBackend.Type)
+			continue
+		}
+		count, err := localResources(filepath.Join(deploymentDir, grp.Name))
+		switch {
+		case err != nil:
+			fmt.Fprintf(&b, "  %s: unknown, %v\n", grp.Name, err)
+		case count > 0:
+			fmt.Fprintf(&b, "  %s: %d resources\n", grp.Name, count)
+		}
+	}
+	if b.Len() == 0 {
+		return "No deployment group holds resources according to its local state."
+	}
+	return "Deployment groups that still hold resources according to their local state:\n" +
+		strings.TrimSuffix(b.String(), "\n")
+}
+
+// Destroy runs terraform destroy in each Terraform deployment group of a
+// deployment directory, after the groups that depend on it, and stops at the
+// first group that fails. Packer groups are skipped, as the images they built
+// are not tracked by Terraform.
+func Destroy(deploymentDir string, opts DestroyOptions) error {
+	manifest, err := modulewriter.ReadManifest(deploymentDir)
+	if err != nil {
+		return err
+	}
+
+	r := newRunner(opts.Binaries, opts.Stdin, opts.Stdout, opts.Stderr)
+	// groups that do not depend on each other are destroyed in the reverse
+	// order of deployment
+	groups := slices.Clone(manifest.DeploymentGroups)
+	for i, j := 0, len(groups)-1; i < j; i, j = i+1, j-1 {
+		groups[i], groups[j] = groups[j], groups[i]
+	}
+	destroyed := make(map[string]bool)
+	err = r.runGroups(groups, reverseDependencies(groupDependencies(manifest)), false,
+		func(r *runner, grp modulewriter.GroupManifest) error {
+			if grp.Kind == "packer" {
+				r.printf("Skipping Packer group %s: images built by Packer are not destroyed "+
+					"and must be deleted manually\n\n", grp.Name)
+				return nil
+			}
+			if err := r.destroyGroup(deploymentDir, grp, opts.AutoApprove); err != nil {
+				return fmt.Errorf("failed to destroy group %s: %w", grp.Name, err)
+			}
+			destroyed[grp.Name] = true
+			return nil
+		})
+	if err != nil {
+		var remaining []modulewriter.GroupManifest
+		for _, grp := range manifest.DeploymentGroups {
+			if !destroyed[grp.Name] {
+				remaining = append(remaining, grp)
+			}
+		}
+		return fmt.Errorf("%w\n%s", err, remainingResources(deploymentDir, remaining))
+	}
+	return nil
+}
+
+func (r *runner) destroyGroup(deploymentDir string, grp modulewriter.GroupManifest, autoApprove bool) error {
+	if grp.Kind != "terraform" {
+		return fmt.Errorf("deployment groups of kind %q are not supported", grp.Kind)
+	}
+	logPath, closeLog, err := r.openLog(deploymentDir, grp.Name+".destroy")
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	r.printf("Destroying terraform group %s (log: %s)\n", grp.Name, logPath)
+
+	groupDir := filepath.Join(deploymentDir, grp.Name)
+	// the images applied by the last deployment are destroyed with it, they
+	// are only imported again if the deployment did not get that far
+	if _, err := os.Stat(modulewriter.PackerImagesVarsPath(deploymentDir, grp.Name)); err != nil {
+		if err := r.importImages(deploymentDir, grp); err != nil {
+			return err
+		}
+	}
+	if err := r.initTerraform(groupDir, autoApprove); err != nil {
+		return err
+	}
+	args := []string{"destroy"}
+	if autoApprove {
+		args = append(args, "-auto-approve")
+	}
+	if err := r.terraform(groupDir, args...); err != nil {
+		return err
+	}
+	r.printf("Deployment group %s was destroyed successfully\n\n", grp.Name)
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shell
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"hpc-toolkit/pkg/modulewriter"
+)
+
+// OutputsOptions configure the collection of the outputs of a deployment
+type OutputsOptions struct {
+	Binaries
+	// Stdin, Stdout and Stderr default to those of ghpc
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// DeploymentOutput is the value of an output of the deployment
+type DeploymentOutput struct {
+	Name  string `json:"-"`
+	Group string `json:"group"`
+	// Applied reports whether the group of the output was applied
+	Applied   bool            `json:"applied"`
+	Sensitive bool            `json:"sensitive"`
+	Value     json.RawMessage `json:"value,omitempty"`
+}
+
+// tfOutputs are the outputs of a group as recorded in the Terraform state and
+// printed by terraform output -json
+type tfOutputs map[string]struct {
+	Value     json.RawMessage `json:"value"`
+	Sensitive bool            `json:"sensitive"`
+}
+
+// DeploymentOutputs collects the outputs of a deployment from the deployment
+// groups they are written to, in the order of the blueprint. Outputs of groups
+// with a local backend are read from the local state, the others are read by
+// terraform output.
+func DeploymentOutputs(deploymentDir string, opts OutputsOptions) ([]DeploymentOutput, error) {
+	manifest, err := modulewriter.ReadManifest(deploymentDir)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newRunner(opts.Binaries, opts.Stdin, opts.Stdout, opts.Stderr)
+	outputs := []DeploymentOutput{}
+	for _, grp := range manifest.DeploymentGroups {
+		if len(grp.Outputs) == 0 {
+			continue
+		}
+		values, err := r.groupOutputs(filepath.Join(deploymentDir, grp.Name), grp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the outputs of deployment group %s: %w", grp.Name, err)
+		}
+		for _, name := range grp.Outputs {
+			out := DeploymentOutput{Name: name, Group: grp.Name}
+			if v, ok := values[name]; ok {
+				out.Applied, out.Sensitive, out.Value = true, v.Sensitive, v.Value
+			}
+			outputs = append(outputs, out)
+		}
+	}
+	return outputs, nil
+}
+
+func (r *runner) groupOutputs(groupDir string, grp modulewriter.GroupManifest) (tfOutputs, error) {
+	// until it is migrated, the state is kept in the previous backend of the
+	// group, which is only known if it kept its state locally
+	migrating := modulewriter.HasPendingMigration(groupDir)
+	if grp.TerraformBackend == nil || migrating {
+		state, _, err := readTfState(groupDir)
+		if errors.Is(err, fs.ErrNotExist) {
+			if migrating {
+				r.printf("The outputs of deployment group %s are unknown until its state is "+
+					"migrated to its new backend by ghpc deploy\n", grp.Name)
+			}
+			return tfOutputs{}, nil
+		}
+		return state.Outputs, err
+	}
+
+	// groups that were deployed are already initialized with their backend
+	if _, err := os.Stat(filepath.Join(groupDir, ".terraform", tfStateFileName)); err != nil {
+		if err := r.terraform(groupDir, "init", "-input=false"); err != nil {
+			return nil, err
+		}
+	}
+	b, err := r.terraformOutput(groupDir, "output", "-json")
+	if err != nil {
+		return nil, err
+	}
+	var values tfOutputs
+	if err := json.Unmarshal(b, &values); err != nil {
+		return nil, fmt.Errorf("failed to parse the output of terraform output: %w", err)
+	}
+	return values, nil
+}
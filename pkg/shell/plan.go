@@ -0,0 +1,280 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shell
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"hpc-toolkit/pkg/modulewriter"
+)
+
+const (
+	planDirName = "plans"
+	// rootModuleID identifies resources that are not in a module of the group
+	rootModuleID = "(root)"
+)
+
+// PlanOptions controls how the deployment groups of a deployment directory
+// are planned
+type PlanOptions struct {
+	Binaries
+	// Stdin, Stdout and Stderr default to those of ghpc
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// PlanReport combines the Terraform plans of the deployment groups of a
+// deployment directory
+type PlanReport struct {
+	Deployment string      `json:"deployment"`
+	Groups     []GroupPlan `json:"groups"`
+	PlanChanges
+}
+
+// PlanChanges counts the resources that a plan adds, changes and destroys.
+// A replaced resource is both added and destroyed.
+type PlanChanges struct {
+	Add     int `json:"add"`
+	Change  int `json:"change"`
+	Destroy int `json:"destroy"`
+}
+
+func (c *PlanChanges) count(actions []string) {
+	for _, action := range actions {
+		switch action {
+		case "create":
+			c.Add++
+		case "update":
+			c.Change++
+		case "delete":
+			c.Destroy++
+		}
+	}
+}
+
+func (c PlanChanges) String() string {
+	return fmt.Sprintf("%d to add, %d to change, %d to destroy", c.Add, c.Change, c.Destroy)
+}
+
+// GroupPlan summarizes the plan of a deployment group per module. Packer
+// groups are not planned, nor are Terraform groups whose state must first be
+// migrated to a new backend.
+type GroupPlan struct {
+	Name     string       `json:"name"`
+	Kind     string       `json:"kind"`
+	PlanFile string       `json:"plan_file,omitempty"`
+	Modules  []ModulePlan `json:"modules"`
+	// BackendMigration reports that the state of the group will be migrated
+	// to its new backend when it is deployed
+	BackendMigration bool `json:"backend_migration,omitempty"`
+	PlanChanges
+}
+
+// ModulePlan summarizes the changes to the resources of a module. Resources
+// that are destroyed or replaced are listed as destructive changes.
+type ModulePlan struct {
+	ID          string           `json:"id"`
+	Destructive []ResourceChange `json:"destructive,omitempty"`
+	PlanChanges
+}
+
+// ResourceChange is a change to a resource in a Terraform plan
+type ResourceChange struct {
+	Address string   `json:"address"`
+	Actions []string `json:"actions"`
+}
+
+// tfPlan is the part of the JSON representation of a Terraform plan that
+// lists the changes to resources
+type tfPlan struct {
+	ResourceChanges []struct {
+		Address       string `json:"address"`
+		ModuleAddress string `json:"module_address"`
+		Change        struct {
+			Actions []string `json:"actions"`
+		} `json:"change"`
+	} `json:"resource_changes"`
+}
+
+// moduleID returns the ID of the module of the group that holds a resource,
+// given the address of the module of the resource
+func moduleID(moduleAddress string) string {
+	if moduleAddress == "" {
+		return rootModuleID
+	}
+	id := strings.TrimPrefix(strings.SplitN(moduleAddress, ".module.", 2)[0], "module.")
+	// drop the index of modules with count or for_each
+	return strings.SplitN(id, "[", 2)[0]
+}
+
+// summarizePlan groups the changes of a Terraform plan by module, in the
+// order of the modules of the deployment group
+func summarizePlan(grp modulewriter.GroupManifest, planJSON []byte) (GroupPlan, error) {
+	var plan tfPlan
+	if err := json.Unmarshal(planJSON, &plan); err != nil {
+		return GroupPlan{}, fmt.Errorf("failed to parse plan of deployment group %s: %w", grp.Name, err)
+	}
+
+	summary := GroupPlan{Name: grp.Name, Kind: grp.Kind, Modules: []ModulePlan{}}
+	modules := make(map[string]*ModulePlan)
+	var order []string
+	for _, mod := range grp.Modules {
+		order = append(order, mod.ID)
+		modules[mod.ID] = &ModulePlan{ID: mod.ID}
+	}
+	for _, rc := range plan.ResourceChanges {
+		id := moduleID(rc.ModuleAddress)
+		mod, ok := modules[id]
+		if !ok {
+			mod = &ModulePlan{ID: id}
+			modules[id] = mod
+			order = append(order, id)
+		}
+		mod.count(rc.Change.Actions)
+		summary.count(rc.Change.Actions)
+		if slices.Contains(rc.Change.Actions, "delete") {
+			mod.Destructive = append(mod.Destructive,
+				ResourceChange{Address: rc.Address, Actions: rc.Change.Actions})
+		}
+	}
+	for _, id := range order {
+		summary.Modules = append(summary.Modules, *modules[id])
+	}
+	return summary, nil
+}
+
+// Plan runs terraform plan in each Terraform deployment group of a deployment
+// directory, in the order they are deployed, and combines the changes of every group into a report.
+// The plans are saved in the .ghpc directory. It stops at the first group that
+// fails. Groups with a pending backend migration are reported without a plan.
+func Plan(deploymentDir string, opts PlanOptions) (PlanReport, error) {
+	report := PlanReport{Groups: []GroupPlan{}}
+	manifest, err := modulewriter.ReadManifest(deploymentDir)
+	if err != nil {
+		return report, err
+	}
+	report.Deployment = manifest.DeploymentName
+
+	planDir, err := filepath.Abs(filepath.Join(modulewriter.HiddenGhpcDir(deploymentDir), planDirName))
+	if err != nil {
+		return report, err
+	}
+	if err := os.MkdirAll(planDir, 0755); err != nil {
+		return report, err
+	}
+
+	r := newRunner(opts.Binaries, opts.Stdin, opts.Stdout, opts.Stderr)
+	err = r.runGroups(manifest.DeploymentGroups, groupDependencies(manifest), false,
+		func(r *runner, grp modulewriter.GroupManifest) error {
+			if grp.Kind == "packer" {
+				r.printf("Skipping Packer group %s: Packer builds cannot be planned\n\n", grp.Name)
+				report.Groups = append(report.Groups,
+					GroupPlan{Name: grp.Name, Kind: grp.Kind, Modules: []ModulePlan{}})
+				return nil
+			}
+			if modulewriter.HasPendingMigration(filepath.Join(deploymentDir, grp.Name)) {
+				// migrating the state is a change of its own, which plan must not make
+				r.printf("Skipping terraform group %s: its state will be migrated to its new backend "+
+					"when it is deployed, it can only be planned afterwards\n\n", grp.Name)
+				report.Groups = append(report.Groups,
+					GroupPlan{Name: grp.Name, Kind: grp.Kind, Modules: []ModulePlan{}, BackendMigration: true})
+				return nil
+			}
+			summary, err := r.planGroup(deploymentDir, grp, filepath.Join(planDir, grp.Name+".tfplan"))
+			if err != nil {
+				return fmt.Errorf("failed to plan group %s: %w", grp.Name, err)
+			}
+			report.Groups = append(report.Groups, summary)
+			report.Add += summary.Add
+			report.Change += summary.Change
+			report.Destroy += summary.Destroy
+			return nil
+		})
+	return report, err
+}
+
+func (r *runner) planGroup(deploymentDir string, grp modulewriter.GroupManifest, planFile string) (GroupPlan, error) {
+	if grp.Kind != "terraform" {
+		return GroupPlan{}, fmt.Errorf("deployment groups of kind %q are not supported", grp.Kind)
+	}
+	logPath, closeLog, err := r.openLog(deploymentDir, grp.Name+".plan")
+	if err != nil {
+		return GroupPlan{}, err
+	}
+	defer closeLog()
+	r.printf("Planning terraform group %s (log: %s)\n", grp.Name, logPath)
+
+	groupDir := filepath.Join(deploymentDir, grp.Name)
+	if err := r.importImages(deploymentDir, grp); err != nil {
+		return GroupPlan{}, err
+	}
+	if err := r.terraform(groupDir, "init", "-input=false"); err != nil {
+		return GroupPlan{}, err
+	}
+	if err := r.terraform(groupDir, "plan", "-input=false", "-out="+planFile); err != nil {
+		return GroupPlan{}, err
+	}
+	planJSON, err := r.terraformOutput(groupDir, "show", "-json", planFile)
+	if err != nil {
+		return GroupPlan{}, err
+	}
+	summary, err := summarizePlan(grp, planJSON)
+	summary.PlanFile = planFile
+	r.printf("\n")
+	return summary, err
+}
+
+// String renders the report for humans. Destroyed and replaced resources are
+// highlighted.
+func (report PlanReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Plan of deployment %s\n", report.Deployment)
+	destructive := 0
+	for _, grp := range report.Groups {
+		if grp.Kind == "packer" {
+			fmt.Fprintf(&b, "\nGroup %s: Packer group, not planned\n", grp.Name)
+			continue
+		}
+		if grp.BackendMigration {
+			fmt.Fprintf(&b, "\nGroup %s: state will be migrated to a new backend, not planned\n", grp.Name)
+			continue
+		}
+		fmt.Fprintf(&b, "\nGroup %s: %s\n", grp.Name, grp.PlanChanges)
+		for _, mod := range grp.Modules {
+			fmt.Fprintf(&b, "  %s: %s\n", mod.ID, mod.PlanChanges)
+			for _, rc := range mod.Destructive {
+				verb := "destroyed"
+				if len(rc.Actions) > 1 {
+					verb = "replaced"
+				}
+				fmt.Fprintf(&b, "    ! %s will be %s\n", rc.Address, verb)
+				destructive++
+			}
+		}
+	}
+	fmt.Fprintf(&b, "\nTotal: %s\n", report.PlanChanges)
+	if destructive > 0 {
+		fmt.Fprintf(&b, "WARNING: %d resources will be destroyed or replaced\n", destructive)
+	}
+	return b.String()
+}
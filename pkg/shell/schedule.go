@@ -0,0 +1,197 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shell
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/slices"
+
+	"hpc-toolkit/pkg/modulewriter"
+)
+
+// groupDependencies returns the names of the groups that each deployment
+// group of a manifest depends on. Manifests in which no group records its
+// dependencies were written before groups could depend on each other, and each
+// of their groups depends on the group before it.
+func groupDependencies(manifest modulewriter.Manifest) map[string][]string {
+	deps := make(map[string][]string)
+	ordered := !slices.ContainsFunc(manifest.DeploymentGroups, func(g modulewriter.GroupManifest) bool {
+		return g.DependsOn != nil
+	})
+	for i, grp := range manifest.DeploymentGroups {
+		switch {
+		case !ordered:
+			deps[grp.Name] = grp.DependsOn
+		case i > 0:
+			deps[grp.Name] = []string{manifest.DeploymentGroups[i-1].Name}
+		}
+	}
+	return deps
+}
+
+// reverseDependencies returns the names of the groups that depend on each
+// deployment group, which must be destroyed before it
+func reverseDependencies(deps map[string][]string) map[string][]string {
+	reverse := make(map[string][]string)
+	for grp, grpDeps := range deps {
+		for _, dep := range grpDeps {
+			reverse[dep] = append(reverse[dep], grp)
+		}
+	}
+	for _, dependents := range reverse {
+		slices.Sort(dependents)
+	}
+	return reverse
+}
+
+// prefixWriter writes whole lines to a writer shared by concurrent commands,
+// prefixed with the name of the deployment group that ran them
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if _, err := fmt.Fprintf(p.w, "%s%s", p.prefix, p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// flush writes the last line if it was not terminated
+func (p *prefixWriter) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) > 0 {
+		fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.buf)
+		p.buf = nil
+	}
+}
+
+// forGroup returns a runner for a deployment group that runs at the same time
+// as others. Its output is prefixed with the name of the group and it cannot
+// read from stdin. The returned function flushes its output.
+func (r *runner) forGroup(mu *sync.Mutex, name string) (*runner, func()) {
+	prefix := fmt.Sprintf("[%s] ", name)
+	stdout := &prefixWriter{mu: mu, w: r.stdout, prefix: prefix}
+	stderr := &prefixWriter{mu: mu, w: r.stderr, prefix: prefix}
+	return newRunner(r.bin, strings.NewReader(""), stdout, stderr), func() {
+		stdout.flush()
+		stderr.flush()
+	}
+}
+
+// runGroups runs a function for each deployment group once the groups it
+// depends on have completed. Dependencies on groups that are not run are
+// ignored. Groups run one at a time, in the order they are given, unless
+// parallel is set, in which case all the groups whose dependencies completed
+// run at the same time. No group is started after one fails, and the error of
+// the first group that failed is returned once the others complete.
+func (r *runner) runGroups(
+	groups []modulewriter.GroupManifest,
+	deps map[string][]string,
+	parallel bool,
+	run func(*runner, modulewriter.GroupManifest) error,
+) error {
+	pending := slices.Clone(groups)
+	selected := make(map[string]bool)
+	for _, grp := range groups {
+		selected[grp.Name] = true
+	}
+	done := make(map[string]bool)
+	ready := func(grp modulewriter.GroupManifest) bool {
+		return !slices.ContainsFunc(deps[grp.Name], func(dep string) bool { return selected[dep] && !done[dep] })
+	}
+	cycle := func() error {
+		names := []string{}
+		for _, grp := range pending {
+			names = append(names, grp.Name)
+		}
+		return fmt.Errorf("deployment groups %s depend on each other in a cycle", strings.Join(names, ", "))
+	}
+
+	if !parallel {
+		for len(pending) > 0 {
+			i := slices.IndexFunc(pending, ready)
+			if i < 0 {
+				return cycle()
+			}
+			grp := pending[i]
+			pending = slices.Delete(pending, i, i+1)
+			if err := run(r, grp); err != nil {
+				return err
+			}
+			done[grp.Name] = true
+		}
+		return nil
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result)
+	var mu sync.Mutex
+	running := 0
+	var firstErr error
+	for {
+		for i := 0; firstErr == nil && i < len(pending); {
+			if !ready(pending[i]) {
+				i++
+				continue
+			}
+			grp := pending[i]
+			pending = slices.Delete(pending, i, i+1)
+			grpRunner, flush := r.forGroup(&mu, grp.Name)
+			running++
+			go func() {
+				err := run(grpRunner, grp)
+				flush()
+				results <- result{name: grp.Name, err: err}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+		res := <-results
+		running--
+		switch {
+		case res.err == nil:
+			done[res.name] = true
+		case firstErr == nil:
+			firstErr = res.err
+		}
+	}
+	if firstErr == nil && len(pending) > 0 {
+		return cycle()
+	}
+	return firstErr
+}
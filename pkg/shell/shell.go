@@ -0,0 +1,140 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shell runs Terraform and Packer in the deployment groups of a
+// deployment directory
+package shell
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"hpc-toolkit/pkg/modulewriter"
+)
+
+const logDirName = "logs"
+
+// Binaries are the Terraform and Packer executables run in deployment groups.
+// Names without a path separator are looked up in the PATH.
+type Binaries struct {
+	Terraform string
+	Packer    string
+}
+
+// DefaultBinaries runs the terraform and packer executables found in the PATH
+var DefaultBinaries = Binaries{Terraform: "terraform", Packer: "packer"}
+
+// resolveBinary returns the absolute path of an executable, so that it can be
+// run from the directory of any deployment group
+func resolveBinary(name string) (string, error) {
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("executable %s was not found: %w", name, err)
+	}
+	return filepath.Abs(p)
+}
+
+// runner runs commands in the deployment groups of a deployment directory,
+// streaming their output to the console and to the log of the group
+type runner struct {
+	bin    Binaries
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	log    io.Writer
+}
+
+func newRunner(bin Binaries, stdin io.Reader, stdout io.Writer, stderr io.Writer) *runner {
+	if stdin == nil {
+		stdin = os.Stdin
+	}
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	return &runner{bin: bin, stdin: stdin, stdout: stdout, stderr: stderr, log: io.Discard}
+}
+
+// openLog directs the output of the following commands to a new log file for
+// a deployment group in the .ghpc directory. The returned function closes it.
+func (r *runner) openLog(deploymentDir string, name string) (string, func(), error) {
+	logDir := filepath.Join(modulewriter.HiddenGhpcDir(deploymentDir), logDirName)
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return "", nil, err
+	}
+	logPath := filepath.Join(logDir, name+".log")
+	f, err := os.Create(logPath)
+	if err != nil {
+		return "", nil, err
+	}
+	r.log = f
+	return logPath, func() {
+		r.log = io.Discard
+		f.Close()
+	}, nil
+}
+
+// printf writes a message to the console and to the log
+func (r *runner) printf(format string, a ...interface{}) {
+	fmt.Fprintf(io.MultiWriter(r.stdout, r.log), format, a...)
+}
+
+// run runs an executable in a directory and waits for it to complete
+func (r *runner) run(dir string, name string, args ...string) error {
+	return r.runWithOutput(io.MultiWriter(r.stdout, r.log), dir, name, args...)
+}
+
+// output runs an executable in a directory and returns its standard output,
+// which is not streamed
+func (r *runner) output(dir string, name string, args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	err := r.runWithOutput(&stdout, dir, name, args...)
+	return stdout.Bytes(), err
+}
+
+func (r *runner) runWithOutput(stdout io.Writer, dir string, name string, args ...string) error {
+	path, err := resolveBinary(name)
+	if err != nil {
+		return err
+	}
+	r.printf("+ %s %s\n", name, strings.Join(args, " "))
+	cmd := exec.Command(path, args...)
+	cmd.Dir = dir
+	cmd.Stdin = r.stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = io.MultiWriter(r.stderr, r.log)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("\"%s %s\" failed in %s: %w", name, strings.Join(args, " "), dir, err)
+	}
+	return nil
+}
+
+func (r *runner) terraform(dir string, args ...string) error {
+	return r.run(dir, r.bin.Terraform, args...)
+}
+
+func (r *runner) terraformOutput(dir string, args ...string) ([]byte, error) {
+	return r.output(dir, r.bin.Terraform, args...)
+}
+
+func (r *runner) packer(dir string, args ...string) error {
+	return r.run(dir, r.bin.Packer, args...)
+}
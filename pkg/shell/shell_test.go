@@ -0,0 +1,643 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shell
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"hpc-toolkit/pkg/config"
+	"hpc-toolkit/pkg/modulewriter"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeBinary records how it was run, fails in the directory named by
+// $FAKE_FAIL_IN and prints the plan or outputs in $FAKE_PLANS named after the
+// directory
+const fakeBinary = `#!/bin/sh
+echo "$(basename "$0") $(basename "$PWD") $*" >> "$FAKE_LOG"
+if [ "$(basename "$PWD")" = "$FAKE_FAIL_IN" ]; then
+  echo "failed in $FAKE_FAIL_IN" >&2
+  exit 1
+fi
+if [ "$1" = show ] || [ "$1" = output ]; then
+  cat "$FAKE_PLANS/$(basename "$PWD").json"
+  exit 0
+fi
+echo "ran $*"
+`
+
+var testDir string
+
+// Setup GoCheck
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func setup() {
+	t := time.Now()
+	dirName := fmt.Sprintf("ghpc_shell_test_%s", t.Format(time.RFC3339))
+	dir, err := ioutil.TempDir("", dirName)
+	if err != nil {
+		log.Fatalf("shell_test: %v", err)
+	}
+	testDir = dir
+}
+
+func teardown() {
+	os.RemoveAll(testDir)
+}
+
+func TestMain(m *testing.M) {
+	setup()
+	code := m.Run()
+	teardown()
+	os.Exit(code)
+}
+
+// setupDeployment creates a deployment directory with a manifest and fake
+// terraform and packer executables
+func setupDeployment(c *C, name string) (string, Binaries, string) {
+	depDir := filepath.Join(testDir, name)
+	manifest := modulewriter.Manifest{
+		CreatedAt:      time.Now().UTC(),
+		DeploymentName: name,
+		DeploymentGroups: []modulewriter.GroupManifest{
+			{Name: "network", Kind: "terraform"},
+			{Name: "image", Kind: "packer", Modules: []modulewriter.ModuleManifest{{ID: "builder"}}},
+			{Name: "cluster", Kind: "terraform"},
+		},
+	}
+	for _, dir := range []string{".ghpc", "network", "image/builder", "cluster", "bin"} {
+		c.Assert(os.MkdirAll(filepath.Join(depDir, dir), 0755), IsNil)
+	}
+	writeManifest(c, depDir, manifest)
+
+	bin := Binaries{
+		Terraform: filepath.Join(depDir, "bin", "terraform"),
+		Packer:    filepath.Join(depDir, "bin", "packer"),
+	}
+	for _, b := range []string{bin.Terraform, bin.Packer} {
+		c.Assert(ioutil.WriteFile(b, []byte(fakeBinary), 0755), IsNil)
+	}
+	callLog := filepath.Join(depDir, "calls.log")
+	os.Setenv("FAKE_LOG", callLog)
+	os.Setenv("FAKE_FAIL_IN", "")
+	return depDir, bin, callLog
+}
+
+func writeManifest(c *C, depDir string, manifest modulewriter.Manifest) {
+	b, err := json.Marshal(manifest)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(depDir, ".ghpc", "manifest.json"), b, 0644), IsNil)
+}
+
+// readCalls returns the calls to fake executables since it was last called
+func readCalls(c *C, callLog string) []string {
+	b, err := ioutil.ReadFile(callLog)
+	c.Assert(err, IsNil)
+	c.Assert(os.Remove(callLog), IsNil)
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func (s *MySuite) TestDeploy(c *C) {
+	depDir, bin, callLog := setupDeployment(c, "test_deploy")
+	var stdout, stderr bytes.Buffer
+	opts := DeployOptions{Binaries: bin, AutoApprove: true, Stdout: &stdout, Stderr: &stderr}
+	c.Assert(Deploy(depDir, opts), IsNil)
+
+	c.Check(readCalls(c, callLog), DeepEquals, []string{
+		"terraform network init",
+		"terraform network validate",
+		"terraform network apply -auto-approve",
+		"packer builder init .",
+		"packer builder validate .",
+		"packer builder build .",
+		"terraform cluster init",
+		"terraform cluster validate",
+		"terraform cluster apply -auto-approve",
+	})
+	c.Check(stdout.String(), Matches, "(?s)Deploying terraform group network.*ran apply -auto-approve.*")
+
+	// the output of each group is logged
+	groupLog, err := ioutil.ReadFile(filepath.Join(depDir, ".ghpc", logDirName, "image.log"))
+	c.Assert(err, IsNil)
+	c.Check(string(groupLog), Matches, "(?s).*\\+ .*packer build \\.\nran build \\.\n.*")
+
+	// no progress is kept after a successful run
+	_, err = os.Stat(progressPath(depDir))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *MySuite) TestDeploy_MigrateState(c *C) {
+	depDir, bin, callLog := setupDeployment(c, "test_deploy_migrate_state")
+	note := filepath.Join(depDir, "cluster", modulewriter.BackendMigrationFileName)
+	c.Assert(ioutil.WriteFile(note, []byte("migrate"), 0644), IsNil)
+
+	// Failure: the note is kept until the state was migrated
+	os.Setenv("FAKE_FAIL_IN", "cluster")
+	opts := DeployOptions{Binaries: bin, Groups: []string{"cluster"}, AutoApprove: true, Stdout: &bytes.Buffer{}}
+	c.Check(Deploy(depDir, opts), NotNil)
+	c.Check(readCalls(c, callLog), DeepEquals, []string{
+		"terraform cluster init -migrate-state -force-copy",
+	})
+	c.Check(modulewriter.HasPendingMigration(filepath.Join(depDir, "cluster")), Equals, true)
+
+	os.Setenv("FAKE_FAIL_IN", "")
+	c.Assert(Deploy(depDir, opts), IsNil)
+	c.Check(readCalls(c, callLog), DeepEquals, []string{
+		"terraform cluster init -migrate-state -force-copy",
+		"terraform cluster validate",
+		"terraform cluster apply -auto-approve",
+	})
+	c.Check(modulewriter.HasPendingMigration(filepath.Join(depDir, "cluster")), Equals, false)
+}
+
+func (s *MySuite) TestDeploy_Groups(c *C) {
+	depDir, bin, callLog := setupDeployment(c, "test_deploy_groups")
+	var stdout bytes.Buffer
+	opts := DeployOptions{Binaries: bin, Groups: []string{"cluster", "network"}, Stdout: &stdout}
+	c.Assert(Deploy(depDir, opts), IsNil)
+	c.Check(readCalls(c, callLog), DeepEquals, []string{
+		"terraform network init",
+		"terraform network validate",
+		"terraform network apply",
+		"terraform cluster init",
+		"terraform cluster validate",
+		"terraform cluster apply",
+	})
+
+	// Failure: unknown group
+	opts.Groups = []string{"storage"}
+	c.Check(Deploy(depDir, opts), ErrorMatches, "deployment group storage was not found.*")
+
+	// Failure: missing executable
+	opts.Groups = nil
+	opts.Terraform = filepath.Join(depDir, "bin", "not-terraform")
+	c.Check(Deploy(depDir, opts), ErrorMatches, "(?s)failed to deploy group network: executable .* was not found.*")
+}
+
+func (s *MySuite) TestDeploy_Resume(c *C) {
+	depDir, bin, callLog := setupDeployment(c, "test_deploy_resume")
+	var stdout, stderr bytes.Buffer
+	opts := DeployOptions{Binaries: bin, AutoApprove: true, Stdout: &stdout, Stderr: &stderr}
+
+	os.Setenv("FAKE_FAIL_IN", "cluster")
+	err := Deploy(depDir, opts)
+	c.Check(err, ErrorMatches, "(?s)failed to deploy group cluster: \".*terraform init\" failed.*--resume.*")
+	c.Check(stderr.String(), Equals, "failed in cluster\n")
+	readCalls(c, callLog)
+	prog, err := readProgress(depDir)
+	c.Assert(err, IsNil)
+	c.Check(prog.Deployed, DeepEquals, []string{"network", "image"})
+
+	// resuming only deploys the groups that were not deployed
+	os.Setenv("FAKE_FAIL_IN", "")
+	opts.Resume = true
+	c.Assert(Deploy(depDir, opts), IsNil)
+	c.Check(readCalls(c, callLog), DeepEquals, []string{
+		"terraform cluster init",
+		"terraform cluster validate",
+		"terraform cluster apply -auto-approve",
+	})
+	c.Check(stdout.String(), Matches, "(?s).*Skipping deployment group network.*")
+
+	// Failure: deployment overwritten after the failed run
+	os.Setenv("FAKE_FAIL_IN", "cluster")
+	opts.Resume = false
+	c.Assert(Deploy(depDir, opts), NotNil)
+	manifest, err := modulewriter.ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	manifest.CreatedAt = manifest.CreatedAt.Add(time.Minute)
+	writeManifest(c, depDir, manifest)
+	opts.Resume = true
+	c.Check(Deploy(depDir, opts), ErrorMatches, ".* was overwritten after the previous run.*")
+}
+
+func (s *MySuite) TestDeploy_Parallel(c *C) {
+	depDir, bin, callLog := setupDeployment(c, "test_deploy_parallel")
+	manifest, err := modulewriter.ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	manifest.DeploymentGroups = []modulewriter.GroupManifest{
+		{Name: "network", Kind: "terraform", DependsOn: []string{}},
+		{Name: "image-a", Kind: "packer", DependsOn: []string{"network"},
+			Modules: []modulewriter.ModuleManifest{{ID: "builder-a"}}},
+		{Name: "image-b", Kind: "packer", DependsOn: []string{"network"},
+			Modules: []modulewriter.ModuleManifest{{ID: "builder-b"}}},
+		{Name: "cluster", Kind: "terraform", DependsOn: []string{"image-a", "image-b"}},
+	}
+	writeManifest(c, depDir, manifest)
+	for _, dir := range []string{"image-a/builder-a", "image-b/builder-b"} {
+		c.Assert(os.MkdirAll(filepath.Join(depDir, dir), 0755), IsNil)
+	}
+
+	// the images are built at the same time, after the network is deployed
+	var stdout bytes.Buffer
+	opts := DeployOptions{Binaries: bin, AutoApprove: true, Parallel: true, Stdout: &stdout}
+	c.Assert(Deploy(depDir, opts), IsNil)
+	calls := readCalls(c, callLog)
+	c.Assert(calls, HasLen, 12)
+	c.Check(calls[:3], DeepEquals, []string{
+		"terraform network init",
+		"terraform network validate",
+		"terraform network apply -auto-approve",
+	})
+	images := slices.Clone(calls[3:9])
+	slices.Sort(images)
+	c.Check(images, DeepEquals, []string{
+		"packer builder-a build .",
+		"packer builder-a init .",
+		"packer builder-a validate .",
+		"packer builder-b build .",
+		"packer builder-b init .",
+		"packer builder-b validate .",
+	})
+	c.Check(calls[9:], DeepEquals, []string{
+		"terraform cluster init",
+		"terraform cluster validate",
+		"terraform cluster apply -auto-approve",
+	})
+	c.Check(stdout.String(), Matches, "(?s).*\\[image-a\\] Deploying packer group image-a.*")
+	c.Check(stdout.String(), Matches, "(?s).*\\[image-b\\] Deployment group image-b was deployed successfully.*")
+
+	// Failure: the groups that depend on a failed group are not deployed
+	os.Setenv("FAKE_FAIL_IN", "builder-a")
+	err = Deploy(depDir, opts)
+	c.Check(err, ErrorMatches, "(?s)failed to deploy group image-a: .*--resume.*")
+	c.Check(slices.Contains(readCalls(c, callLog), "terraform cluster init"), Equals, false)
+	prog, err := readProgress(depDir)
+	c.Assert(err, IsNil)
+	slices.Sort(prog.Deployed)
+	c.Check(prog.Deployed, DeepEquals, []string{"image-b", "network"})
+
+	// Failure: parallel groups cannot ask for approval
+	opts.AutoApprove = false
+	c.Check(Deploy(depDir, opts), ErrorMatches, ".*only be deployed in parallel with auto-approve")
+}
+
+func (s *MySuite) TestDestroy(c *C) {
+	depDir, bin, callLog := setupDeployment(c, "test_destroy")
+	var stdout, stderr bytes.Buffer
+	opts := DestroyOptions{Binaries: bin, AutoApprove: true, Stdout: &stdout, Stderr: &stderr}
+	c.Assert(Destroy(depDir, opts), IsNil)
+	c.Check(readCalls(c, callLog), DeepEquals, []string{
+		"terraform cluster init",
+		"terraform cluster destroy -auto-approve",
+		"terraform network init",
+		"terraform network destroy -auto-approve",
+	})
+	c.Check(stdout.String(), Matches, "(?s).*Skipping Packer group image.*")
+
+	// Failure: the groups left with resources are reported
+	state := `{"resources": [
+  {"mode": "managed", "type": "a", "instances": [{}, {}]},
+  {"mode": "data", "type": "b", "instances": [{}]}
+]}`
+	for _, grp := range []string{"network", "cluster"} {
+		c.Assert(ioutil.WriteFile(
+			filepath.Join(depDir, grp, tfStateFileName), []byte(state), 0644), IsNil)
+	}
+	os.Setenv("FAKE_FAIL_IN", "cluster")
+	err := Destroy(depDir, opts)
+	c.Check(err, ErrorMatches, "(?s)failed to destroy group cluster: .*\n"+
+		"Deployment groups that still hold resources according to their local state:\n"+
+		"  network: 2 resources\n  cluster: 2 resources")
+	c.Check(readCalls(c, callLog), DeepEquals, []string{"terraform cluster init"})
+
+	// groups are destroyed before the groups they depend on
+	os.Setenv("FAKE_FAIL_IN", "")
+	manifest, err := modulewriter.ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	manifest.DeploymentGroups = []modulewriter.GroupManifest{
+		{Name: "cluster", Kind: "terraform", DependsOn: []string{"network"}},
+		{Name: "network", Kind: "terraform", DependsOn: []string{}},
+	}
+	writeManifest(c, depDir, manifest)
+	c.Assert(Destroy(depDir, opts), IsNil)
+	c.Check(readCalls(c, callLog), DeepEquals, []string{
+		"terraform cluster init",
+		"terraform cluster destroy -auto-approve",
+		"terraform network init",
+		"terraform network destroy -auto-approve",
+	})
+
+	// groups are initialized as they are for deployment
+	manifest.DeploymentGroups = []modulewriter.GroupManifest{{
+		Name: "cluster", Kind: "terraform",
+		PackerImages: []modulewriter.PackerImageManifest{
+			{Group: "image", Module: "builder", Variable: "image_name_builder"},
+		},
+	}}
+	writeManifest(c, depDir, manifest)
+	packerManifest := `{"builds": [{"artifact_id": "img-1", "packer_run_uuid": "a"}], "last_run_uuid": "a"}`
+	c.Assert(ioutil.WriteFile(filepath.Join(depDir, "image", "builder", modulewriter.PackerManifestFileName),
+		[]byte(packerManifest), 0644), IsNil)
+	note := filepath.Join(depDir, "cluster", modulewriter.BackendMigrationFileName)
+	c.Assert(ioutil.WriteFile(note, []byte("migrate"), 0644), IsNil)
+	c.Assert(Destroy(depDir, opts), IsNil)
+	c.Check(readCalls(c, callLog), DeepEquals, []string{
+		"terraform cluster init -migrate-state -force-copy",
+		"terraform cluster destroy -auto-approve",
+	})
+	b, err := ioutil.ReadFile(modulewriter.PackerImagesVarsPath(depDir, "cluster"))
+	c.Assert(err, IsNil)
+	c.Check(string(b), Matches, `(?s).*"image_name_builder": "img-1".*`)
+	c.Check(modulewriter.HasPendingMigration(filepath.Join(depDir, "cluster")), Equals, false)
+}
+
+func (s *MySuite) TestDeploymentStatus(c *C) {
+	depDir, _, _ := setupDeployment(c, "test_deployment_status")
+	manifest, err := modulewriter.ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	manifest.DeploymentGroups = append(manifest.DeploymentGroups, modulewriter.GroupManifest{
+		Name: "remote", Kind: "terraform", TerraformBackend: &modulewriter.BackendManifest{Type: "gcs"},
+	})
+	manifest.CreatedAt = manifest.CreatedAt.Add(-time.Minute)
+	writeManifest(c, depDir, manifest)
+
+	// nothing applied yet
+	_, statuses, err := DeploymentStatus(depDir)
+	c.Assert(err, IsNil)
+	c.Assert(statuses, HasLen, 4)
+	for i, state := range []string{"not applied", "not applied", "not applied", "unknown"} {
+		c.Check(statuses[i].State(), Equals, state)
+	}
+
+	state := `{"resources": [{"mode": "managed", "type": "a", "instances": [{}]}],
+"outputs": {
+  "name": {"value": "net-1", "type": "string"},
+  "ids": {"value": [1, 2], "type": ["list", "number"]},
+  "secret": {"value": "hunter2", "type": "string", "sensitive": true}
+}}`
+	c.Assert(ioutil.WriteFile(
+		filepath.Join(depDir, "network", tfStateFileName), []byte(state), 0644), IsNil)
+	packerManifest := `{"builds": [{"artifact_id": "image-1", "packer_run_uuid": "run"}], "last_run_uuid": "run"}`
+	c.Assert(ioutil.WriteFile(filepath.Join(depDir, "image", "builder", modulewriter.PackerManifestFileName),
+		[]byte(packerManifest), 0644), IsNil)
+	// the cluster group was applied before the deployment was last written
+	c.Assert(ioutil.WriteFile(
+		filepath.Join(depDir, "cluster", tfStateFileName), []byte(state), 0644), IsNil)
+	past := manifest.CreatedAt.Add(-time.Hour)
+	c.Assert(os.Chtimes(filepath.Join(depDir, "cluster", tfStateFileName), past, past), IsNil)
+
+	_, statuses, err = DeploymentStatus(depDir)
+	c.Assert(err, IsNil)
+	network, image, cluster := statuses[0], statuses[1], statuses[2]
+	c.Check(network.State(), Equals, "applied")
+	c.Check(network.Resources, Equals, 1)
+	c.Check(network.Outputs, DeepEquals, map[string]string{
+		"name": `"net-1"`, "ids": "[1,2]", "secret": "(sensitive)",
+	})
+	c.Check(image.State(), Equals, "applied")
+	c.Check(image.Images, DeepEquals, map[string]string{"builder": "image-1"})
+	c.Check(cluster.State(), Equals, "outdated")
+	c.Check(cluster.LastApplied.Equal(past), Equals, true)
+}
+
+func (s *MySuite) TestDeploymentStatus_Overwrite(c *C) {
+	bp := config.Blueprint{
+		BlueprintName: "status",
+		Vars:          map[string]interface{}{"deployment_name": "test_status_overwrite", "project_id": "p"},
+		DeploymentGroups: []config.DeploymentGroup{
+			{Name: "network", Kind: "terraform", Modules: []config.Module{}},
+		},
+	}
+	c.Assert(modulewriter.WriteDeployment(&bp, testDir, modulewriter.WriteOptions{}), IsNil)
+	depDir := filepath.Join(testDir, "test_status_overwrite")
+	state := `{"resources": [{"mode": "managed", "type": "a", "instances": [{}]}]}`
+	c.Assert(ioutil.WriteFile(
+		filepath.Join(depDir, "network", tfStateFileName), []byte(state), 0644), IsNil)
+	_, statuses, err := DeploymentStatus(depDir)
+	c.Assert(err, IsNil)
+	c.Check(statuses[0].State(), Equals, "applied")
+
+	// the state carried into the regenerated group predates it
+	opts := modulewriter.WriteOptions{Overwrite: true}
+	c.Assert(modulewriter.WriteDeployment(&bp, testDir, opts), IsNil)
+	_, statuses, err = DeploymentStatus(depDir)
+	c.Assert(err, IsNil)
+	c.Check(statuses[0].State(), Equals, "outdated")
+	c.Check(statuses[0].Resources, Equals, 1)
+}
+
+func (s *MySuite) TestDeploymentOutputs(c *C) {
+	depDir, bin, callLog := setupDeployment(c, "test_deployment_outputs")
+	manifest, err := modulewriter.ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	manifest.DeploymentGroups[0].Outputs = []string{"network_name"}
+	manifest.DeploymentGroups[2].Outputs = []string{"login_ip", "password"}
+	manifest.DeploymentGroups[2].TerraformBackend = &modulewriter.BackendManifest{Type: "gcs"}
+	writeManifest(c, depDir, manifest)
+
+	plans := filepath.Join(depDir, "plans")
+	c.Assert(os.MkdirAll(plans, 0755), IsNil)
+	os.Setenv("FAKE_PLANS", plans)
+	c.Assert(ioutil.WriteFile(filepath.Join(plans, "cluster.json"), []byte(`{
+  "login_ip": {"value": "10.0.0.2", "type": "string", "sensitive": false},
+  "password": {"value": "hunter2", "type": "string", "sensitive": true}
+}`), 0644), IsNil)
+
+	// the local state of the network group is read, the cluster group has a
+	// remote backend
+	var stdout bytes.Buffer
+	outputs, err := DeploymentOutputs(depDir, OutputsOptions{Binaries: bin, Stdout: &stdout})
+	c.Assert(err, IsNil)
+	c.Check(readCalls(c, callLog), DeepEquals, []string{
+		"terraform cluster init -input=false",
+		"terraform cluster output -json",
+	})
+	c.Assert(outputs, HasLen, 3)
+	c.Check(outputs[0], DeepEquals, DeploymentOutput{Name: "network_name", Group: "network"})
+	c.Check(outputs[1].Name, Equals, "login_ip")
+	c.Check(outputs[1].Applied, Equals, true)
+	c.Check(string(outputs[1].Value), Equals, `"10.0.0.2"`)
+	c.Check(outputs[2].Sensitive, Equals, true)
+
+	state := `{"outputs": {"network_name": {"value": "net-1", "type": "string"}}}`
+	c.Assert(ioutil.WriteFile(
+		filepath.Join(depDir, "network", tfStateFileName), []byte(state), 0644), IsNil)
+	// the cluster group is already initialized with its backend
+	c.Assert(os.MkdirAll(filepath.Join(depDir, "cluster", ".terraform"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(
+		filepath.Join(depDir, "cluster", ".terraform", tfStateFileName), []byte("{}"), 0644), IsNil)
+	outputs, err = DeploymentOutputs(depDir, OutputsOptions{Binaries: bin, Stdout: &stdout})
+	c.Assert(err, IsNil)
+	c.Check(readCalls(c, callLog), DeepEquals, []string{"terraform cluster output -json"})
+	c.Check(outputs[0].Applied, Equals, true)
+	c.Check(string(outputs[0].Value), Equals, `"net-1"`)
+
+	// the state of a group with a pending migration is still in its previous
+	// backend, which is read if it is local
+	note := filepath.Join(depDir, "cluster", modulewriter.BackendMigrationFileName)
+	c.Assert(ioutil.WriteFile(note, []byte("migrate"), 0644), IsNil)
+	outputs, err = DeploymentOutputs(depDir, OutputsOptions{Binaries: bin, Stdout: &stdout})
+	c.Assert(err, IsNil)
+	c.Check(outputs[1].Applied, Equals, false)
+	c.Check(stdout.String(), Matches, "(?s).*outputs of deployment group cluster are unknown.*")
+	state = `{"outputs": {"login_ip": {"value": "10.0.0.3", "type": "string"}}}`
+	c.Assert(ioutil.WriteFile(
+		filepath.Join(depDir, "cluster", tfStateFileName), []byte(state), 0644), IsNil)
+	outputs, err = DeploymentOutputs(depDir, OutputsOptions{Binaries: bin, Stdout: &stdout})
+	c.Assert(err, IsNil)
+	c.Check(string(outputs[1].Value), Equals, `"10.0.0.3"`)
+	_, err = os.Stat(callLog)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *MySuite) TestModuleID(c *C) {
+	c.Check(moduleID(""), Equals, rootModuleID)
+	c.Check(moduleID("module.network1"), Equals, "network1")
+	c.Check(moduleID("module.slurm_controller.module.slurm_cluster"), Equals, "slurm_controller")
+	c.Check(moduleID(`module.nodes["a"].module.vm`), Equals, "nodes")
+}
+
+func (s *MySuite) TestGroupDependencies(c *C) {
+	// groups of older manifests depend on the group before them
+	manifest := modulewriter.Manifest{DeploymentGroups: []modulewriter.GroupManifest{
+		{Name: "network"}, {Name: "cluster"},
+	}}
+	c.Check(groupDependencies(manifest), DeepEquals, map[string][]string{
+		"cluster": {"network"},
+	})
+
+	// groups that depend on no other group are deployed independently
+	manifest.DeploymentGroups[0].DependsOn = []string{}
+	manifest.DeploymentGroups[1].DependsOn = []string{}
+	c.Check(groupDependencies(manifest), DeepEquals, map[string][]string{
+		"network": {}, "cluster": {},
+	})
+}
+
+func (s *MySuite) TestPlan(c *C) {
+	depDir, bin, callLog := setupDeployment(c, "test_plan")
+	manifest, err := modulewriter.ReadManifest(depDir)
+	c.Assert(err, IsNil)
+	manifest.DeploymentGroups[2].Modules = []modulewriter.ModuleManifest{{ID: "controller"}, {ID: "login"}}
+	writeManifest(c, depDir, manifest)
+
+	plans := filepath.Join(depDir, "plans")
+	c.Assert(os.MkdirAll(plans, 0755), IsNil)
+	os.Setenv("FAKE_PLANS", plans)
+	c.Assert(ioutil.WriteFile(filepath.Join(plans, "network.json"), []byte(`{"resource_changes": [
+  {"address": "module.vpc.google_compute_network.n", "module_address": "module.vpc",
+   "change": {"actions": ["no-op"]}}
+]}`), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(plans, "cluster.json"), []byte(`{"resource_changes": [
+  {"address": "module.controller.google_compute_instance.c", "module_address": "module.controller",
+   "change": {"actions": ["delete", "create"]}},
+  {"address": "module.controller.google_compute_disk.d", "module_address": "module.controller",
+   "change": {"actions": ["update"]}},
+  {"address": "module.login.module.vm.google_compute_instance.l", "module_address": "module.login.module.vm",
+   "change": {"actions": ["delete"]}},
+  {"address": "random_id.r", "change": {"actions": ["create"]}}
+]}`), 0644), IsNil)
+
+	var stdout bytes.Buffer
+	report, err := Plan(depDir, PlanOptions{Binaries: bin, Stdout: &stdout})
+	c.Assert(err, IsNil)
+
+	planDir := filepath.Join(depDir, ".ghpc", planDirName)
+	calls := readCalls(c, callLog)
+	c.Check(calls, HasLen, 6)
+	c.Check(calls[1], Equals, "terraform network plan -input=false -out="+filepath.Join(planDir, "network.tfplan"))
+	c.Check(calls[5], Equals, "terraform cluster show -json "+filepath.Join(planDir, "cluster.tfplan"))
+
+	c.Check(report.PlanChanges, Equals, PlanChanges{Add: 2, Change: 1, Destroy: 2})
+	c.Assert(report.Groups, HasLen, 3)
+	c.Check(report.Groups[1].Kind, Equals, "packer")
+	cluster := report.Groups[2]
+	c.Check(cluster.PlanChanges, Equals, PlanChanges{Add: 2, Change: 1, Destroy: 2})
+	c.Check(cluster.Modules, DeepEquals, []ModulePlan{
+		{
+			ID: "controller",
+			Destructive: []ResourceChange{{
+				Address: "module.controller.google_compute_instance.c",
+				Actions: []string{"delete", "create"},
+			}},
+			PlanChanges: PlanChanges{Add: 1, Change: 1, Destroy: 1},
+		},
+		{
+			ID: "login",
+			Destructive: []ResourceChange{{
+				Address: "module.login.module.vm.google_compute_instance.l",
+				Actions: []string{"delete"},
+			}},
+			PlanChanges: PlanChanges{Destroy: 1},
+		},
+		{ID: rootModuleID, PlanChanges: PlanChanges{Add: 1}},
+	})
+
+	c.Check(report.String(), Equals, `Plan of deployment test_plan
+
+Group network: 0 to add, 0 to change, 0 to destroy
+  vpc: 0 to add, 0 to change, 0 to destroy
+
+Group image: Packer group, not planned
+
+Group cluster: 2 to add, 1 to change, 2 to destroy
+  controller: 1 to add, 1 to change, 1 to destroy
+    ! module.controller.google_compute_instance.c will be replaced
+  login: 0 to add, 0 to change, 1 to destroy
+    ! module.login.module.vm.google_compute_instance.l will be destroyed
+  (root): 1 to add, 0 to change, 0 to destroy
+
+Total: 2 to add, 1 to change, 2 to destroy
+WARNING: 2 resources will be destroyed or replaced
+`)
+
+	// groups whose state must first be migrated are not planned
+	note := filepath.Join(depDir, "cluster", modulewriter.BackendMigrationFileName)
+	c.Assert(ioutil.WriteFile(note, []byte("migrate"), 0644), IsNil)
+	report, err = Plan(depDir, PlanOptions{Binaries: bin, Stdout: &stdout})
+	c.Assert(err, IsNil)
+	c.Check(readCalls(c, callLog), HasLen, 3)
+	c.Check(report.Groups[2].BackendMigration, Equals, true)
+	c.Check(report.PlanChanges, Equals, PlanChanges{})
+	c.Check(report.String(), Matches,
+		"(?s).*Group cluster: state will be migrated to a new backend, not planned\n.*")
+	c.Assert(os.Remove(note), IsNil)
+
+	// groups are planned in the order they are deployed
+	manifest.DeploymentGroups = []modulewriter.GroupManifest{
+		{Name: "network", Kind: "terraform", DependsOn: []string{"cluster"}},
+		{Name: "cluster", Kind: "terraform", DependsOn: []string{}},
+	}
+	writeManifest(c, depDir, manifest)
+	report, err = Plan(depDir, PlanOptions{Binaries: bin, Stdout: &stdout})
+	c.Assert(err, IsNil)
+	c.Check(readCalls(c, callLog)[0], Equals, "terraform cluster init -input=false")
+	c.Check(report.Groups[0].Name, Equals, "cluster")
+
+	// Failure: plan of a group fails
+	os.Setenv("FAKE_FAIL_IN", "cluster")
+	_, err = Plan(depDir, PlanOptions{Binaries: bin, Stdout: &stdout, Stderr: &stdout})
+	c.Check(err, ErrorMatches, "failed to plan group cluster: .*")
+	os.Setenv("FAKE_FAIL_IN", "")
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shell
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"hpc-toolkit/pkg/modulewriter"
+)
+
+// GroupStatus summarizes the state of a deployment group
+type GroupStatus struct {
+	Name string
+	Kind string
+	// Backend is the type of the remote Terraform backend of the group, whose
+	// state cannot be inspected locally
+	Backend string
+	// Applied reports whether the group was applied, or its images built
+	Applied bool
+	// LastApplied is when the local state or Packer manifest was last written
+	LastApplied time.Time
+	// Outdated reports whether the deployment was written after the group
+	// was last applied
+	Outdated bool
+	// Resources is the number of managed resources in the local state
+	Resources int
+	// Outputs are the output values in the local state, in JSON. Sensitive
+	// values are hidden.
+	Outputs map[string]string
+	// Images are the images last built by each module of a Packer group
+	Images map[string]string
+}
+
+// State describes the progress of the deployment group in a word
+func (s GroupStatus) State() string {
+	switch {
+	case s.Backend != "":
+		return "unknown"
+	case !s.Applied:
+		return "not applied"
+	case s.Outdated:
+		return "outdated"
+	default:
+		return "applied"
+	}
+}
+
+func readTfState(groupDir string) (tfState, time.Time, error) {
+	var state tfState
+	statePath := filepath.Join(groupDir, tfStateFileName)
+	info, err := os.Stat(statePath)
+	if err != nil {
+		return state, time.Time{}, err
+	}
+	b, err := os.ReadFile(statePath)
+	if err != nil {
+		return state, time.Time{}, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return state, time.Time{}, fmt.Errorf("failed to parse %s: %w", statePath, err)
+	}
+	return state, info.ModTime(), nil
+}
+
+func terraformStatus(groupDir string, status *GroupStatus) error {
+	state, modTime, err := readTfState(groupDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	status.Resources = state.managedResources()
+	status.Applied = status.Resources > 0 || len(state.Outputs) > 0
+	status.LastApplied = modTime
+	status.Outputs = make(map[string]string)
+	for name, output := range state.Outputs {
+		if output.Sensitive {
+			status.Outputs[name] = "(sensitive)"
+			continue
+		}
+		var value bytes.Buffer
+		if err := json.Compact(&value, output.Value); err != nil {
+			return err
+		}
+		status.Outputs[name] = value.String()
+	}
+	return nil
+}
+
+func packerStatus(groupDir string, grp modulewriter.GroupManifest, status *GroupStatus) error {
+	status.Images = make(map[string]string)
+	status.Applied = len(grp.Modules) > 0
+	for _, mod := range grp.Modules {
+		manifestPath := filepath.Join(groupDir, mod.ID, modulewriter.PackerManifestFileName)
+		info, err := os.Stat(manifestPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			status.Applied = false
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		image, err := modulewriter.ReadPackerImage(filepath.Dir(groupDir), grp.Name, mod.ID)
+		if err != nil {
+			return err
+		}
+		status.Images[mod.ID] = image
+		if info.ModTime().After(status.LastApplied) {
+			status.LastApplied = info.ModTime()
+		}
+	}
+	return nil
+}
+
+// DeploymentStatus inspects the local state of each deployment group of a
+// deployment directory
+func DeploymentStatus(deploymentDir string) (modulewriter.Manifest, []GroupStatus, error) {
+	manifest, err := modulewriter.ReadManifest(deploymentDir)
+	if err != nil {
+		return manifest, nil, err
+	}
+
+	statuses := []GroupStatus{}
+	for _, grp := range manifest.DeploymentGroups {
+		status := GroupStatus{Name: grp.Name, Kind: grp.Kind}
+		groupDir := filepath.Join(deploymentDir, grp.Name)
+		switch {
+		case grp.Kind == "packer":
+			err = packerStatus(groupDir, grp, &status)
+		case grp.TerraformBackend != nil:
+			status.Backend = grp.TerraformBackend.Type
+		default:
+			err = terraformStatus(groupDir, &status)
+		}
+		if err != nil {
+			return manifest, nil, fmt.Errorf("failed to inspect deployment group %s: %w", grp.Name, err)
+		}
+		status.Outdated = status.Applied && status.LastApplied.Before(manifest.CreatedAt)
+		statuses = append(statuses, status)
+	}
+	return manifest, statuses, nil
+}
@@ -20,8 +20,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/go-git/go-git/v5"
 	"github.com/hashicorp/go-getter"
 )
 
@@ -39,6 +41,45 @@ var goGetterDecompressors = map[string]getter.Decompressor{}
 // GitSourceReader reads modules from a git repository
 type GitSourceReader struct{}
 
+// gitClones holds the repositories cloned by this run of ghpc, indexed by
+// their source without subdirectory, so that reading a module and recording
+// its commit share a single clone
+var gitClones = struct {
+	sync.Mutex
+	dirs map[string]string
+}{dirs: make(map[string]string)}
+
+// cloneGitRepo clones the repository of a git source without subdirectory, or
+// returns the clone made earlier in this run
+func cloneGitRepo(repoSrc string) (string, error) {
+	gitClones.Lock()
+	defer gitClones.Unlock()
+	if dir, ok := gitClones.dirs[repoSrc]; ok {
+		return dir, nil
+	}
+	tmpDir, err := ioutil.TempDir("", "git-repo-*")
+	if err != nil {
+		return "", err
+	}
+	repoDir := filepath.Join(tmpDir, "repo")
+	if err := copyGitModules(repoSrc, repoDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	gitClones.dirs[repoSrc] = repoDir
+	return repoDir, nil
+}
+
+// RemoveGitClones removes the repositories cloned by this run of ghpc
+func RemoveGitClones() {
+	gitClones.Lock()
+	defer gitClones.Unlock()
+	for repoSrc, dir := range gitClones.dirs {
+		os.RemoveAll(filepath.Dir(dir))
+		delete(gitClones.dirs, repoSrc)
+	}
+}
+
 func copyGitModules(srcPath string, destPath string) error {
 	client := getter.Client{
 		Src: srcPath,
@@ -62,17 +103,37 @@ func (r GitSourceReader) GetModule(modPath string, copyPath string) error {
 		return fmt.Errorf("Source is not valid: %s", modPath)
 	}
 
-	modDir, err := ioutil.TempDir("", "git-module-*")
-	defer os.RemoveAll(modDir)
-	writeDir := filepath.Join(modDir, "mod")
+	repoSrc, subDir := getter.SourceDirSubdir(modPath)
+	repoDir, err := cloneGitRepo(repoSrc)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to clone git module at %s: %v", modPath, err)
 	}
 
-	if err := copyGitModules(modPath, writeDir); err != nil {
-		return fmt.Errorf("failed to clone git module at %s to tmp dir %s: %v",
-			modPath, writeDir, err)
+	return copyFromPath(filepath.Join(repoDir, subDir), copyPath)
+}
+
+// CheckoutGitModule returns the commit checked out for a git module source
+// along with the path of the module within the clone of its repository. The
+// clone made when the module was read is used if there is one.
+func CheckoutGitModule(modPath string) (string, string, error) {
+	if !IsGitPath(modPath) {
+		return "", "", fmt.Errorf("Source is not valid: %s", modPath)
+	}
+
+	repoSrc, subDir := getter.SourceDirSubdir(modPath)
+	repoPath, err := cloneGitRepo(repoSrc)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to clone git module at %s: %v", modPath, err)
 	}
 
-	return copyFromPath(writeDir, copyPath)
+	repo, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return "", "", err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to find the commit of git module %s: %v",
+			modPath, err)
+	}
+	return head.Hash().String(), filepath.Join(repoPath, subDir), nil
 }
@@ -15,10 +15,14 @@
 package sourcereader
 
 import (
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	. "gopkg.in/check.v1"
 )
 
@@ -65,3 +69,40 @@ func (s *MySuite) TestGetModule_Git(c *C) {
 	expectedErr = "Source is not valid: .*"
 	c.Assert(err, ErrorMatches, expectedErr)
 }
+
+func (s *MySuite) TestCheckoutGitModule(c *C) {
+	// Setup: a repository holding a module in a subdirectory
+	repoDir := filepath.Join(testDir, "TestCheckoutGitModule")
+	c.Assert(os.MkdirAll(filepath.Join(repoDir, "module"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(repoDir, "module", "main.tf"), []byte("# module\n"), 0644), IsNil)
+	repo, err := git.PlainInit(repoDir, false)
+	c.Assert(err, IsNil)
+	tree, err := repo.Worktree()
+	c.Assert(err, IsNil)
+	_, err = tree.Add("module/main.tf")
+	c.Assert(err, IsNil)
+	hash, err := tree.Commit("add module", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	c.Assert(err, IsNil)
+	defer RemoveGitClones()
+
+	source := "git::file://" + repoDir + "//module"
+	commit, modPath, err := CheckoutGitModule(source)
+	c.Assert(err, IsNil)
+	c.Check(commit, Equals, hash.String())
+	_, err = os.Stat(filepath.Join(modPath, "main.tf"))
+	c.Check(err, IsNil)
+
+	// the module is read from the same clone
+	c.Assert(os.RemoveAll(repoDir), IsNil)
+	dest := filepath.Join(testDir, "TestCheckoutGitModule_copy")
+	c.Assert(GitSourceReader{}.GetModule(source, dest), IsNil)
+	_, err = os.Stat(filepath.Join(dest, "main.tf"))
+	c.Check(err, IsNil)
+
+	// clones are removed at the end of the run
+	RemoveGitClones()
+	_, err = os.Stat(modPath)
+	c.Check(os.IsNotExist(err), Equals, true)
+}